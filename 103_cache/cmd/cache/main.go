@@ -4,14 +4,36 @@ import (
 	"flag"
 	"log"
 	"strings"
+	"time"
 
 	"github.com/todaatsushi/handrolled-cache/cmd/client"
 	"github.com/todaatsushi/handrolled-cache/cmd/server"
+	"github.com/todaatsushi/handrolled-cache/internal/aof"
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
 )
 
 func main() {
 	port := flag.Int("p", 420, "Runs on.")
 	cacheSize := flag.Int("c", 0, "Max number of items in cache.")
+	maxBytes := flag.Int("m", 0, "Max number of bytes of keys and values in cache.")
+	policyName := flag.String("policy", "lru", "Eviction policy, one of 'lru', 'lfu', 'fifo', 'random', 'tinylfu' or 'approxlru'.")
+	maxValueSize := flag.Int("max-value", server.DEFAULT_MAX_VALUE_SIZE, "Largest value the server accepts, in bytes.")
+	metricsAddr := flag.String("metrics", "", "Address to serve Prometheus metrics on at /metrics, e.g. ':9100'. Off when empty.")
+	readTimeout := flag.Duration("read-timeout", 0, "Close connections that don't send a message for this long. 0 disables.")
+	writeTimeout := flag.Duration("write-timeout", 0, "Close connections that take longer than this to handle and send a response to. 0 disables.")
+	maxConnections := flag.Int("max-conns", 0, "Most client connections open at once, more are closed straight away. 0 is unlimited.")
+	shutdownTimeout := flag.Duration("shutdown-timeout", server.DEFAULT_SHUTDOWN_TIMEOUT, "How long requests get to finish once the server's told to stop.")
+	shards := flag.Int("shards", 1, "Number of independently locked cache shards.")
+	sweepInterval := flag.Duration("e", time.Second, "How often expired items are swept from the cache. 0 disables.")
+	snapshotPath := flag.String("snapshot", "", "File to save snapshots of the cache to and restore from on startup.")
+	snapshotInterval := flag.Duration("snapshot-interval", time.Minute, "How often the cache is snapshotted. 0 disables.")
+	aofPath := flag.String("aof", "", "Append-only log of every change to the cache, replayed on startup.")
+	fsyncPolicy := flag.String("fsync", "everysec", "How often the append-only log is synced to disk, one of 'always', 'everysec' or 'never'.")
+	namespaces := flag.String("namespaces", "", "Comma separated namespaces kept apart from the default, each 'name[:items[:bytes]]' with its own limits.")
+	namespace := flag.String("namespace", "", "Namespace for the client to select. The server's default when empty.")
+	leaderAddr := flag.String("leader", "", "Address of a leader to follow, e.g. 'localhost:420'. Followers serve reads and reject writes.")
+	nodes := flag.String("nodes", "", "Comma separated cache node addresses for the client to spread keys over, e.g. 'localhost:420,localhost:421'.")
+	batch := flag.Int("batch", 0, "Send the client's commands in pipelined batches of this size. 0 sends them one at a time.")
 	runType := flag.String("type", "", "One of 'SERVER' or 'CLIENT'")
 
 	flag.Parse()
@@ -20,9 +42,57 @@ func main() {
 
 	switch t {
 	case "server":
-		log.Fatal(server.Start(*port, *cacheSize))
+		policy, err := cache.ParsePolicy(*policyName)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		fsync, err := aof.ParseFsyncPolicy(*fsyncPolicy)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		extra, err := server.ParseNamespaces(*namespaces)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		cfg := server.Config{
+			CacheSize:     *cacheSize,
+			MaxBytes:      *maxBytes,
+			Policy:        policy,
+			Shards:        *shards,
+			SweepInterval: *sweepInterval,
+			MaxValueSize:  *maxValueSize,
+			MetricsAddr:   *metricsAddr,
+
+			ReadTimeout:     *readTimeout,
+			WriteTimeout:    *writeTimeout,
+			MaxConnections:  *maxConnections,
+			ShutdownTimeout: *shutdownTimeout,
+
+			SnapshotPath:     *snapshotPath,
+			SnapshotInterval: *snapshotInterval,
+
+			AOFPath: *aofPath,
+			Fsync:   fsync,
+
+			LeaderAddr: *leaderAddr,
+			Namespaces: extra,
+		}
+		err = server.Start(*port, cfg)
+		if err != nil {
+			log.Fatal(err)
+		}
 	case "client":
-		log.Fatal(client.Start(*port))
+		if *nodes != "" {
+			log.Fatal(client.StartCluster(strings.Split(*nodes, ","), *namespace))
+		}
+
+		if *batch > 0 {
+			log.Fatal(client.StartPipelined(*port, *batch, *namespace))
+		}
+		log.Fatal(client.Start(*port, *namespace))
 	default:
 		log.Fatal("'type' must be one of 'SERVER' or 'CLIENT'.")
 	}
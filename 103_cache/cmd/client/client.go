@@ -2,6 +2,14 @@ package client
 
 import "github.com/todaatsushi/handrolled-cache/internal/client"
 
-func Start(port int) error {
-	return client.Dial(port)
+func Start(port int, namespace string) error {
+	return client.Dial(port, namespace)
+}
+
+func StartCluster(addrs []string, namespace string) error {
+	return client.DialCluster(addrs, namespace)
+}
+
+func StartPipelined(port int, batch int, namespace string) error {
+	return client.DialPipelined(port, batch, namespace)
 }
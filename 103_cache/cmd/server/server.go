@@ -1,8 +1,33 @@
 package server
 
-import "github.com/todaatsushi/handrolled-cache/internal/server"
+import (
+	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
-func Start(port, cacheSize int) error {
-	s := server.NewServer(cacheSize)
-	return s.Run(port)
+	"github.com/todaatsushi/handrolled-cache/internal/server"
+)
+
+type Config = server.Config
+type Namespace = server.Namespace
+
+const DEFAULT_MAX_VALUE_SIZE = server.DEFAULT_MAX_VALUE_SIZE
+const DEFAULT_SHUTDOWN_TIMEOUT = server.DEFAULT_SHUTDOWN_TIMEOUT
+
+func ParseNamespaces(spec string) ([]Namespace, error) {
+	return server.ParseNamespaces(spec)
+}
+
+// Start runs the server until it's interrupted or sent SIGTERM, then shuts it
+// down cleanly.
+func Start(port int, cfg Config) error {
+	s, err := server.NewServer(cfg)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	return s.Run(ctx, port)
 }
@@ -0,0 +1,373 @@
+package aof
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
+)
+
+// Magic (4B) | Version (1B) | Records
+// Record: Op (1B) | Expires (8B, Unix nanoseconds, 0 == never) | KeyLen (4B) | ValueLen (4B) | Key (x) | Value (x)
+const VERSION byte = 1
+const HEADER_SIZE = 5
+const RECORD_HEADER_SIZE = 17
+
+var magic = []byte("HRCA")
+
+// Don't bother compacting logs smaller than this.
+const minRewriteSize = 1 << 20
+
+type FsyncPolicy byte
+
+const (
+	EverySecond FsyncPolicy = iota
+	Always
+	Never
+)
+
+func (p FsyncPolicy) String() string {
+	switch p {
+	case EverySecond:
+		return "everysec"
+	case Always:
+		return "always"
+	case Never:
+		return "never"
+	default:
+		return fmt.Sprintf("FsyncPolicy(%d)", byte(p))
+	}
+}
+
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch strings.ToLower(name) {
+	case "everysec":
+		return EverySecond, nil
+	case "always":
+		return Always, nil
+	case "never":
+		return Never, nil
+	default:
+		return EverySecond, errors.New(fmt.Sprintf("Invalid fsync policy: %s", name))
+	}
+}
+
+// Log is an append-only record of every change made to a cache, which can be
+// replayed to rebuild it after a restart.
+type Log struct {
+	mu     *sync.Mutex
+	path   string
+	f      *os.File
+	policy FsyncPolicy
+
+	size     int64 // Bytes in the file
+	baseSize int64 // Bytes in the file after the last rewrite
+
+	// Non-nil while a rewrite is running, collecting what's appended meanwhile.
+	rewriteBuf *bytes.Buffer
+}
+
+func Open(path string, policy FsyncPolicy) (*Log, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+
+	size := info.Size()
+	if size == 0 {
+		_, err = f.Write(header())
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		size = HEADER_SIZE
+	}
+
+	return &Log{
+		mu:       &sync.Mutex{},
+		path:     path,
+		f:        f,
+		policy:   policy,
+		size:     size,
+		baseSize: size,
+	}, nil
+}
+
+func header() []byte {
+	return append(append([]byte{}, magic...), VERSION)
+}
+
+func encode(change cache.Change) []byte {
+	record := make([]byte, 0, RECORD_HEADER_SIZE+len(change.Key)+len(change.Value))
+	record = append(record, byte(change.Op))
+
+	var expires int64 // 0 == never expires
+	if change.Op == cache.Stored && !change.Expire.IsZero() {
+		expires = change.Expire.UnixNano()
+	}
+	record = binary.BigEndian.AppendUint64(record, uint64(expires))
+	record = binary.BigEndian.AppendUint32(record, uint32(len(change.Key)))
+	record = binary.BigEndian.AppendUint32(record, uint32(len(change.Value)))
+	record = append(record, change.Key...)
+	record = append(record, change.Value...)
+	return record
+}
+
+// Append writes a change to the end of the log, syncing it to disk straight
+// away when the policy is Always.
+func (l *Log) Append(change cache.Change) error {
+	record := encode(change)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	_, err := l.f.Write(record)
+	if err != nil {
+		return err
+	}
+	l.size += int64(len(record))
+
+	if l.rewriteBuf != nil {
+		l.rewriteBuf.Write(record)
+	}
+
+	if l.policy == Always {
+		return l.f.Sync()
+	}
+	return nil
+}
+
+func (l *Log) Sync() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.f.Sync()
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	err := l.f.Sync()
+	if err != nil {
+		l.f.Close()
+		return err
+	}
+	return l.f.Close()
+}
+
+func (l *Log) Size() int64 {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.size
+}
+
+// Rewrite replaces the log with the smallest one that rebuilds what's in the
+// cache now: one record per item. Changes appended while the new log is being
+// written are kept and copied over at the end, so nothing is lost.
+func (l *Log) Rewrite(c cache.Cache) error {
+	l.mu.Lock()
+	if l.rewriteBuf != nil {
+		l.mu.Unlock()
+		return errors.New("Rewrite already running.")
+	}
+	l.rewriteBuf = &bytes.Buffer{}
+	l.mu.Unlock()
+
+	tmp := l.path + ".tmp"
+	defer os.Remove(tmp)
+
+	err := l.writeItems(tmp, c.Items())
+	if err != nil {
+		l.mu.Lock()
+		l.rewriteBuf = nil
+		l.mu.Unlock()
+		return err
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	buffered := l.rewriteBuf
+	l.rewriteBuf = nil
+
+	f, err := os.OpenFile(tmp, os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(buffered.Bytes())
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, l.path)
+	}
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.f.Close()
+	l.f = f
+	l.size = info.Size()
+	l.baseSize = l.size
+	return nil
+}
+
+func (l *Log) writeItems(path string, items []cache.Node) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	_, err = w.Write(header())
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		change := cache.Change{Op: cache.Stored, Key: item.Key, Value: item.Value, Expire: item.Expire}
+		_, err = w.Write(encode(change))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
+// NeedsRewrite reports whether the log has doubled in size since it was last
+// rewritten.
+func (l *Log) NeedsRewrite() bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return l.size >= minRewriteSize && l.size >= l.baseSize*2
+}
+
+func (l *Log) Policy() FsyncPolicy {
+	return l.policy
+}
+
+// Replay applies every change in the log at path to the cache, returning how
+// many were applied. Stored items that have since expired are skipped. A torn
+// record at the end, from a crash mid-write, is ignored and cut off, so what's
+// appended next follows the last whole record. A torn header is an empty log.
+func Replay(path string, c cache.Cache, clock cache.Clock) (applied int, err error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+
+	h := make([]byte, HEADER_SIZE)
+	n, err := io.ReadFull(r, h)
+	if errors.Is(err, io.EOF) {
+		return 0, nil
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) && bytes.HasPrefix(header(), h[:n]) {
+		return 0, f.Truncate(0)
+	}
+	if err != nil {
+		return 0, errors.New(fmt.Sprint("Couldn't read log header: ", err))
+	}
+
+	if string(h[:4]) != string(magic) {
+		return 0, errors.New("Not an append-only log.")
+	}
+
+	if h[4] != VERSION {
+		return 0, errors.New("Version mismatch.")
+	}
+
+	good := int64(HEADER_SIZE) // End of the last whole record
+	recordHeader := make([]byte, RECORD_HEADER_SIZE)
+	for {
+		_, err = io.ReadFull(r, recordHeader)
+		if errors.Is(err, io.EOF) {
+			return applied, nil
+		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			return applied, f.Truncate(good)
+		}
+		if err != nil {
+			return applied, err
+		}
+
+		op := cache.Op(recordHeader[0])
+		expires := int64(binary.BigEndian.Uint64(recordHeader[1:9]))
+		lenKey := binary.BigEndian.Uint32(recordHeader[9:13])
+		lenValue := binary.BigEndian.Uint32(recordHeader[13:17])
+
+		// Summed as int64, where two uint32s can't overflow. A bad length just
+		// reads to the end of the file, same as a torn record.
+		size := int64(lenKey) + int64(lenValue)
+		var buf bytes.Buffer
+		_, err = io.CopyN(&buf, r, size)
+		if errors.Is(err, io.EOF) {
+			return applied, f.Truncate(good)
+		}
+		if err != nil {
+			return applied, err
+		}
+		good += RECORD_HEADER_SIZE + size
+		body := buf.Bytes()
+
+		key := string(body[:lenKey])
+		switch op {
+		case cache.Stored:
+			var expire time.Time
+			if expires != 0 {
+				expire = time.Unix(0, expires).UTC()
+			}
+
+			if !expire.IsZero() && clock.Expired(expire) {
+				// Could be overwriting a live value, which has expired too.
+				c.Delete(key)
+				continue
+			}
+
+			_, err = c.Set(key, string(body[lenKey:]), expire)
+			if err != nil {
+				continue
+			}
+		case cache.Deleted, cache.Expired, cache.Evicted:
+			c.Delete(key)
+		case cache.Flushed:
+			c.Flush()
+		default:
+			return applied, errors.New(fmt.Sprintf("Invalid log record: %d", byte(op)))
+		}
+		applied++
+	}
+}
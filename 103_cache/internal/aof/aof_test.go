@@ -0,0 +1,422 @@
+package aof_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/aof"
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c clock) Now() time.Time {
+	return c.now
+}
+
+func (c clock) Expired(t time.Time) bool {
+	return t.Before(c.now)
+}
+
+func newClock() clock {
+	t, _ := time.Parse(time.RFC3339, "2069-04-20T15:00:00Z")
+	return clock{t}
+}
+
+// A store that writes every change to the log at path.
+func newLoggedStore(t *testing.T, path string, c clock) (*cache.Store, *aof.Log) {
+	t.Helper()
+
+	l, err := aof.Open(path, aof.Always)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	opts := cache.Options{
+		OnChange: func(change cache.Change) {
+			err := l.Append(change)
+			if err != nil {
+				t.Error(err)
+			}
+		},
+	}
+	return cache.NewStoreWithOptions(opts, c), l
+}
+
+func TestParseFsyncPolicy(t *testing.T) {
+	t.Run("Valid policies", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			expected aof.FsyncPolicy
+		}{
+			{"always", aof.Always},
+			{"everysec", aof.EverySecond},
+			{"NEVER", aof.Never},
+		}
+
+		for _, tc := range cases {
+			actual, err := aof.ParseFsyncPolicy(tc.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, actual)
+			}
+		}
+	})
+
+	t.Run("Invalid policy", func(t *testing.T) {
+		_, err := aof.ParseFsyncPolicy("sometimes")
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Invalid fsync policy: sometimes").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+}
+
+func TestReplay(t *testing.T) {
+	t.Run("Replay changes", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.aof")
+		s, _ := newLoggedStore(t, path, c)
+
+		for i := range 5 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), c.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err := s.Set("0", "updated", c.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Delete("1")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored := cache.NewStore(0, c)
+		applied, err := aof.Replay(path, restored, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if applied != 7 {
+			t.Errorf("Expected %d applied, got %d", 7, applied)
+		}
+
+		value, err := restored.Get("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "updated" {
+			t.Errorf("Expected 'updated', got '%s'", value)
+		}
+
+		_, err = restored.Get("1")
+		if err == nil {
+			t.Error("Expected '1' to be deleted")
+		}
+
+		if restored.NumItems != 4 {
+			t.Errorf("Expected %d items, got %d", 4, restored.NumItems)
+		}
+	})
+
+	t.Run("Replay flush", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.aof")
+		s, _ := newLoggedStore(t, path, c)
+
+		_, err := s.Set("before", "1", c.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		s.Flush()
+
+		_, err = s.Set("after", "2", c.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored := cache.NewStore(0, c)
+		_, err = aof.Replay(path, restored, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = restored.Get("before")
+		if err == nil {
+			t.Error("Expected 'before' to be flushed")
+		}
+
+		_, err = restored.Get("after")
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Skip expired", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.aof")
+		s, _ := newLoggedStore(t, path, c)
+
+		_, err := s.Set("short", "1", c.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		later := clock{c.Now().Add(time.Hour)}
+		restored := cache.NewStore(0, later)
+		_, err = aof.Replay(path, restored, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if restored.NumItems != 0 {
+			t.Errorf("Expected %d items, got %d", 0, restored.NumItems)
+		}
+	})
+
+	t.Run("Replay persist", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.aof")
+		s, _ := newLoggedStore(t, path, c)
+
+		_, err := s.Set("kept", "1", c.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.Expire("kept", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		later := clock{c.Now().Add(time.Hour)}
+		restored := cache.NewStore(0, later)
+		_, err = aof.Replay(path, restored, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node, err := restored.Lookup("kept")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !node.Expire.IsZero() {
+			t.Errorf("Expected no expiry, got %s", node.Expire)
+		}
+	})
+
+	t.Run("Torn record ignored", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.aof")
+		s, l := newLoggedStore(t, path, c)
+
+		for i := range 2 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), c.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := os.Truncate(path, l.Size()-1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored := cache.NewStore(0, c)
+		applied, err := aof.Replay(path, restored, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if applied != 1 {
+			t.Errorf("Expected %d applied, got %d", 1, applied)
+		}
+
+		// Cut off, so the next change isn't stuck behind the torn one.
+		s, _ = newLoggedStore(t, path, c)
+		_, err = s.Set("2", "2", c.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored = cache.NewStore(0, c)
+		applied, err = aof.Replay(path, restored, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if applied != 2 {
+			t.Errorf("Expected %d applied, got %d", 2, applied)
+		}
+	})
+
+	t.Run("Torn header is an empty log", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.aof")
+
+		err := os.WriteFile(path, []byte("HRC"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		applied, err := aof.Replay(path, cache.NewStore(0, c), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if applied != 0 {
+			t.Errorf("Expected %d applied, got %d", 0, applied)
+		}
+
+		s, _ := newLoggedStore(t, path, c)
+		_, err = s.Set("key", "value", c.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		applied, err = aof.Replay(path, cache.NewStore(0, c), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if applied != 1 {
+			t.Errorf("Expected %d applied, got %d", 1, applied)
+		}
+	})
+
+	t.Run("Lengths that add up past 32 bits", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.aof")
+		s, l := newLoggedStore(t, path, c)
+
+		_, err := s.Set("key", "value", c.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+		l.Close()
+
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		binary.BigEndian.PutUint32(data[aof.HEADER_SIZE+9:], math.MaxUint32)
+		binary.BigEndian.PutUint32(data[aof.HEADER_SIZE+13:], 1)
+
+		err = os.WriteFile(path, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		applied, err := aof.Replay(path, cache.NewStore(0, c), c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if applied != 0 {
+			t.Errorf("Expected %d applied, got %d", 0, applied)
+		}
+	})
+
+	t.Run("Not a log", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.aof")
+
+		err := os.WriteFile(path, []byte("not a log"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = aof.Replay(path, cache.NewStore(0, c), c)
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Not an append-only log.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+}
+
+func TestRewrite(t *testing.T) {
+	t.Run("Compacts log", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.aof")
+		s, l := newLoggedStore(t, path, c)
+
+		for i := range 100 {
+			_, err := s.Set("key", fmt.Sprint(i), c.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		before := l.Size()
+		err := l.Rewrite(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		after := l.Size()
+		if after >= before {
+			t.Errorf("Expected log to shrink from %d bytes, got %d", before, after)
+		}
+
+		// Appends carry on into the rewritten log.
+		_, err = s.Set("other", "1", c.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored := cache.NewStore(0, c)
+		applied, err := aof.Replay(path, restored, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if applied != 2 {
+			t.Errorf("Expected %d applied, got %d", 2, applied)
+		}
+
+		value, err := restored.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "99" {
+			t.Errorf("Expected '99', got '%s'", value)
+		}
+
+		_, err = restored.Get("other")
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
@@ -0,0 +1,103 @@
+package cache
+
+import (
+	"math/rand/v2"
+	"sync/atomic"
+)
+
+// Approximate LRU, like Redis: each key keeps a tick of when it was last used
+// instead of a place in a list, and the victim is the least recently used of a
+// few keys picked at random. Marking a key as used is a single atomic store,
+// so the store can take gets with only its read lock held.
+//
+// Like the Redis LRU clock the tick is coarse: it only moves on when a key is
+// added, under the write lock, so gets just read it and don't fight over it.
+// Keys read between the same two sets tie, but are newer than the key added
+// before them and older than the one added after.
+type approxLRU struct {
+	keys  []*approxEntry
+	items map[string]*approxEntry
+	tick  uint64
+}
+
+type approxEntry struct {
+	key   string
+	index int // Position in keys
+	used  atomic.Uint64
+}
+
+// Keys looked at to pick each victim. More is closer to exact LRU but slower
+// to evict.
+const approxSamples = 5
+
+func newApproxLRU() *approxLRU {
+	return &approxLRU{
+		keys:  []*approxEntry{},
+		items: make(map[string]*approxEntry),
+	}
+}
+
+// Accessed only reads the map, which nothing changes under the read lock.
+func (p *approxLRU) concurrent() {}
+
+func (p *approxLRU) Added(key string) {
+	// Moved on either side, so the new key is newer than any read before it
+	// and older than any read after.
+	p.tick++
+	entry := &approxEntry{key: key, index: len(p.keys)}
+	entry.used.Store(p.tick)
+	p.tick++
+
+	p.items[key] = entry
+	p.keys = append(p.keys, entry)
+}
+
+func (p *approxLRU) Accessed(key string) {
+	// Skip the store if it's already up to date, so hot keys aren't written
+	// by every get.
+	if entry, ok := p.items[key]; ok && entry.used.Load() != p.tick {
+		entry.used.Store(p.tick)
+	}
+}
+
+func (p *approxLRU) Removed(key string) {
+	entry, ok := p.items[key]
+	if !ok {
+		return
+	}
+
+	// Move the last key into the gap so keys stays contiguous.
+	last := len(p.keys) - 1
+	p.keys[entry.index] = p.keys[last]
+	p.keys[entry.index].index = entry.index
+
+	p.keys = p.keys[:last]
+	delete(p.items, key)
+}
+
+func (p *approxLRU) Victim() (string, bool) {
+	if len(p.keys) == 0 {
+		return "", false
+	}
+
+	// Few enough to look at them all, which is exact bar keys read between
+	// the same two sets.
+	if len(p.keys) <= approxSamples {
+		oldest := p.keys[0]
+		for _, entry := range p.keys[1:] {
+			if entry.used.Load() < oldest.used.Load() {
+				oldest = entry
+			}
+		}
+		return oldest.key, true
+	}
+
+	oldest := p.keys[rand.IntN(len(p.keys))]
+	for range approxSamples - 1 {
+		entry := p.keys[rand.IntN(len(p.keys))]
+		if entry.used.Load() < oldest.used.Load() {
+			oldest = entry
+		}
+	}
+	return oldest.key, true
+}
@@ -0,0 +1,48 @@
+package cache
+
+// Min heap of nodes ordered by expiry, so the sweeper only ever has to look at
+// the items that are due rather than scanning the whole store. Items that never
+// expire sink to the bottom.
+type expiryHeap []*Node
+
+func (h expiryHeap) Len() int {
+	return len(h)
+}
+
+func (h expiryHeap) Less(i, j int) bool {
+	if h[i].Expire.IsZero() || h[j].Expire.IsZero() {
+		return h[j].Expire.IsZero() && !h[i].Expire.IsZero()
+	}
+	return h[i].Expire.Before(h[j].Expire)
+}
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	node := x.(*Node)
+	node.index = len(*h)
+	*h = append(*h, node)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	n := len(old)
+
+	node := old[n-1]
+	old[n-1] = nil
+	node.index = -1
+
+	*h = old[:n-1]
+	return node
+}
+
+func (h expiryHeap) peek() *Node {
+	if len(h) == 0 {
+		return nil
+	}
+	return h[0]
+}
@@ -0,0 +1,290 @@
+package cache
+
+import (
+	"container/heap"
+	"container/list"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"strings"
+)
+
+// EvictionPolicy decides which item is dropped when the store is full. The
+// store calls it with its lock held, so implementations don't need their own.
+type EvictionPolicy interface {
+	// Added is called when a key is stored for the first time.
+	Added(key string)
+	// Accessed is called when a stored key is read or overwritten.
+	Accessed(key string)
+	// Removed is called when a key leaves the store for any reason.
+	Removed(key string)
+	// Victim picks the next key to evict, false if there's nothing to evict.
+	Victim() (key string, ok bool)
+}
+
+// A policy that's safe to call Accessed on with only the store's read lock
+// held, so gets don't wait on each other. Everything else still gets the write
+// lock.
+type concurrentPolicy interface {
+	EvictionPolicy
+	concurrent()
+}
+
+type Policy byte
+
+const (
+	LRU Policy = iota
+	LFU
+	FIFO
+	Random
+	TinyLFU
+	ApproxLRU
+)
+
+func (p Policy) String() string {
+	switch p {
+	case LRU:
+		return "lru"
+	case LFU:
+		return "lfu"
+	case FIFO:
+		return "fifo"
+	case Random:
+		return "random"
+	case TinyLFU:
+		return "tinylfu"
+	case ApproxLRU:
+		return "approxlru"
+	default:
+		return fmt.Sprintf("Policy(%d)", byte(p))
+	}
+}
+
+func ParsePolicy(name string) (Policy, error) {
+	switch strings.ToLower(name) {
+	case "lru":
+		return LRU, nil
+	case "lfu":
+		return LFU, nil
+	case "fifo":
+		return FIFO, nil
+	case "random":
+		return Random, nil
+	case "tinylfu":
+		return TinyLFU, nil
+	case "approxlru":
+		return ApproxLRU, nil
+	default:
+		return LRU, errors.New(fmt.Sprintf("Invalid eviction policy: %s", name))
+	}
+}
+
+// Used to size TinyLFU's frequency sketch when there's no item limit.
+const defaultCapacity = 1024
+
+func newEvictionPolicy(opts Options) EvictionPolicy {
+	switch opts.Policy {
+	case LFU:
+		return newLFU()
+	case FIFO:
+		return newFIFO()
+	case Random:
+		return newRandom()
+	case TinyLFU:
+		capacity := int(opts.MaxItems)
+		if capacity == 0 {
+			capacity = defaultCapacity
+		}
+		return newTinyLFU(capacity)
+	case ApproxLRU:
+		return newApproxLRU()
+	default:
+		return newLRU()
+	}
+}
+
+// Evicts the least recently used key.
+type lru struct {
+	ll    *list.List
+	items map[string]*list.Element
+}
+
+func newLRU() *lru {
+	return &lru{
+		ll:    list.New(),
+		items: make(map[string]*list.Element),
+	}
+}
+
+func (p *lru) Added(key string) {
+	p.items[key] = p.ll.PushFront(key)
+}
+
+func (p *lru) Accessed(key string) {
+	if item, ok := p.items[key]; ok {
+		p.ll.MoveToFront(item)
+	}
+}
+
+func (p *lru) Removed(key string) {
+	if item, ok := p.items[key]; ok {
+		p.ll.Remove(item)
+		delete(p.items, key)
+	}
+}
+
+func (p *lru) Victim() (string, bool) {
+	last := p.ll.Back()
+	if last == nil {
+		return "", false
+	}
+	return last.Value.(string), true
+}
+
+// Evicts the oldest key, regardless of how it's been used since.
+type fifo struct {
+	lru
+}
+
+func newFIFO() *fifo {
+	return &fifo{*newLRU()}
+}
+
+func (p *fifo) Accessed(key string) {}
+
+// Evicts the least frequently used key, the least recently used of those on a
+// tie.
+type lfu struct {
+	entries lfuHeap
+	items   map[string]*lfuEntry
+	tick    uint64
+}
+
+type lfuEntry struct {
+	key      string
+	count    uint64
+	lastUsed uint64
+	index    int
+}
+
+type lfuHeap []*lfuEntry
+
+func (h lfuHeap) Len() int {
+	return len(h)
+}
+
+func (h lfuHeap) Less(i, j int) bool {
+	if h[i].count == h[j].count {
+		return h[i].lastUsed < h[j].lastUsed
+	}
+	return h[i].count < h[j].count
+}
+
+func (h lfuHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *lfuHeap) Push(x any) {
+	entry := x.(*lfuEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *lfuHeap) Pop() any {
+	old := *h
+	n := len(old)
+
+	entry := old[n-1]
+	old[n-1] = nil
+
+	*h = old[:n-1]
+	return entry
+}
+
+func newLFU() *lfu {
+	return &lfu{
+		entries: lfuHeap{},
+		items:   make(map[string]*lfuEntry),
+	}
+}
+
+func (p *lfu) Added(key string) {
+	p.tick++
+
+	entry := &lfuEntry{key: key, count: 1, lastUsed: p.tick}
+	heap.Push(&p.entries, entry)
+	p.items[key] = entry
+}
+
+func (p *lfu) Accessed(key string) {
+	entry, ok := p.items[key]
+	if !ok {
+		return
+	}
+
+	p.tick++
+	entry.count++
+	entry.lastUsed = p.tick
+	heap.Fix(&p.entries, entry.index)
+}
+
+func (p *lfu) Removed(key string) {
+	entry, ok := p.items[key]
+	if !ok {
+		return
+	}
+
+	heap.Remove(&p.entries, entry.index)
+	delete(p.items, key)
+}
+
+func (p *lfu) Victim() (string, bool) {
+	if len(p.entries) == 0 {
+		return "", false
+	}
+	return p.entries[0].key, true
+}
+
+// Evicts any key.
+type random struct {
+	keys  []string
+	items map[string]int // Position in keys
+}
+
+func newRandom() *random {
+	return &random{
+		keys:  []string{},
+		items: make(map[string]int),
+	}
+}
+
+func (p *random) Added(key string) {
+	p.items[key] = len(p.keys)
+	p.keys = append(p.keys, key)
+}
+
+func (p *random) Accessed(key string) {}
+
+func (p *random) Removed(key string) {
+	i, ok := p.items[key]
+	if !ok {
+		return
+	}
+
+	// Move the last key into the gap so keys stays contiguous.
+	last := len(p.keys) - 1
+	p.keys[i] = p.keys[last]
+	p.items[p.keys[i]] = i
+
+	p.keys = p.keys[:last]
+	delete(p.items, key)
+}
+
+func (p *random) Victim() (string, bool) {
+	if len(p.keys) == 0 {
+		return "", false
+	}
+	return p.keys[rand.IntN(len(p.keys))], true
+}
@@ -0,0 +1,390 @@
+package cache_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"testing"
+
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
+)
+
+func TestParsePolicy(t *testing.T) {
+	t.Run("Valid policies", func(t *testing.T) {
+		cases := []struct {
+			name     string
+			expected cache.Policy
+		}{
+			{"lru", cache.LRU},
+			{"LFU", cache.LFU},
+			{"fifo", cache.FIFO},
+			{"random", cache.Random},
+			{"TinyLFU", cache.TinyLFU},
+			{"approxlru", cache.ApproxLRU},
+		}
+
+		for _, tc := range cases {
+			actual, err := cache.ParsePolicy(tc.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != tc.expected {
+				t.Errorf("Expected %s, got %s", tc.expected, actual)
+			}
+		}
+	})
+
+	t.Run("Invalid policy", func(t *testing.T) {
+		_, err := cache.ParsePolicy("mru")
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Invalid eviction policy: mru").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+}
+
+func newStoreWithPolicy(t *testing.T, policy cache.Policy, maxItems uint64) *cache.Store {
+	t.Helper()
+	return cache.NewStoreWithOptions(cache.Options{MaxItems: maxItems, Policy: policy}, clock)
+}
+
+func set(t *testing.T, s *cache.Store, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		_, err := s.Set(key, key, clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func get(t *testing.T, s *cache.Store, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		_, err := s.Get(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func stored(s *cache.Store, key string) bool {
+	_, err := s.Get(key)
+	return err == nil
+}
+
+func TestPolicies(t *testing.T) {
+	t.Run("LRU evicts least recently used", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.LRU, 2)
+
+		set(t, s, "a", "b")
+		get(t, s, "a")
+		set(t, s, "c")
+
+		if stored(s, "b") {
+			t.Error("Expected 'b' to be evicted")
+		}
+
+		if !stored(s, "a") {
+			t.Error("Expected 'a' to be stored")
+		}
+	})
+
+	t.Run("LFU evicts least frequently used", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.LFU, 2)
+
+		set(t, s, "a", "b")
+		get(t, s, "a", "a", "b")
+		set(t, s, "c")
+
+		if stored(s, "b") {
+			t.Error("Expected 'b' to be evicted")
+		}
+
+		if !stored(s, "a") {
+			t.Error("Expected 'a' to be stored")
+		}
+	})
+
+	t.Run("LFU ties broken by recency", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.LFU, 2)
+
+		set(t, s, "a", "b")
+		get(t, s, "b", "a")
+		set(t, s, "c")
+
+		if stored(s, "b") {
+			t.Error("Expected 'b' to be evicted")
+		}
+	})
+
+	t.Run("FIFO evicts oldest", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.FIFO, 2)
+
+		set(t, s, "a", "b")
+		get(t, s, "a")
+		set(t, s, "c")
+
+		if stored(s, "a") {
+			t.Error("Expected 'a' to be evicted")
+		}
+
+		if !stored(s, "b") {
+			t.Error("Expected 'b' to be stored")
+		}
+	})
+
+	t.Run("Random stays within limit", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.Random, 5)
+
+		for i := range 100 {
+			set(t, s, fmt.Sprint(i))
+		}
+
+		if s.NumItems != 5 {
+			t.Errorf("Expected %d items, got %d", 5, s.NumItems)
+		}
+
+		if !stored(s, "99") {
+			t.Error("Expected newest item to be stored")
+		}
+	})
+
+	t.Run("Approximate LRU is exact with only a few keys", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.ApproxLRU, 3)
+
+		set(t, s, "a", "b", "c")
+		get(t, s, "a")
+		set(t, s, "d")
+
+		if stored(s, "b") {
+			t.Error("Expected 'b' to be evicted")
+		}
+
+		for _, key := range []string{"a", "c", "d"} {
+			if !stored(s, key) {
+				t.Errorf("Expected '%s' to be stored", key)
+			}
+		}
+	})
+
+	t.Run("Approximate LRU keeps keys read since the last set", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.ApproxLRU, 3)
+
+		set(t, s, "a", "b", "c")
+		get(t, s, "b")
+		get(t, s, "a")
+		set(t, s, "d")
+
+		if stored(s, "c") {
+			t.Error("Expected 'c' to be evicted")
+		}
+
+		for _, key := range []string{"a", "b", "d"} {
+			if !stored(s, key) {
+				t.Errorf("Expected '%s' to be stored", key)
+			}
+		}
+	})
+
+	t.Run("Approximate LRU keeps keys in use", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.ApproxLRU, 200)
+
+		hot := []string{}
+		for i := range 50 {
+			hot = append(hot, fmt.Sprint("hot", i))
+		}
+		set(t, s, hot...)
+
+		for i := range 1000 {
+			if i%20 == 0 {
+				for _, key := range hot {
+					s.Get(key)
+				}
+			}
+			set(t, s, fmt.Sprint("cold", i))
+		}
+
+		if s.NumItems != 200 {
+			t.Errorf("Expected %d items, got %d", 200, s.NumItems)
+		}
+
+		// Victims are sampled, so allow for a few unlucky keys. Exact LRU would
+		// keep them all.
+		kept := 0
+		for _, key := range hot {
+			if stored(s, key) {
+				kept++
+			}
+		}
+
+		if kept < len(hot)-10 {
+			t.Errorf("Expected at least %d hot keys to be stored, got %d", len(hot)-10, kept)
+		}
+	})
+
+	t.Run("Approximate LRU gets run at the same time as sets", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.ApproxLRU, 100)
+		for i := range 100 {
+			set(t, s, fmt.Sprint(i))
+		}
+
+		var wg sync.WaitGroup
+		for w := range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := range 1000 {
+					key := fmt.Sprint((i * (w + 1)) % 150)
+					if w == 0 {
+						s.Set(key, key, clock.Now())
+						continue
+					}
+					s.Get(key)
+				}
+			}()
+		}
+		wg.Wait()
+
+		if s.NumItems != 100 {
+			t.Errorf("Expected %d items, got %d", 100, s.NumItems)
+		}
+	})
+
+	t.Run("Deleted keys aren't evicted", func(t *testing.T) {
+		for _, policy := range []cache.Policy{cache.LRU, cache.LFU, cache.FIFO, cache.Random, cache.TinyLFU, cache.ApproxLRU} {
+			s := newStoreWithPolicy(t, policy, 2)
+
+			set(t, s, "a", "b")
+			err := s.Delete("a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			set(t, s, "c")
+
+			if s.NumItems != 2 {
+				t.Errorf("%s: Expected %d items, got %d", policy, 2, s.NumItems)
+			}
+
+			if !stored(s, "b") || !stored(s, "c") {
+				t.Errorf("%s: Expected 'b' and 'c' to be stored", policy)
+			}
+		}
+	})
+}
+
+func TestScanResistance(t *testing.T) {
+	hot := []string{}
+	for i := range 10 {
+		hot = append(hot, fmt.Sprint("hot", i))
+	}
+
+	warmUpAndScan := func(t *testing.T, s *cache.Store) {
+		t.Helper()
+
+		set(t, s, hot...)
+		for range 10 {
+			get(t, s, hot...)
+		}
+
+		for i := range 500 {
+			set(t, s, fmt.Sprint("scan", i))
+		}
+	}
+
+	t.Run("TinyLFU keeps hot keys", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.TinyLFU, 100)
+		warmUpAndScan(t, s)
+
+		// The frequency sketch is probabilistic, so allow for one unlucky key.
+		kept := 0
+		for _, key := range hot {
+			if stored(s, key) {
+				kept++
+			}
+		}
+
+		if kept < len(hot)-1 {
+			t.Errorf("Expected at least %d hot keys to be stored, got %d", len(hot)-1, kept)
+		}
+
+		if s.NumItems != 100 {
+			t.Errorf("Expected %d items, got %d", 100, s.NumItems)
+		}
+	})
+
+	t.Run("LRU loses hot keys", func(t *testing.T) {
+		s := newStoreWithPolicy(t, cache.LRU, 100)
+		warmUpAndScan(t, s)
+
+		for _, key := range hot {
+			if stored(s, key) {
+				t.Errorf("Expected '%s' to be evicted", key)
+			}
+		}
+	})
+}
+
+// Exact LRU moves the key to the front of a list on every get, so needs the
+// write lock. Approximate LRU gets by with the read lock.
+var lruPolicies = []cache.Policy{cache.LRU, cache.ApproxLRU}
+
+func BenchmarkLRUGetParallel(b *testing.B) {
+	for _, policy := range lruPolicies {
+		b.Run(policy.String(), func(b *testing.B) {
+			s := cache.NewStoreWithOptions(cache.Options{Policy: policy}, clock)
+			keys := make([]string, 1024)
+			for i := range keys {
+				keys[i] = fmt.Sprint("key", i)
+				s.Set(keys[i], keys[i], clock.Future())
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					s.Get(keys[rand.IntN(len(keys))])
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkLRUReadHeavyParallel(b *testing.B) {
+	for _, policy := range lruPolicies {
+		b.Run(policy.String(), func(b *testing.B) {
+			benchmarkParallel(b, cache.NewStoreWithOptions(cache.Options{Policy: policy}, clock))
+		})
+	}
+}
+
+// Every set is a new key over the limit, so evicts.
+func BenchmarkLRUEvictingParallel(b *testing.B) {
+	for _, policy := range lruPolicies {
+		b.Run(policy.String(), func(b *testing.B) {
+			s := cache.NewStoreWithOptions(cache.Options{MaxItems: 1024, Policy: policy}, clock)
+			keys := make([]string, 2048)
+			for i := range keys {
+				keys[i] = fmt.Sprint("key", i)
+			}
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					key := keys[rand.IntN(len(keys))]
+					_, err := s.Get(key)
+					if err != nil {
+						s.Set(key, key, clock.Future())
+					}
+				}
+			})
+		})
+	}
+}
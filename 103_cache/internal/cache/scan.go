@@ -0,0 +1,93 @@
+package cache
+
+import "slices"
+
+// Page size for a Scan given a count of 0 or less.
+const DEFAULT_SCAN_COUNT = 10
+
+// Scan returns up to count keys matching the pattern, in order, starting after
+// the cursor. The next cursor is the last key returned, or "" once there's
+// nothing left. Keys there for the whole scan are returned exactly once however
+// the cache changes in between, keys added or removed part way might not be.
+// A count of 0 or less is DEFAULT_SCAN_COUNT.
+//
+// Every call walks every key, so this is for debugging and bulk deletes rather
+// than anything on a hot path.
+func (s *Store) Scan(cursor string, pattern string, count int) ([]string, string) {
+	s.mu.RLock()
+	keys := []string{}
+	for key, node := range s.store {
+		if key > cursor && !s.expired(node) && Match(pattern, key) {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.RUnlock()
+
+	slices.Sort(keys)
+	return page(keys, count)
+}
+
+// Trims sorted keys down to a page, with the cursor for the next one.
+func page(keys []string, count int) ([]string, string) {
+	if count <= 0 {
+		count = DEFAULT_SCAN_COUNT
+	}
+
+	if len(keys) <= count {
+		return keys, ""
+	}
+
+	keys = keys[:count]
+	return keys, keys[count-1]
+}
+
+// Match reports whether the key matches the glob pattern, where * matches any
+// run of characters, ? any single one and \ makes the next one literal. An
+// empty pattern matches everything.
+func Match(pattern string, key string) bool {
+	if pattern == "" {
+		return true
+	}
+	return match([]rune(pattern), []rune(key))
+}
+
+func match(pattern []rune, key []rune) bool {
+	// Where to go back to if what's after the last * doesn't match.
+	star, retry := -1, 0
+
+	p, k := 0, 0
+	for k < len(key) {
+		if p < len(pattern) {
+			switch {
+			case pattern[p] == '*':
+				star, retry = p, k
+				p++
+				continue
+			case pattern[p] == '?':
+				p, k = p+1, k+1
+				continue
+			case pattern[p] == '\\' && p+1 < len(pattern):
+				if pattern[p+1] == key[k] {
+					p, k = p+2, k+1
+					continue
+				}
+			case pattern[p] == key[k]:
+				p, k = p+1, k+1
+				continue
+			}
+		}
+
+		if star == -1 {
+			return false
+		}
+
+		// Let the * take one more character and try again.
+		retry++
+		p, k = star+1, retry
+	}
+
+	for p < len(pattern) && pattern[p] == '*' {
+		p++
+	}
+	return p == len(pattern)
+}
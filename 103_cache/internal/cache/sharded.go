@@ -0,0 +1,257 @@
+package cache
+
+import (
+	"hash/maphash"
+	"slices"
+	"time"
+)
+
+// Cache is what the server needs from a store, so it can run on either a
+// single Store or a ShardedStore.
+type Cache interface {
+	Set(key string, value string, expires time.Time) (time.Time, error)
+	SetNX(key string, value string, expires time.Time) (time.Time, error)
+	SetXX(key string, value string, expires time.Time) (time.Time, error)
+	Get(key string) ([]byte, error)
+	Lookup(key string) (Node, error)
+	MGet(keys []string) []Result
+	MSet(items []Node) []Result
+	Incr(key string, delta int64, expires time.Time) (int64, time.Time, error)
+	CompareAndSet(key string, value string, expires time.Time, version uint64) (time.Time, uint64, error)
+	Expire(key string, expires time.Time) (time.Time, error)
+	Scan(cursor string, pattern string, count int) ([]string, string)
+	Delete(key string) error
+	Flush() uint64
+	Usage() (items uint64, bytes uint64)
+	Stats() Stats
+	Items() []Node
+	DeleteExpired() int
+	Sweep(tick <-chan time.Time, done <-chan struct{})
+}
+
+// ShardedStore spreads keys over independent Stores, each with its own lock
+// and eviction policy, so requests for different keys don't wait on each
+// other. Limits are split evenly between the shards.
+type ShardedStore struct {
+	shards []*Store
+	seed   maphash.Seed
+}
+
+// Index of the shard the key lives in.
+func (s *ShardedStore) shardIndex(key string) int {
+	return int(maphash.String(s.seed, key) % uint64(len(s.shards)))
+}
+
+func (s *ShardedStore) shard(key string) *Store {
+	return s.shards[s.shardIndex(key)]
+}
+
+func (s *ShardedStore) Set(key string, value string, expires time.Time) (time.Time, error) {
+	return s.shard(key).Set(key, value, expires)
+}
+
+func (s *ShardedStore) SetNX(key string, value string, expires time.Time) (time.Time, error) {
+	return s.shard(key).SetNX(key, value, expires)
+}
+
+func (s *ShardedStore) SetXX(key string, value string, expires time.Time) (time.Time, error) {
+	return s.shard(key).SetXX(key, value, expires)
+}
+
+func (s *ShardedStore) Get(key string) ([]byte, error) {
+	return s.shard(key).Get(key)
+}
+
+func (s *ShardedStore) Lookup(key string) (Node, error) {
+	return s.shard(key).Lookup(key)
+}
+
+// Locks the shards the keys live in, always in index order so two batches
+// can't each hold a shard the other is waiting for.
+func (s *ShardedStore) lockShards(keys []string) (unlock func()) {
+	locked := make([]bool, len(s.shards))
+	for _, key := range keys {
+		locked[s.shardIndex(key)] = true
+	}
+
+	for i, shard := range s.shards {
+		if locked[i] {
+			shard.mu.Lock()
+		}
+	}
+
+	return func() {
+		for i, shard := range s.shards {
+			if locked[i] {
+				shard.mu.Unlock()
+			}
+		}
+	}
+}
+
+// MGet locks every shard involved at once, so the values are from a single
+// point in time.
+func (s *ShardedStore) MGet(keys []string) []Result {
+	unlock := s.lockShards(keys)
+	defer unlock()
+
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		shard := s.shard(key)
+		node, err := shard.getLocked(key)
+		shard.countRead(err)
+		results[i] = Result{node.Value, node.Expire, err}
+	}
+	return results
+}
+
+// MSet locks every shard involved at once, so no one sees only some of the
+// items. Ones evicted by a later item are reported as ErrEvicted.
+func (s *ShardedStore) MSet(items []Node) []Result {
+	keys := make([]string, len(items))
+	for i, item := range items {
+		keys[i] = item.Key
+	}
+
+	unlock := s.lockShards(keys)
+	defer unlock()
+
+	results := make([]Result, len(items))
+	for i, item := range items {
+		expires, err := s.shard(item.Key).setLocked(item.Key, string(item.Value), item.Expire, always)
+		results[i] = Result{nil, expires, err}
+	}
+
+	for i, item := range items {
+		s.shard(item.Key).checkEvicted(item.Key, &results[i])
+	}
+	return results
+}
+
+func (s *ShardedStore) Incr(key string, delta int64, expires time.Time) (int64, time.Time, error) {
+	return s.shard(key).Incr(key, delta, expires)
+}
+
+func (s *ShardedStore) CompareAndSet(key string, value string, expires time.Time, version uint64) (time.Time, uint64, error) {
+	return s.shard(key).CompareAndSet(key, value, expires, version)
+}
+
+func (s *ShardedStore) Expire(key string, expires time.Time) (time.Time, error) {
+	return s.shard(key).Expire(key, expires)
+}
+
+// Scan takes a page from every shard and keeps the first keys of them all, as
+// the cursor works the same across shards.
+func (s *ShardedStore) Scan(cursor string, pattern string, count int) ([]string, string) {
+	keys := []string{}
+	more := false
+	for _, shard := range s.shards {
+		shardKeys, next := shard.Scan(cursor, pattern, count)
+		keys = append(keys, shardKeys...)
+		more = more || next != ""
+	}
+
+	slices.Sort(keys)
+	keys, next := page(keys, count)
+	if next == "" && more {
+		next = keys[len(keys)-1]
+	}
+	return keys, next
+}
+
+func (s *ShardedStore) Delete(key string) error {
+	return s.shard(key).Delete(key)
+}
+
+func (s *ShardedStore) Flush() (flushed uint64) {
+	for _, shard := range s.shards {
+		flushed += shard.Flush()
+	}
+	return flushed
+}
+
+func (s *ShardedStore) Usage() (items uint64, bytes uint64) {
+	for _, shard := range s.shards {
+		i, b := shard.Usage()
+		items += i
+		bytes += b
+	}
+	return items, bytes
+}
+
+func (s *ShardedStore) Stats() (stats Stats) {
+	for _, shard := range s.shards {
+		stats = stats.add(shard.Stats())
+	}
+	return stats
+}
+
+// Items locks every shard at once so the copy is a single point in time.
+func (s *ShardedStore) Items() []Node {
+	for _, shard := range s.shards {
+		shard.mu.Lock()
+		defer shard.mu.Unlock()
+	}
+
+	items := []Node{}
+	for _, shard := range s.shards {
+		items = append(items, shard.items()...)
+	}
+	return items
+}
+
+func (s *ShardedStore) DeleteExpired() (removed int) {
+	for _, shard := range s.shards {
+		removed += shard.DeleteExpired()
+	}
+	return removed
+}
+
+func (s *ShardedStore) Sweep(tick <-chan time.Time, done <-chan struct{}) {
+	for {
+		select {
+		case <-tick:
+			s.DeleteExpired()
+		case <-done:
+			return
+		}
+	}
+}
+
+func NewShardedStore(shards int, opts Options, c Clock) *ShardedStore {
+	shards = max(1, shards)
+
+	// Every shard needs a share of a limit, as 0 would mean unlimited, so a
+	// limit smaller than the shard count means fewer shards.
+	for _, limit := range []uint64{opts.MaxItems, opts.MaxBytes} {
+		if limit > 0 && limit < uint64(shards) {
+			shards = int(limit)
+		}
+	}
+
+	s := &ShardedStore{
+		shards: make([]*Store, shards),
+		seed:   maphash.MakeSeed(),
+	}
+	for i := range s.shards {
+		perShard := Options{
+			MaxItems: divideLimit(opts.MaxItems, shards, i),
+			MaxBytes: divideLimit(opts.MaxBytes, shards, i),
+			Policy:   opts.Policy,
+			OnChange: opts.OnChange,
+		}
+		s.shards[i] = NewStoreWithOptions(perShard, c)
+	}
+	return s
+}
+
+// The ith shard's share of the limit. The first limit % shards get one more,
+// so the shares add up to the limit.
+func divideLimit(limit uint64, shards int, i int) uint64 {
+	n := uint64(shards)
+	share := limit / n
+	if uint64(i) < limit%n {
+		share++
+	}
+	return share
+}
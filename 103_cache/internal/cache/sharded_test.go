@@ -0,0 +1,173 @@
+package cache_test
+
+import (
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
+)
+
+func TestShardedStore(t *testing.T) {
+	t.Run("Set and get across shards", func(t *testing.T) {
+		s := cache.NewShardedStore(4, cache.Options{}, clock)
+
+		for i := range 100 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		for i := range 100 {
+			value, err := s.Get(fmt.Sprint(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(value) != fmt.Sprint(i) {
+				t.Errorf("Expected '%d', got '%s'", i, value)
+			}
+		}
+
+		items, _ := s.Usage()
+		if items != 100 {
+			t.Errorf("Expected %d items, got %d", 100, items)
+		}
+	})
+
+	t.Run("Delete", func(t *testing.T) {
+		s := cache.NewShardedStore(4, cache.Options{}, clock)
+
+		_, err := s.Set("key", "420", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Delete("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.Get("key")
+		if err == nil {
+			t.Fatal("Expected err, got nil")
+		}
+
+		expected := errors.New("Value doesn't exist.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Flush all shards", func(t *testing.T) {
+		s := cache.NewShardedStore(4, cache.Options{}, clock)
+
+		for i := range 100 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		flushed := s.Flush()
+		if flushed != 100 {
+			t.Errorf("Expected %d flushed, got %d", 100, flushed)
+		}
+
+		items, bytes := s.Usage()
+		if items != 0 || bytes != 0 {
+			t.Errorf("Expected empty store, got %d items and %d bytes", items, bytes)
+		}
+	})
+
+	t.Run("Limits split between shards", func(t *testing.T) {
+		s := cache.NewShardedStore(4, cache.Options{MaxItems: 8}, clock)
+
+		for i := range 100 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		items, _ := s.Usage()
+		if items > 8 {
+			t.Errorf("Expected at most %d items, got %d", 8, items)
+		}
+	})
+
+	t.Run("Limits add up to the total", func(t *testing.T) {
+		for _, limit := range []uint64{10, 2} {
+			s := cache.NewShardedStore(4, cache.Options{MaxItems: limit}, clock)
+
+			for i := range 100 {
+				_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), clock.Now())
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			items, _ := s.Usage()
+			if items != limit {
+				t.Errorf("Expected %d items, got %d", limit, items)
+			}
+		}
+	})
+
+	t.Run("Delete expired across shards", func(t *testing.T) {
+		s := cache.NewShardedStore(4, cache.Options{}, c{true})
+
+		for i := range 10 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		removed := s.DeleteExpired()
+		if removed != 10 {
+			t.Errorf("Expected %d removed, got %d", 10, removed)
+		}
+	})
+}
+
+func benchmarkParallel(b *testing.B, s cache.Cache) {
+	keys := make([]string, 1024)
+	for i := range keys {
+		keys[i] = fmt.Sprint("key", i)
+		_, err := s.Set(keys[i], keys[i], clock.Future())
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			key := keys[rand.IntN(len(keys))]
+
+			// Read heavy: 9 gets to every set.
+			if rand.IntN(10) == 0 {
+				s.Set(key, key, clock.Future())
+			} else {
+				s.Get(key)
+			}
+		}
+	})
+}
+
+func BenchmarkStoreParallel(b *testing.B) {
+	benchmarkParallel(b, cache.NewStore(0, clock))
+}
+
+func BenchmarkShardedStoreParallel(b *testing.B) {
+	for _, shards := range []int{4, 16, 64} {
+		b.Run(fmt.Sprint(shards, "Shards"), func(b *testing.B) {
+			benchmarkParallel(b, cache.NewShardedStore(shards, cache.Options{}, clock))
+		})
+	}
+}
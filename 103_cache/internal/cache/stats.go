@@ -0,0 +1,39 @@
+package cache
+
+// Stats is what's in the store now, and counts of what's happened to it since
+// it was created.
+type Stats struct {
+	Items       uint64
+	Bytes       uint64
+	Hits        uint64 // Reads that found the key
+	Misses      uint64 // Reads of keys that were missing or had expired
+	Evictions   uint64 // Removed by the policy to make room
+	Expirations uint64 // Removed once expired, on access or by a sweep
+}
+
+func (s Stats) add(other Stats) Stats {
+	return Stats{
+		Items:       s.Items + other.Items,
+		Bytes:       s.Bytes + other.Bytes,
+		Hits:        s.Hits + other.Hits,
+		Misses:      s.Misses + other.Misses,
+		Evictions:   s.Evictions + other.Evictions,
+		Expirations: s.Expirations + other.Expirations,
+	}
+}
+
+// Stats reports what's stored and how often reads have hit, along with how
+// many items have been evicted or expired.
+func (s *Store) Stats() Stats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return Stats{
+		Items:       s.NumItems,
+		Bytes:       s.NumBytes,
+		Hits:        s.hits.Load(),
+		Misses:      s.misses.Load(),
+		Evictions:   s.evictions,
+		Expirations: s.expirations,
+	}
+}
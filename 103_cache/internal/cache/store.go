@@ -1,84 +1,562 @@
 package cache
 
 import (
-	"container/list"
+	"container/heap"
 	"errors"
+	"math"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	ErrNotFound   = errors.New("Value doesn't exist.")
+	ErrExpired    = errors.New("Expired.")
+	ErrExists     = errors.New("Value already exists.")
+	ErrTooLarge   = errors.New("Value too large for cache.")
+	ErrPastExpiry = errors.New("Expiry can't be in the past.")
+	ErrNotInteger = errors.New("Value isn't an integer.")
+	ErrOverflow   = errors.New("Increment would overflow.")
+	ErrChanged    = errors.New("Value has changed.")
+	ErrEvicted    = errors.New("Evicted to make room.")
+)
+
 type Clock interface {
 	Now() time.Time
 	Expired(t time.Time) bool
 }
 
 type Store struct {
-	mu       *sync.Mutex
-	store    map[string]*list.Element
-	ll       *list.List
+	mu       *sync.RWMutex
+	store    map[string]*Node
+	policy   EvictionPolicy
+	shared   bool // Gets only take the read lock, see concurrentPolicy
+	expiries expiryHeap
 	maxItems uint64 // 0 == unlimited
+	maxBytes uint64 // 0 == unlimited
 	NumItems uint64
+	NumBytes uint64 // Size of all keys and values stored
 	C        Clock
+	onChange func(Change)
+	version  uint64 // Last version given to a stored value
+
+	// Counted for Stats. Reads can happen under the read lock, so are atomic.
+	hits        atomic.Uint64
+	misses      atomic.Uint64
+	evictions   uint64
+	expirations uint64
+}
+
+type Options struct {
+	MaxItems uint64 // 0 == unlimited
+	MaxBytes uint64 // 0 == unlimited
+	Policy   Policy // Defaults to LRU, ApproxLRU lets gets run at the same time
+
+	// Called for every change to what's stored, in the order they happen to
+	// each key. It's called with the store's lock held, so it mustn't use the
+	// store.
+	OnChange func(Change)
+}
+
+type Op byte
+
+const (
+	_ Op = iota
+	Stored
+	Deleted
+	Expired
+	Evicted
+	Flushed
+)
+
+// Change describes the state a key was left in, so replaying changes in order
+// rebuilds the store. Value and Expire are only set when Stored.
+type Change struct {
+	Op     Op
+	Key    string
+	Value  []byte
+	Expire time.Time
 }
 
+type setMode int
+
+const (
+	always setMode = iota
+	ifAbsent
+	ifPresent
+)
+
 func (s *Store) Set(key string, value string, expires time.Time) (exp time.Time, err error) {
-	if expires.Compare(s.C.Now()) == -1 {
-		return expires, errors.New("Expiry can't be in the past.")
-	}
+	return s.set(key, value, expires, always)
+}
+
+// SetNX only stores the value if the key isn't already in the cache.
+func (s *Store) SetNX(key string, value string, expires time.Time) (exp time.Time, err error) {
+	return s.set(key, value, expires, ifAbsent)
+}
+
+// SetXX only stores the value if the key is already in the cache.
+func (s *Store) SetXX(key string, value string, expires time.Time) (exp time.Time, err error) {
+	return s.set(key, value, expires, ifPresent)
+}
 
+func (s *Store) set(key string, value string, expires time.Time, mode setMode) (exp time.Time, err error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	// Do this before so the overwriting key value doesn't get deleted
-	if s.NumItems+1 > s.maxItems && s.maxItems != 0 {
-		last := s.ll.Back()
+	return s.setLocked(key, value, expires, mode)
+}
+
+// Must be called with the lock held.
+func (s *Store) setLocked(key string, value string, expires time.Time, mode setMode) (exp time.Time, err error) {
+	if !expires.IsZero() && expires.Compare(s.C.Now()) == -1 {
+		return expires, ErrPastExpiry
+	}
+
+	size := uint64(len(key) + len(value))
+	if s.maxBytes != 0 && size > s.maxBytes {
+		return expires, ErrTooLarge
+	}
+
+	node, ok := s.store[key]
+	if ok && s.expired(node) {
+		s.remove(node)
+		s.notify(Change{Op: Expired, Key: key})
+		ok = false
+	}
+
+	if ok && mode == ifAbsent {
+		return expires, ErrExists
+	}
+
+	if !ok && mode == ifPresent {
+		return expires, ErrNotFound
+	}
+
+	if ok && !s.fits(node.size(), size) {
+		// Room has to be made, so take it out and put it back in as new rather
+		// than risk the policy picking it as the item to evict.
+		s.remove(node)
+		ok = false
+	}
 
-		delete(s.store, last.Value.(*Node).Key)
-		s.ll.Remove(last)
-		s.NumItems--
+	if ok {
+		s.NumBytes -= node.size()
+
+		node.Value = []byte(value)
+		node.Expire = expires
+		node.Version = s.nextVersion()
+		s.NumBytes += node.size()
+
+		heap.Fix(&s.expiries, node.index)
+		s.policy.Accessed(key)
+		s.notify(Change{Op: Stored, Key: key, Value: node.Value, Expire: node.Expire})
+		return node.Expire, nil
 	}
 
-	node := &Node{
-		key, []byte(value), expires,
+	// Do this before so the new item can't be picked for eviction.
+	s.evict(size)
+
+	node = &Node{
+		Key:     key,
+		Value:   []byte(value),
+		Expire:  expires,
+		Version: s.nextVersion(),
 	}
-	s.ll.PushFront(node)
+	heap.Push(&s.expiries, node)
+	s.policy.Added(key)
 	s.NumItems++
+	s.NumBytes += node.size()
 
-	s.store[key] = s.ll.Front()
+	s.store[key] = node
+	s.notify(Change{Op: Stored, Key: key, Value: node.Value, Expire: node.Expire})
 	return node.Expire, nil
 }
 
+// Whether the item has expired, a zero expiry never does.
+func (s *Store) expired(node *Node) bool {
+	return !node.Expire.IsZero() && s.C.Expired(node.Expire)
+}
+
+// Must be called with the lock held.
+func (s *Store) nextVersion() uint64 {
+	s.version++
+	return s.version
+}
+
+// Drops items picked by the eviction policy until there's room for a new item
+// of the given size. Must be called with the lock held.
+func (s *Store) evict(size uint64) {
+	for s.NumItems > 0 && s.full(size) {
+		key, ok := s.policy.Victim()
+		if !ok {
+			return
+		}
+		s.remove(s.store[key])
+		s.notify(Change{Op: Evicted, Key: key})
+	}
+}
+
+// Whether a new item of the given size would take the store over its limits.
+func (s *Store) full(size uint64) bool {
+	if s.maxItems != 0 && s.NumItems+1 > s.maxItems {
+		return true
+	}
+	return !s.fits(0, size)
+}
+
+// Whether replacing an item of size old with one of size new keeps the store
+// within its byte limit.
+func (s *Store) fits(old uint64, new uint64) bool {
+	return s.maxBytes == 0 || s.NumBytes-old+new <= s.maxBytes
+}
+
 func (s *Store) Get(key string) (value []byte, err error) {
+	node, err := s.Lookup(key)
+	return node.Value, err
+}
+
+// Lookup gets a copy of the item stored at the key, including when it expires
+// and its version.
+func (s *Store) Lookup(key string) (Node, error) {
+	if s.shared {
+		node, expired, err := s.lookupShared(key)
+		if !expired {
+			s.countRead(err)
+			return node, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.getLocked(key)
+	s.countRead(err)
+	return node, err
+}
+
+// Counts a read for Stats, anything that didn't find the key is a miss.
+func (s *Store) countRead(err error) {
+	if err == nil {
+		s.hits.Add(1)
+	} else {
+		s.misses.Add(1)
+	}
+}
+
+// Gets the key with only the read lock held. Expired keys have to be removed
+// with the write lock, so are left for the caller to get again.
+func (s *Store) lookupShared(key string) (node Node, expired bool, err error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	stored, ok := s.store[key]
+	if !ok {
+		return Node{}, false, ErrNotFound
+	}
+
+	if s.expired(stored) {
+		return Node{}, true, nil
+	}
+
+	s.policy.Accessed(key)
+	return *stored, false, nil
+}
+
+// Must be called with the lock held.
+func (s *Store) getLocked(key string) (Node, error) {
+	node, ok := s.store[key]
+	if !ok {
+		return Node{}, ErrNotFound
+	}
+
+	if s.expired(node) {
+		s.remove(node)
+		s.notify(Change{Op: Expired, Key: key})
+		return Node{}, ErrExpired
+	}
+
+	s.policy.Accessed(key)
+	return *node, nil
+}
+
+// Result of one key in a batch. Value is only set for gets.
+type Result struct {
+	Value   []byte
+	Expires time.Time
+	Err     error
+}
+
+// MGet gets every key under a single lock, in the same order.
+func (s *Store) MGet(keys []string) []Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]Result, len(keys))
+	for i, key := range keys {
+		node, err := s.getLocked(key)
+		s.countRead(err)
+		results[i] = Result{node.Value, node.Expire, err}
+	}
+	return results
+}
+
+// MSet stores every item under a single lock, so no one sees only some of
+// them. Items which can't be stored are reported in their result rather than
+// stopping the rest, as are ones evicted to make room for a later item.
+func (s *Store) MSet(items []Node) []Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	results := make([]Result, len(items))
+	for i, item := range items {
+		expires, err := s.setLocked(item.Key, string(item.Value), item.Expire, always)
+		results[i] = Result{nil, expires, err}
+	}
+
+	for i, item := range items {
+		s.checkEvicted(item.Key, &results[i])
+	}
+	return results
+}
+
+// Marks a stored result as evicted if the key has since gone, so an MSET
+// doesn't report success for an item a later one pushed out.
+func (s *Store) checkEvicted(key string, result *Result) {
+	if result.Err != nil {
+		return
+	}
+
+	if _, ok := s.store[key]; !ok {
+		result.Err = ErrEvicted
+	}
+}
+
+// Incr adds delta to the integer stored at the key, returning the new value.
+// A missing key starts from 0 and expires at expires, otherwise it keeps the
+// expiry it has.
+func (s *Store) Incr(key string, delta int64, expires time.Time) (int64, time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.getLocked(key)
+	value, exp := node.Value, node.Expire
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrExpired) {
+		value, exp = []byte("0"), expires
+	}
+
+	n, err := strconv.ParseInt(string(value), 10, 64)
+	if err != nil {
+		return 0, exp, ErrNotInteger
+	}
+
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return n, exp, ErrOverflow
+	}
+	n += delta
+
+	exp, err = s.setLocked(key, strconv.FormatInt(n, 10), exp, always)
+	if err != nil {
+		return 0, exp, err
+	}
+	return n, exp, nil
+}
+
+// CompareAndSet only stores the value if the key's version still matches,
+// i.e. nothing has stored it since it was read. Returns the new version, or the
+// current one with ErrChanged.
+func (s *Store) CompareAndSet(key string, value string, expires time.Time, version uint64) (time.Time, uint64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	node, err := s.getLocked(key)
+	if err != nil {
+		return expires, 0, err
+	}
+
+	if node.Version != version {
+		return expires, node.Version, ErrChanged
+	}
+
+	exp, err := s.setLocked(key, value, expires, ifPresent)
+	if err != nil {
+		return exp, node.Version, err
+	}
+	return exp, s.version, nil
+}
+
+// Expire changes when the key expires without touching its value, a zero
+// expires removes the expiry altogether. Returns the new expiry.
+func (s *Store) Expire(key string, expires time.Time) (time.Time, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !expires.IsZero() && expires.Compare(s.C.Now()) == -1 {
+		return expires, ErrPastExpiry
+	}
+
+	_, err := s.getLocked(key)
+	if err != nil {
+		return expires, err
+	}
+
+	node := s.store[key]
+	node.Expire = expires
+	heap.Fix(&s.expiries, node.index)
+	s.notify(Change{Op: Stored, Key: key, Value: node.Value, Expire: node.Expire})
+	return node.Expire, nil
+}
+
+func (s *Store) Delete(key string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	item, ok := s.store[key]
+	node, ok := s.store[key]
 	if !ok {
-		return nil, errors.New("Value doesn't exist.")
+		return ErrNotFound
 	}
 
-	node := item.Value.(*Node)
-	if s.C.Expired(node.Expire) {
-		return nil, errors.New("Expired.")
+	// Already gone as far as anyone can see, the sweep just hadn't got to it.
+	if s.expired(node) {
+		s.remove(node)
+		s.notify(Change{Op: Expired, Key: key})
+		return ErrExpired
 	}
 
-	s.ll.MoveToFront(item)
-	return node.Value, nil
+	s.remove(node)
+	s.notify(Change{Op: Deleted, Key: key})
+	return nil
+}
+
+func (s *Store) Flush() (flushed uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	flushed = s.NumItems
+
+	for key := range s.store {
+		s.policy.Removed(key)
+	}
+
+	s.store = make(map[string]*Node)
+	s.expiries = expiryHeap{}
+	s.NumItems = 0
+	s.NumBytes = 0
+	s.notify(Change{Op: Flushed})
+	return flushed
+}
+
+// Usage reports the number of items and bytes currently stored.
+func (s *Store) Usage() (items uint64, bytes uint64) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.NumItems, s.NumBytes
+}
+
+// Items returns a copy of everything currently stored, expired or not.
+func (s *Store) Items() []Node {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.items()
+}
+
+// Must be called with the lock held.
+func (s *Store) items() []Node {
+	items := make([]Node, 0, len(s.store))
+	for _, node := range s.store {
+		items = append(items, Node{Key: node.Key, Value: node.Value, Expire: node.Expire})
+	}
+	return items
+}
+
+// DeleteExpired removes expired items, returning how many were removed. Expiry
+// is decided by the store's Clock.
+func (s *Store) DeleteExpired() (removed int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for node := s.expiries.peek(); node != nil && s.expired(node); node = s.expiries.peek() {
+		s.remove(node)
+		s.notify(Change{Op: Expired, Key: node.Key})
+		removed++
+	}
+	return removed
+}
+
+// Sweep deletes expired items every time tick fires, until done is closed.
+func (s *Store) Sweep(tick <-chan time.Time, done <-chan struct{}) {
+	for {
+		select {
+		case <-tick:
+			s.DeleteExpired()
+		case <-done:
+			return
+		}
+	}
+}
+
+// Must be called with the lock held.
+func (s *Store) notify(change Change) {
+	switch change.Op {
+	case Evicted:
+		s.evictions++
+	case Expired:
+		s.expirations++
+	}
+
+	if s.onChange != nil {
+		s.onChange(change)
+	}
+}
+
+// Must be called with the lock held.
+func (s *Store) remove(node *Node) {
+	delete(s.store, node.Key)
+	s.policy.Removed(node.Key)
+	if node.index >= 0 {
+		heap.Remove(&s.expiries, node.index)
+	}
+	s.NumItems--
+	s.NumBytes -= node.size()
 }
 
 func NewStore(maxItems uint64, c Clock) *Store {
+	return NewStoreWithOptions(Options{MaxItems: maxItems}, c)
+}
+
+func NewStoreWithOptions(opts Options, c Clock) *Store {
+	policy := newEvictionPolicy(opts)
+	_, shared := policy.(concurrentPolicy)
+
 	return &Store{
-		mu:       &sync.Mutex{},
-		store:    make(map[string]*list.Element),
-		ll:       list.New(),
-		maxItems: maxItems,
+		mu:       &sync.RWMutex{},
+		store:    make(map[string]*Node),
+		policy:   policy,
+		shared:   shared,
+		expiries: expiryHeap{},
+		maxItems: opts.MaxItems,
+		maxBytes: opts.MaxBytes,
 		NumItems: 0,
+		NumBytes: 0,
 		C:        c,
+		onChange: opts.OnChange,
+		// Versions from before a restart shouldn't match ones handed out after.
+		version: uint64(c.Now().UnixNano()),
 	}
 }
 
 type Node struct {
-	Key    string
-	Value  []byte
-	Expire time.Time
+	Key     string
+	Value   []byte
+	Expire  time.Time // Zero == never expires
+	Version uint64    // Changes every time the key is stored, for CompareAndSet
+
+	index int // Position in the expiry heap, -1 when not in it.
+}
+
+func (n *Node) size() uint64 {
+	return uint64(len(n.Key) + len(n.Value))
 }
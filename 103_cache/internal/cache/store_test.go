@@ -3,6 +3,9 @@ package cache_test
 import (
 	"errors"
 	"fmt"
+	"math"
+	"slices"
+	"sync"
 	"testing"
 	"time"
 
@@ -43,6 +46,19 @@ func (clock c) Expired(t time.Time) bool {
 
 var clock = c{false}
 
+// Expires anything before now, which tests move forward by hand.
+type movingClock struct {
+	now time.Time
+}
+
+func (clock *movingClock) Now() time.Time {
+	return clock.now
+}
+
+func (clock *movingClock) Expired(t time.Time) bool {
+	return t.Before(clock.now)
+}
+
 func TestSet(t *testing.T) {
 	t.Run("Set value", func(t *testing.T) {
 		s := cache.NewStore(1, clock)
@@ -101,6 +117,175 @@ func TestSet(t *testing.T) {
 		if actual != "421" {
 			t.Errorf("Expected '421', got '%s'", value)
 		}
+
+		if s.NumItems != 1 {
+			t.Errorf("Expected %d items, got %d", 1, s.NumItems)
+		}
+	})
+
+	t.Run("Overwrite doesn't evict", func(t *testing.T) {
+		s := cache.NewStore(2, clock)
+
+		for _, key := range []string{"a", "b", "a"} {
+			_, err := s.Set(key, key, clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		if s.NumItems != 2 {
+			t.Errorf("Expected %d items, got %d", 2, s.NumItems)
+		}
+
+		for _, key := range []string{"a", "b"} {
+			_, err := s.Get(key)
+			if err != nil {
+				t.Errorf("Expected '%s' to be stored, got '%s'", key, err)
+			}
+		}
+	})
+
+	t.Run("Overwrite refreshes expiry", func(t *testing.T) {
+		mc := &movingClock{clock.Now()}
+		s := cache.NewStore(0, mc)
+
+		_, err := s.Set("key", "420", mc.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.Set("key", "421", mc.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mc.now = mc.now.Add(time.Minute * 2)
+
+		removed := s.DeleteExpired()
+		if removed != 0 {
+			t.Errorf("Expected %d removed, got %d", 0, removed)
+		}
+
+		_, err = s.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestSetNX(t *testing.T) {
+	t.Run("Set absent value", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		_, err := s.SetNX("key", "420", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := s.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "420" {
+			t.Errorf("Expected '420', got '%s'", value)
+		}
+	})
+
+	t.Run("Value already exists", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		_, err := s.Set("key", "420", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.SetNX("key", "421", clock.Now())
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Value already exists.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+
+		value, err := s.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "420" {
+			t.Errorf("Expected '420', got '%s'", value)
+		}
+	})
+
+	t.Run("Expired value counts as absent", func(t *testing.T) {
+		mc := &movingClock{clock.Now()}
+		s := cache.NewStore(0, mc)
+
+		_, err := s.Set("key", "420", mc.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mc.now = mc.now.Add(time.Hour)
+
+		_, err = s.SetNX("key", "421", mc.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.NumItems != 1 {
+			t.Errorf("Expected %d items, got %d", 1, s.NumItems)
+		}
+	})
+}
+
+func TestSetXX(t *testing.T) {
+	t.Run("Update present value", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		_, err := s.Set("key", "420", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = s.SetXX("key", "421", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := s.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "421" {
+			t.Errorf("Expected '421', got '%s'", value)
+		}
+	})
+
+	t.Run("Value doesn't exist", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		_, err := s.SetXX("key", "420", clock.Now())
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Value doesn't exist.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+
+		if s.NumItems != 0 {
+			t.Errorf("Expected %d items, got %d", 0, s.NumItems)
+		}
 	})
 }
 
@@ -170,6 +355,10 @@ func TestGet(t *testing.T) {
 		if actual != expected {
 			t.Errorf("Expected '%s', got '%s'", expected, actual)
 		}
+
+		if s.NumItems != 0 {
+			t.Errorf("Expected expired item to be removed, got %d items", s.NumItems)
+		}
 	})
 }
 
@@ -208,3 +397,1120 @@ func TestCache(t *testing.T) {
 		}
 	})
 }
+
+func TestDelete(t *testing.T) {
+	t.Run("Delete stored value", func(t *testing.T) {
+		s := cache.NewStore(1, clock)
+		_, err := s.Set("key", "420", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = s.Delete("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.NumItems != 0 {
+			t.Errorf("Expected %d items, got %d", 0, s.NumItems)
+		}
+
+		_, err = s.Get("key")
+		if err == nil {
+			t.Fatal("Expected err, got nil")
+		}
+
+		expected := errors.New("Value doesn't exist.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Delete expired value", func(t *testing.T) {
+		mc := &movingClock{clock.Now()}
+		changes := []cache.Change{}
+		s := cache.NewStoreWithOptions(cache.Options{OnChange: func(change cache.Change) {
+			changes = append(changes, change)
+		}}, mc)
+
+		_, err := s.Set("key", "420", mc.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mc.now = mc.now.Add(time.Hour)
+		err = s.Delete("key")
+		if !errors.Is(err, cache.ErrExpired) {
+			t.Errorf("Expected '%s', got '%v'", cache.ErrExpired, err)
+		}
+
+		if s.NumItems != 0 {
+			t.Errorf("Expected %d items, got %d", 0, s.NumItems)
+		}
+
+		last := changes[len(changes)-1]
+		if last.Op != cache.Expired || last.Key != "key" {
+			t.Errorf("Expected expiry of 'key', got %d '%s'", last.Op, last.Key)
+		}
+	})
+
+	t.Run("Delete non stored value", func(t *testing.T) {
+		s := cache.NewStore(1, clock)
+
+		err := s.Delete("nonexistent")
+		if err == nil {
+			t.Fatal("Expected err, got nil")
+		}
+
+		expected := errors.New("Value doesn't exist.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+}
+
+func TestFlush(t *testing.T) {
+	t.Run("Flush all values", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		for i := range 3 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		flushed := s.Flush()
+		if flushed != 3 {
+			t.Errorf("Expected %d flushed, got %d", 3, flushed)
+		}
+
+		if s.NumItems != 0 {
+			t.Errorf("Expected %d items, got %d", 0, s.NumItems)
+		}
+
+		for i := range 3 {
+			_, err := s.Get(fmt.Sprint(i))
+			if err == nil {
+				t.Errorf("Expected err for key '%d', got nil", i)
+			}
+		}
+	})
+
+	t.Run("Store usable after flush", func(t *testing.T) {
+		s := cache.NewStore(1, clock)
+		s.Flush()
+
+		_, err := s.Set("key", "420", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err := s.Get("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "420" {
+			t.Errorf("Expected '420', got '%s'", value)
+		}
+	})
+}
+
+func TestExpiry(t *testing.T) {
+	t.Run("Delete expired items", func(t *testing.T) {
+		mc := &movingClock{clock.Now()}
+		s := cache.NewStore(0, mc)
+
+		for i := range 3 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), mc.Now().Add(time.Minute*time.Duration(i+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Only the first two have expired.
+		mc.now = mc.now.Add(time.Minute*2 + time.Second)
+
+		removed := s.DeleteExpired()
+		if removed != 2 {
+			t.Errorf("Expected %d removed, got %d", 2, removed)
+		}
+
+		if s.NumItems != 1 {
+			t.Errorf("Expected %d items, got %d", 1, s.NumItems)
+		}
+
+		value, err := s.Get("2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "2" {
+			t.Errorf("Expected '2', got '%s'", value)
+		}
+	})
+
+	t.Run("Nothing expired", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		_, err := s.Set("key", "420", clock.Future())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		removed := s.DeleteExpired()
+		if removed != 0 {
+			t.Errorf("Expected %d removed, got %d", 0, removed)
+		}
+
+		if s.NumItems != 1 {
+			t.Errorf("Expected %d items, got %d", 1, s.NumItems)
+		}
+	})
+
+	t.Run("Deleted items aren't swept", func(t *testing.T) {
+		mc := &movingClock{clock.Now()}
+		s := cache.NewStore(0, mc)
+
+		for i := range 2 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), mc.Now().Add(time.Minute))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := s.Delete("0")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mc.now = mc.now.Add(time.Hour)
+
+		removed := s.DeleteExpired()
+		if removed != 1 {
+			t.Errorf("Expected %d removed, got %d", 1, removed)
+		}
+
+		if s.NumItems != 0 {
+			t.Errorf("Expected %d items, got %d", 0, s.NumItems)
+		}
+	})
+
+	t.Run("Sweep on tick", func(t *testing.T) {
+		mc := &movingClock{clock.Now()}
+		s := cache.NewStore(0, mc)
+
+		_, err := s.Set("key", "420", mc.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tick := make(chan time.Time)
+		done := make(chan struct{})
+		finished := make(chan struct{})
+
+		go func() {
+			s.Sweep(tick, done)
+			close(finished)
+		}()
+
+		mc.now = mc.now.Add(time.Hour)
+
+		// The second send can't happen until the first sweep is done.
+		tick <- mc.now
+		tick <- mc.now
+		close(done)
+		<-finished
+
+		if s.NumItems != 0 {
+			t.Errorf("Expected %d items, got %d", 0, s.NumItems)
+		}
+	})
+}
+
+func TestMemoryBound(t *testing.T) {
+	t.Run("Track bytes", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		_, err := s.Set("key", "420", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.NumBytes != 6 {
+			t.Errorf("Expected %d bytes, got %d", 6, s.NumBytes)
+		}
+
+		_, err = s.Set("key", "42", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.NumBytes != 5 {
+			t.Errorf("Expected %d bytes, got %d", 5, s.NumBytes)
+		}
+
+		err = s.Delete("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.NumBytes != 0 {
+			t.Errorf("Expected %d bytes, got %d", 0, s.NumBytes)
+		}
+	})
+
+	t.Run("Evict until under budget", func(t *testing.T) {
+		s := cache.NewStoreWithOptions(cache.Options{MaxBytes: 10}, clock)
+
+		// 2 bytes each
+		for i := range 5 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// Needs 3 of the oldest items gone to fit.
+		_, err := s.Set("big", "val", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.NumBytes > 10 {
+			t.Errorf("Expected at most %d bytes, got %d", 10, s.NumBytes)
+		}
+
+		for i := range 3 {
+			_, err := s.Get(fmt.Sprint(i))
+			if err == nil {
+				t.Errorf("Expected '%d' to be evicted", i)
+			}
+		}
+
+		for _, key := range []string{"3", "4", "big"} {
+			_, err := s.Get(key)
+			if err != nil {
+				t.Errorf("Expected '%s' to be stored, got '%s'", key, err)
+			}
+		}
+	})
+
+	t.Run("Growing value evicts others", func(t *testing.T) {
+		s := cache.NewStoreWithOptions(cache.Options{MaxBytes: 6}, clock)
+
+		for _, key := range []string{"a", "b", "c"} {
+			_, err := s.Set(key, key, clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		_, err := s.Set("c", "ccc", clock.Now())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if s.NumItems != 2 {
+			t.Errorf("Expected %d items, got %d", 2, s.NumItems)
+		}
+
+		value, err := s.Get("c")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "ccc" {
+			t.Errorf("Expected 'ccc', got '%s'", value)
+		}
+	})
+
+	t.Run("Value too large", func(t *testing.T) {
+		s := cache.NewStoreWithOptions(cache.Options{MaxBytes: 4}, clock)
+
+		_, err := s.Set("key", "420", clock.Now())
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Value too large for cache.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Usage", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		for i := range 3 {
+			_, err := s.Set(fmt.Sprint(i), fmt.Sprint(i), clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		items, bytes := s.Usage()
+		if items != 3 {
+			t.Errorf("Expected %d items, got %d", 3, items)
+		}
+
+		if bytes != 6 {
+			t.Errorf("Expected %d bytes, got %d", 6, bytes)
+		}
+	})
+}
+
+func TestOnChange(t *testing.T) {
+	t.Run("Changes reported in order", func(t *testing.T) {
+		mc := &movingClock{clock.Now()}
+		changes := []cache.Change{}
+
+		opts := cache.Options{
+			MaxItems: 2,
+			OnChange: func(change cache.Change) {
+				changes = append(changes, change)
+			},
+		}
+		s := cache.NewStoreWithOptions(opts, mc)
+
+		steps := []func() error{
+			func() error { _, err := s.Set("a", "1", mc.Now().Add(time.Minute)); return err },
+			func() error { _, err := s.Set("b", "2", mc.Now().Add(time.Hour)); return err },
+			func() error { _, err := s.Set("c", "3", mc.Now().Add(time.Hour)); return err },
+			func() error { return s.Delete("b") },
+			func() error { mc.now = mc.now.Add(time.Minute * 2); s.DeleteExpired(); return nil },
+			func() error { s.Flush(); return nil },
+		}
+		for _, step := range steps {
+			err := step()
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		expected := []struct {
+			op  cache.Op
+			key string
+		}{
+			{cache.Stored, "a"},
+			{cache.Stored, "b"},
+			{cache.Evicted, "a"},
+			{cache.Stored, "c"},
+			{cache.Deleted, "b"},
+			{cache.Flushed, ""},
+		}
+
+		if len(changes) != len(expected) {
+			t.Fatalf("Expected %d changes, got %d: %v", len(expected), len(changes), changes)
+		}
+
+		for i, e := range expected {
+			a := changes[i]
+			if a.Op != e.op || a.Key != e.key {
+				t.Errorf("Expected change %d to be %d '%s', got %d '%s'", i, e.op, e.key, a.Op, a.Key)
+			}
+		}
+	})
+
+	t.Run("Expiry reported", func(t *testing.T) {
+		mc := &movingClock{clock.Now()}
+		changes := []cache.Change{}
+
+		opts := cache.Options{
+			OnChange: func(change cache.Change) {
+				changes = append(changes, change)
+			},
+		}
+		s := cache.NewStoreWithOptions(opts, mc)
+
+		_, err := s.Set("a", "1", mc.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mc.now = mc.now.Add(time.Hour)
+		s.DeleteExpired()
+
+		last := changes[len(changes)-1]
+		if last.Op != cache.Expired || last.Key != "a" {
+			t.Errorf("Expected expiry of 'a', got %d '%s'", last.Op, last.Key)
+		}
+	})
+}
+
+func TestBatch(t *testing.T) {
+	stores := map[string]func() cache.Cache{
+		"Store":        func() cache.Cache { return cache.NewStore(0, clock) },
+		"ShardedStore": func() cache.Cache { return cache.NewShardedStore(4, cache.Options{}, clock) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name+" MSet then MGet", func(t *testing.T) {
+			s := newStore()
+
+			items := []cache.Node{}
+			for i := range 20 {
+				items = append(items, cache.Node{Key: fmt.Sprint(i), Value: []byte(fmt.Sprint(i)), Expire: clock.Future()})
+			}
+
+			for i, result := range s.MSet(items) {
+				if result.Err != nil {
+					t.Fatalf("Expected nil for key '%d', got '%s'", i, result.Err)
+				}
+
+				if !result.Expires.Equal(clock.Future()) {
+					t.Errorf("Expected expiry %s, got %s", clock.Future(), result.Expires)
+				}
+			}
+
+			results := s.MGet([]string{"3", "missing", "19"})
+			if string(results[0].Value) != "3" || string(results[2].Value) != "19" {
+				t.Errorf("Expected '3' and '19', got '%s' and '%s'", results[0].Value, results[2].Value)
+			}
+
+			expected := errors.New("Value doesn't exist.").Error()
+			if results[1].Err == nil || results[1].Err.Error() != expected {
+				t.Errorf("Expected '%s', got '%v'", expected, results[1].Err)
+			}
+		})
+
+		t.Run(name+" MSet reports failures per key", func(t *testing.T) {
+			s := newStore()
+
+			results := s.MSet([]cache.Node{
+				{Key: "past", Value: []byte("1"), Expire: clock.Before()},
+				{Key: "ok", Value: []byte("2"), Expire: clock.Future()},
+			})
+
+			if !errors.Is(results[0].Err, cache.ErrPastExpiry) {
+				t.Errorf("Expected past expiry, got '%v'", results[0].Err)
+			}
+
+			if results[1].Err != nil {
+				t.Errorf("Expected nil, got '%s'", results[1].Err)
+			}
+
+			value, err := s.Get("ok")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(value) != "2" {
+				t.Errorf("Expected '2', got '%s'", value)
+			}
+		})
+	}
+
+	full := map[string]cache.Cache{
+		"Store":        cache.NewStore(2, clock),
+		"ShardedStore": cache.NewShardedStore(1, cache.Options{MaxItems: 2}, clock),
+	}
+
+	for name, s := range full {
+		t.Run(name+" MSet reports items evicted by later ones", func(t *testing.T) {
+			results := s.MSet([]cache.Node{
+				{Key: "a", Value: []byte("1"), Expire: clock.Future()},
+				{Key: "b", Value: []byte("2"), Expire: clock.Future()},
+				{Key: "c", Value: []byte("3"), Expire: clock.Future()},
+			})
+
+			evicted := 0
+			for i, key := range []string{"a", "b", "c"} {
+				_, err := s.Get(key)
+				switch {
+				case results[i].Err == nil && err != nil:
+					t.Errorf("Expected '%s' to be stored, got '%s'", key, err)
+				case errors.Is(results[i].Err, cache.ErrEvicted):
+					evicted++
+					if !errors.Is(err, cache.ErrNotFound) {
+						t.Errorf("Expected '%s' to be gone, got '%v'", key, err)
+					}
+				case results[i].Err != nil:
+					t.Errorf("Expected nil or evicted for '%s', got '%s'", key, results[i].Err)
+				}
+			}
+
+			if evicted != 1 {
+				t.Errorf("Expected 1 evicted, got %d", evicted)
+			}
+		})
+	}
+
+	t.Run("MSet notifies every item", func(t *testing.T) {
+		changes := []cache.Change{}
+		s := cache.NewStoreWithOptions(cache.Options{OnChange: func(change cache.Change) {
+			changes = append(changes, change)
+		}}, clock)
+
+		s.MSet([]cache.Node{
+			{Key: "a", Value: []byte("1"), Expire: clock.Future()},
+			{Key: "b", Value: []byte("2"), Expire: clock.Future()},
+		})
+
+		if len(changes) != 2 || changes[0].Key != "a" || changes[1].Key != "b" {
+			t.Errorf("Expected changes to 'a' then 'b', got %v", changes)
+		}
+	})
+}
+
+func TestIncr(t *testing.T) {
+	stores := map[string]func() cache.Cache{
+		"Store":        func() cache.Cache { return cache.NewStore(0, clock) },
+		"ShardedStore": func() cache.Cache { return cache.NewShardedStore(4, cache.Options{}, clock) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name+" creates missing keys", func(t *testing.T) {
+			s := newStore()
+
+			n, expires, err := s.Incr("counter", 5, clock.Future())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != 5 || !expires.Equal(clock.Future()) {
+				t.Errorf("Expected 5 expiring %s, got %d expiring %s", clock.Future(), n, expires)
+			}
+
+			value, err := s.Get("counter")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(value) != "5" {
+				t.Errorf("Expected '5', got '%s'", value)
+			}
+		})
+
+		t.Run(name+" keeps the expiry", func(t *testing.T) {
+			s := newStore()
+			s.Set("counter", "10", clock.Future())
+
+			n, expires, err := s.Incr("counter", -3, clock.Now())
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if n != 7 || !expires.Equal(clock.Future()) {
+				t.Errorf("Expected 7 expiring %s, got %d expiring %s", clock.Future(), n, expires)
+			}
+		})
+
+		t.Run(name+" concurrent increments", func(t *testing.T) {
+			s := newStore()
+
+			var wg sync.WaitGroup
+			for range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 100 {
+						s.Incr("counter", 1, clock.Future())
+					}
+				}()
+			}
+			wg.Wait()
+
+			value, err := s.Get("counter")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(value) != "800" {
+				t.Errorf("Expected '800', got '%s'", value)
+			}
+		})
+	}
+
+	t.Run("Not an integer", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+		s.Set("key", "value", clock.Future())
+
+		_, _, err := s.Incr("key", 1, clock.Future())
+		if !errors.Is(err, cache.ErrNotInteger) {
+			t.Errorf("Expected '%s', got '%v'", cache.ErrNotInteger, err)
+		}
+
+		value, _ := s.Get("key")
+		if string(value) != "value" {
+			t.Errorf("Expected 'value' to be left alone, got '%s'", value)
+		}
+	})
+
+	t.Run("Overflow", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+		s.Set("key", fmt.Sprint(math.MaxInt64), clock.Future())
+
+		_, _, err := s.Incr("key", 1, clock.Future())
+		if !errors.Is(err, cache.ErrOverflow) {
+			t.Errorf("Expected '%s', got '%v'", cache.ErrOverflow, err)
+		}
+	})
+
+	t.Run("Expired counters start again", func(t *testing.T) {
+		c := &movingClock{clock.Now()}
+		s := cache.NewStore(0, c)
+		s.Set("counter", "10", clock.Now().Add(time.Minute))
+
+		c.now = c.now.Add(2 * time.Minute)
+		n, expires, err := s.Incr("counter", 1, c.now.Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 1 || !expires.Equal(c.now.Add(time.Minute)) {
+			t.Errorf("Expected 1 expiring %s, got %d expiring %s", c.now.Add(time.Minute), n, expires)
+		}
+	})
+}
+
+func TestCompareAndSet(t *testing.T) {
+	stores := map[string]func() cache.Cache{
+		"Store":        func() cache.Cache { return cache.NewStore(0, clock) },
+		"ShardedStore": func() cache.Cache { return cache.NewShardedStore(4, cache.Options{}, clock) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name+" only stores if the version matches", func(t *testing.T) {
+			s := newStore()
+			s.Set("key", "first", clock.Future())
+
+			node, err := s.Lookup("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, version, err := s.CompareAndSet("key", "second", clock.Future(), node.Version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if version == node.Version {
+				t.Errorf("Expected a new version, got %d again", version)
+			}
+
+			_, current, err := s.CompareAndSet("key", "third", clock.Future(), node.Version)
+			if !errors.Is(err, cache.ErrChanged) {
+				t.Errorf("Expected '%s', got '%v'", cache.ErrChanged, err)
+			}
+
+			if current != version {
+				t.Errorf("Expected the current version %d, got %d", version, current)
+			}
+
+			value, _ := s.Get("key")
+			if string(value) != "second" {
+				t.Errorf("Expected 'second', got '%s'", value)
+			}
+		})
+
+		t.Run(name+" missing key", func(t *testing.T) {
+			s := newStore()
+
+			_, _, err := s.CompareAndSet("missing", "value", clock.Future(), 1)
+			if !errors.Is(err, cache.ErrNotFound) {
+				t.Errorf("Expected '%s', got '%v'", cache.ErrNotFound, err)
+			}
+		})
+
+		t.Run(name+" concurrent writers", func(t *testing.T) {
+			s := newStore()
+			s.Set("key", "0", clock.Future())
+
+			var wg sync.WaitGroup
+			for range 8 {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for range 50 {
+						for {
+							node, _ := s.Lookup("key")
+							var n int
+							fmt.Sscan(string(node.Value), &n)
+
+							_, _, err := s.CompareAndSet("key", fmt.Sprint(n+1), clock.Future(), node.Version)
+							if err == nil {
+								break
+							}
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			value, _ := s.Get("key")
+			if string(value) != "400" {
+				t.Errorf("Expected '400', got '%s'", value)
+			}
+		})
+	}
+
+	t.Run("Every store changes the version", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		seen := map[uint64]bool{}
+		for _, store := range []func(){
+			func() { s.Set("key", "1", clock.Future()) },
+			func() { s.SetXX("key", "2", clock.Future()) },
+			func() { s.Incr("key", 1, clock.Future()) },
+		} {
+			store()
+			node, err := s.Lookup("key")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if seen[node.Version] {
+				t.Errorf("Expected a new version, got %d again", node.Version)
+			}
+			seen[node.Version] = true
+		}
+	})
+}
+
+func TestExpire(t *testing.T) {
+	stores := map[string]func(cache.Clock) cache.Cache{
+		"Store":        func(c cache.Clock) cache.Cache { return cache.NewStore(0, c) },
+		"ShardedStore": func(c cache.Clock) cache.Cache { return cache.NewShardedStore(4, cache.Options{}, c) },
+	}
+
+	for name, newStore := range stores {
+		t.Run(name+" extends and shortens", func(t *testing.T) {
+			mc := &movingClock{clock.Now()}
+			s := newStore(mc)
+			s.Set("long", "1", mc.Now().Add(time.Minute))
+			s.Set("short", "2", mc.Now().Add(time.Hour))
+
+			for key, expires := range map[string]time.Time{
+				"long":  mc.Now().Add(time.Hour),
+				"short": mc.Now().Add(time.Minute),
+			} {
+				actual, err := s.Expire(key, expires)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				if !actual.Equal(expires) {
+					t.Errorf("Expected '%s' to expire at %s, got %s", key, expires, actual)
+				}
+			}
+
+			mc.now = mc.now.Add(time.Minute * 2)
+			s.DeleteExpired()
+
+			_, err := s.Get("long")
+			if err != nil {
+				t.Errorf("Expected 'long' to still be there, got %v", err)
+			}
+
+			_, err = s.Get("short")
+			if !errors.Is(err, cache.ErrNotFound) {
+				t.Errorf("Expected '%s', got '%v'", cache.ErrNotFound, err)
+			}
+		})
+
+		t.Run(name+" persist removes the expiry", func(t *testing.T) {
+			mc := &movingClock{clock.Now()}
+			s := newStore(mc)
+			s.Set("kept", "1", mc.Now().Add(time.Minute))
+			s.Set("gone", "2", mc.Now().Add(time.Minute))
+
+			_, err := s.Expire("kept", time.Time{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			mc.now = mc.now.Add(time.Hour * 24 * 365)
+			removed := s.DeleteExpired()
+			if removed != 1 {
+				t.Errorf("Expected %d removed, got %d", 1, removed)
+			}
+
+			node, err := s.Lookup("kept")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !node.Expire.IsZero() {
+				t.Errorf("Expected no expiry, got %s", node.Expire)
+			}
+		})
+
+		t.Run(name+" missing key", func(t *testing.T) {
+			s := newStore(clock)
+			_, err := s.Expire("key", clock.Future())
+			if !errors.Is(err, cache.ErrNotFound) {
+				t.Errorf("Expected '%s', got '%v'", cache.ErrNotFound, err)
+			}
+		})
+	}
+
+	t.Run("Expiry in the past", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+		s.Set("key", "value", clock.Future())
+
+		_, err := s.Expire("key", clock.Before())
+		if !errors.Is(err, cache.ErrPastExpiry) {
+			t.Errorf("Expected '%s', got '%v'", cache.ErrPastExpiry, err)
+		}
+	})
+
+	t.Run("Keeps the version", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+		s.Set("key", "value", clock.Future())
+		before, _ := s.Lookup("key")
+
+		s.Expire("key", time.Time{})
+		after, _ := s.Lookup("key")
+		if after.Version != before.Version {
+			t.Errorf("Expected version %d, got %d", before.Version, after.Version)
+		}
+	})
+}
+
+func TestScan(t *testing.T) {
+	stores := map[string]func() cache.Cache{
+		"Store":        func() cache.Cache { return cache.NewStore(0, clock) },
+		"ShardedStore": func() cache.Cache { return cache.NewShardedStore(4, cache.Options{}, clock) },
+	}
+
+	// Scans until the cursor comes back empty, returning every key seen.
+	scanAll := func(s cache.Cache, pattern string, count int) []string {
+		keys := []string{}
+		cursor := ""
+		for {
+			page, next := s.Scan(cursor, pattern, count)
+			if len(page) > count {
+				t.Fatalf("Expected at most %d keys, got %d", count, len(page))
+			}
+
+			keys = append(keys, page...)
+			if next == "" {
+				return keys
+			}
+			cursor = next
+		}
+	}
+
+	for name, newStore := range stores {
+		t.Run(name+" pages through every key in order", func(t *testing.T) {
+			s := newStore()
+			expected := []string{}
+			for i := range 25 {
+				key := fmt.Sprintf("key-%02d", i)
+				s.Set(key, "value", clock.Future())
+				expected = append(expected, key)
+			}
+
+			actual := scanAll(s, "", 10)
+			if !slices.Equal(actual, expected) {
+				t.Errorf("Expected %v, got %v", expected, actual)
+			}
+		})
+
+		t.Run(name+" only matching keys", func(t *testing.T) {
+			s := newStore()
+			for _, key := range []string{"user:1", "user:2", "session:1", "user:10"} {
+				s.Set(key, "value", clock.Future())
+			}
+
+			expected := []string{"user:1", "user:2"}
+			actual := scanAll(s, "user:?", 1)
+			if !slices.Equal(actual, expected) {
+				t.Errorf("Expected %v, got %v", expected, actual)
+			}
+		})
+
+		t.Run(name+" keys there throughout are seen once", func(t *testing.T) {
+			s := newStore()
+			expected := []string{}
+			for i := range 100 {
+				key := fmt.Sprintf("kept-%03d", i)
+				s.Set(key, "value", clock.Future())
+				expected = append(expected, key)
+			}
+
+			done := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-done:
+						return
+					default:
+					}
+
+					key := fmt.Sprintf("churn-%d", i%50)
+					s.Set(key, "value", clock.Future())
+					s.Delete(fmt.Sprintf("churn-%d", (i+25)%50))
+				}
+			}()
+
+			actual := scanAll(s, "kept-*", 7)
+			close(done)
+			wg.Wait()
+
+			if !slices.Equal(actual, expected) {
+				t.Errorf("Expected %d keys in order, got %v", len(expected), actual)
+			}
+		})
+		t.Run(name+" count of 0 or less is the default", func(t *testing.T) {
+			s := newStore()
+			for i := range 25 {
+				s.Set(fmt.Sprintf("key-%02d", i), "value", clock.Future())
+			}
+
+			for _, count := range []int{0, -1} {
+				keys, next := s.Scan("", "", count)
+				if len(keys) != cache.DEFAULT_SCAN_COUNT || next != "key-09" {
+					t.Errorf("Expected %d keys up to 'key-09', got %v up to '%s'", cache.DEFAULT_SCAN_COUNT, keys, next)
+				}
+			}
+		})
+	}
+
+	t.Run("Expired keys are skipped", func(t *testing.T) {
+		expired := cache.NewStore(0, c{true})
+		expired.Set("key", "value", clock.Future())
+
+		keys, _ := expired.Scan("", "", 10)
+		if len(keys) != 0 {
+			t.Errorf("Expected no keys, got %v", keys)
+		}
+	})
+}
+
+func TestMatch(t *testing.T) {
+	tests := map[string]struct {
+		pattern  string
+		key      string
+		expected bool
+	}{
+		"Empty pattern":         {"", "anything", true},
+		"Exact":                 {"key", "key", true},
+		"Different":             {"key", "other", false},
+		"Prefix":                {"user:*", "user:42", true},
+		"Prefix doesn't match":  {"user:*", "session:42", false},
+		"Star matches nothing":  {"user:*", "user:", true},
+		"Suffix":                {"*:tmp", "a:b:tmp", true},
+		"Middle":                {"a*c", "abbbc", true},
+		"Middle backtracks":     {"a*bc", "abcbc", true},
+		"Middle doesn't match":  {"a*c", "abcd", false},
+		"Question mark":         {"k?y", "key", true},
+		"Question mark needs 1": {"k?y", "ky", false},
+		"Escaped star":          {`a\*`, "a*", true},
+		"Escaped star literal":  {`a\*`, "ab", false},
+		"Slashes are ordinary":  {"a/*", "a/b/c", true},
+		"Unicode":               {"ключ-?", "ключ-1", true},
+	}
+
+	for name, tc := range tests {
+		t.Run(name, func(t *testing.T) {
+			actual := cache.Match(tc.pattern, tc.key)
+			if actual != tc.expected {
+				t.Errorf("Expected %t for '%s' against '%s', got %t", tc.expected, tc.key, tc.pattern, actual)
+			}
+		})
+	}
+}
+
+func TestStats(t *testing.T) {
+	t.Run("Hits and misses", func(t *testing.T) {
+		s := cache.NewStore(0, clock)
+
+		for _, key := range []string{"a", "b", "a"} {
+			_, err := s.Set(key, "value", clock.Future())
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		s.Get("a")
+		s.Get("missing")
+		s.MGet([]string{"a", "b", "missing"})
+
+		expected := cache.Stats{Items: 2, Bytes: 12, Hits: 3, Misses: 2}
+		actual := s.Stats()
+		if actual != expected {
+			t.Errorf("Expected %+v, got %+v", expected, actual)
+		}
+	})
+
+	t.Run("Evictions and expirations", func(t *testing.T) {
+		mc := &movingClock{clock.Now()}
+		s := cache.NewStoreWithOptions(cache.Options{MaxItems: 2}, mc)
+
+		for i, key := range []string{"a", "b", "c"} {
+			_, err := s.Set(key, "1", mc.Now().Add(time.Minute*time.Duration(i+1)))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		mc.now = mc.now.Add(time.Minute * 5)
+		s.Get("b")
+		s.DeleteExpired()
+
+		expected := cache.Stats{Evictions: 1, Expirations: 2, Misses: 1}
+		actual := s.Stats()
+		if actual != expected {
+			t.Errorf("Expected %+v, got %+v", expected, actual)
+		}
+	})
+
+	t.Run("Shards added up", func(t *testing.T) {
+		s := cache.NewShardedStore(4, cache.Options{}, clock)
+
+		for i := range 10 {
+			key := fmt.Sprint(i)
+			_, err := s.Set(key, key, clock.Future())
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Get(key)
+		}
+		s.Get("missing")
+
+		expected := cache.Stats{Items: 10, Bytes: 20, Hits: 10, Misses: 1}
+		actual := s.Stats()
+		if actual != expected {
+			t.Errorf("Expected %+v, got %+v", expected, actual)
+		}
+	})
+
+	t.Run("Reads under the read lock counted", func(t *testing.T) {
+		s := cache.NewStoreWithOptions(cache.Options{Policy: cache.ApproxLRU}, clock)
+
+		_, err := s.Set("a", "1", clock.Future())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var wg sync.WaitGroup
+		for range 8 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 100 {
+					s.Get("a")
+					s.Get("missing")
+				}
+			}()
+		}
+		wg.Wait()
+
+		stats := s.Stats()
+		if stats.Hits != 800 || stats.Misses != 800 {
+			t.Errorf("Expected 800 hits and misses, got %d and %d", stats.Hits, stats.Misses)
+		}
+	})
+}
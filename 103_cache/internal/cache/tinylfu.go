@@ -0,0 +1,225 @@
+package cache
+
+import (
+	"container/list"
+	"hash/maphash"
+)
+
+// W-TinyLFU: new keys land in a small LRU window, then move into the main
+// area's probation segment. Keys hit again while on probation are promoted to
+// the protected segment. When something has to go, the newest key on probation
+// has to be used more often than the oldest one to stay, so a scan of one-off
+// keys can't push out the keys that are actually hot.
+type tinyLFU struct {
+	window    *list.List
+	probation *list.List
+	protected *list.List
+	items     map[string]*tinyLFUEntry
+	sketch    *sketch
+}
+
+type segment byte
+
+const (
+	windowSegment segment = iota
+	probationSegment
+	protectedSegment
+)
+
+type tinyLFUEntry struct {
+	element *list.Element
+	segment segment
+}
+
+// Share of all keys kept in the window, and of the main area kept protected.
+const (
+	windowPercent    = 1
+	protectedPercent = 80
+)
+
+func newTinyLFU(capacity int) *tinyLFU {
+	return &tinyLFU{
+		window:    list.New(),
+		probation: list.New(),
+		protected: list.New(),
+		items:     make(map[string]*tinyLFUEntry),
+		sketch:    newSketch(capacity),
+	}
+}
+
+func (p *tinyLFU) Added(key string) {
+	p.sketch.increment(key)
+	p.items[key] = &tinyLFUEntry{p.window.PushFront(key), windowSegment}
+
+	windowSize := max(1, len(p.items)*windowPercent/100)
+	for p.window.Len() > windowSize {
+		p.move(p.window.Back(), probationSegment)
+	}
+}
+
+func (p *tinyLFU) Accessed(key string) {
+	entry, ok := p.items[key]
+	if !ok {
+		return
+	}
+
+	p.sketch.increment(key)
+	switch entry.segment {
+	case windowSegment:
+		p.window.MoveToFront(entry.element)
+	case probationSegment:
+		p.move(entry.element, protectedSegment)
+
+		mainSize := p.probation.Len() + p.protected.Len()
+		for p.protected.Len() > max(1, mainSize*protectedPercent/100) {
+			p.move(p.protected.Back(), probationSegment)
+		}
+	case protectedSegment:
+		p.protected.MoveToFront(entry.element)
+	}
+}
+
+func (p *tinyLFU) Removed(key string) {
+	entry, ok := p.items[key]
+	if !ok {
+		return
+	}
+
+	p.list(entry.segment).Remove(entry.element)
+	delete(p.items, key)
+}
+
+func (p *tinyLFU) Victim() (string, bool) {
+	var candidate, victim *list.Element
+
+	// Newest arrival from the window vs the key that's been waiting longest.
+	candidate = p.probation.Front()
+	if p.probation.Len() > 1 {
+		victim = p.probation.Back()
+	} else {
+		victim = p.protected.Back()
+	}
+
+	switch {
+	case candidate == nil && victim == nil:
+		last := p.window.Back()
+		if last == nil {
+			return "", false
+		}
+		return last.Value.(string), true
+	case candidate == nil:
+		return victim.Value.(string), true
+	case victim == nil:
+		return candidate.Value.(string), true
+	}
+
+	candidateKey := candidate.Value.(string)
+	victimKey := victim.Value.(string)
+	if p.sketch.estimate(candidateKey) > p.sketch.estimate(victimKey) {
+		return victimKey, true
+	}
+	return candidateKey, true
+}
+
+func (p *tinyLFU) list(s segment) *list.List {
+	switch s {
+	case probationSegment:
+		return p.probation
+	case protectedSegment:
+		return p.protected
+	default:
+		return p.window
+	}
+}
+
+// Moves a key to the front of another segment.
+func (p *tinyLFU) move(element *list.Element, to segment) {
+	key := element.Value.(string)
+	entry := p.items[key]
+
+	p.list(entry.segment).Remove(element)
+	entry.element = p.list(to).PushFront(key)
+	entry.segment = to
+}
+
+// Count-min sketch of how often keys have been used. Counters are halved once
+// enough samples have been taken so old popularity fades.
+type sketch struct {
+	rows    [sketchDepth][]uint8
+	mask    uint64
+	seed    maphash.Seed
+	samples int
+	resetAt int
+}
+
+const (
+	sketchDepth = 4
+	maxCount    = 15
+)
+
+func newSketch(capacity int) *sketch {
+	// Plenty of counters per key keeps collisions from inflating one-off keys.
+	width := 1
+	for width < capacity*4 {
+		width *= 2
+	}
+
+	s := &sketch{
+		mask:    uint64(width - 1),
+		seed:    maphash.MakeSeed(),
+		resetAt: capacity * 10,
+	}
+	for i := range s.rows {
+		s.rows[i] = make([]uint8, width)
+	}
+	return s
+}
+
+func (s *sketch) indexes(key string) [sketchDepth]uint64 {
+	hash := maphash.String(s.seed, key)
+
+	// Remix the hash per row so two keys sharing a counter in one row are
+	// unlikely to share one in the others.
+	var indexes [sketchDepth]uint64
+	for i := range indexes {
+		indexes[i] = mix(hash+uint64(i)*0x9e3779b97f4a7c15) & s.mask
+	}
+	return indexes
+}
+
+// SplitMix64 finaliser.
+func mix(x uint64) uint64 {
+	x = (x ^ (x >> 30)) * 0xbf58476d1ce4e5b9
+	x = (x ^ (x >> 27)) * 0x94d049bb133111eb
+	return x ^ (x >> 31)
+}
+
+func (s *sketch) increment(key string) {
+	for i, index := range s.indexes(key) {
+		if s.rows[i][index] < maxCount {
+			s.rows[i][index]++
+		}
+	}
+
+	s.samples++
+	if s.samples >= s.resetAt {
+		s.reset()
+	}
+}
+
+func (s *sketch) estimate(key string) uint8 {
+	estimate := uint8(maxCount)
+	for i, index := range s.indexes(key) {
+		estimate = min(estimate, s.rows[i][index])
+	}
+	return estimate
+}
+
+func (s *sketch) reset() {
+	for _, row := range s.rows {
+		for i := range row {
+			row[i] /= 2
+		}
+	}
+	s.samples /= 2
+}
@@ -2,6 +2,7 @@ package client
 
 import (
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"log"
@@ -22,26 +23,78 @@ func (clock c) Now() time.Time {
 
 func ToMessage(input string) (protocol.Message, error) {
 	parts := strings.SplitN(input, " ", 4)
-	if len(parts) < 2 {
+	cmd := strings.ToLower(parts[0])
+	if len(parts) < 2 && cmd != "flush" && cmd != "usage" && cmd != "stats" {
 		return protocol.Message{}, errors.New("Invalid format, should have 2/3 parts: CMD <KEY> <DATA (for SET)>")
 	}
 
-	cmd := strings.ToLower(parts[0])
 	var command protocol.Command
 	switch cmd {
 	case "get":
 		command = protocol.Get
 	case "set":
 		command = protocol.Set
+	case "setnx":
+		command = protocol.SetNX
+	case "setxx":
+		command = protocol.SetXX
+	case "delete":
+		command = protocol.Delete
+	case "flush":
+		command = protocol.Flush
+	case "usage":
+		command = protocol.Usage
+	case "stats":
+		command = protocol.Stats
+	case "mget":
+		command = protocol.MGet
+	case "mset":
+		command = protocol.MSet
+	case "incr":
+		command = protocol.Incr
+	case "decr":
+		command = protocol.Decr
+	case "incrby":
+		command = protocol.IncrBy
+	case "cas":
+		command = protocol.CompareAndSet
+	case "ttl":
+		command = protocol.TTL
+	case "expire":
+		command = protocol.Expire
+	case "persist":
+		command = protocol.Persist
+	case "scan":
+		command = protocol.Scan
 	default:
-		return protocol.Message{}, errors.New("Invalid command: should be SET or GET.")
+		return protocol.Message{}, errors.New("Invalid command: should be one of GET, SET, SETNX, SETXX, DELETE, FLUSH, USAGE, MGET, MSET, INCR, DECR, INCRBY, CAS, TTL, EXPIRE, PERSIST, SCAN or STATS.")
+	}
+
+	if command == protocol.Scan {
+		return toScan(strings.Fields(input)[1:])
+	}
+
+	if command == protocol.CompareAndSet {
+		return toCompareAndSet(strings.SplitN(input, " ", 5))
+	}
+
+	if command == protocol.MGet || command == protocol.MSet {
+		return toBatch(command, strings.Fields(input)[1:])
+	}
+
+	if command == protocol.Flush || command == protocol.Usage || command == protocol.Stats {
+		if len(parts) != 1 {
+			return protocol.Message{}, errors.New(fmt.Sprintf("Invalid input, expected format: %s.", command))
+		}
+
+		return protocol.NewMessage(command, "", []byte{}, 0, c{})
 	}
 
 	key := parts[1]
 
-	if command == protocol.Get {
+	if command == protocol.Get || command == protocol.Delete || command == protocol.TTL || command == protocol.Persist {
 		if len(parts) != 2 {
-			return protocol.Message{}, errors.New("Invalid input, expected format: GET <key>.")
+			return protocol.Message{}, errors.New(fmt.Sprintf("Invalid input, expected format: %s <key>.", command))
 		}
 
 		msg, err := protocol.NewMessage(command, key, []byte{}, 0, c{})
@@ -49,18 +102,38 @@ func ToMessage(input string) (protocol.Message, error) {
 			return protocol.Message{}, err
 		}
 		return msg, nil
-	} else if command == protocol.Set {
+	} else if command == protocol.Incr || command == protocol.Decr || command == protocol.Expire {
+		if len(parts) != 3 {
+			return protocol.Message{}, errors.New(fmt.Sprintf("Invalid input, expected format: %s <key> <ttl>.", command))
+		}
+
+		ttl, err := parseTTL(parts[2])
+		if err != nil {
+			return protocol.Message{}, err
+		}
+		return protocol.NewMessageTTL(command, key, []byte{}, ttl, c{})
+	} else if command == protocol.IncrBy {
+		if len(parts) != 4 {
+			return protocol.Message{}, errors.New("Invalid input, expected format: INCRBY <key> <ttl> <amount>.")
+		}
+
+		ttl, err := parseTTL(parts[2])
+		if err != nil {
+			return protocol.Message{}, err
+		}
+		return protocol.NewMessageTTL(command, key, []byte(parts[3]), ttl, c{})
+	} else if command == protocol.Set || command == protocol.SetNX || command == protocol.SetXX {
 		if len(parts) != 4 {
-			return protocol.Message{}, errors.New("Invalid input, expected format: SET <key> <ttl> <data>.")
+			return protocol.Message{}, errors.New(fmt.Sprintf("Invalid input, expected format: %s <key> <ttl> <data>.", command))
 		}
 
-		ttl, err := strconv.Atoi(parts[2])
+		ttl, err := parseTTL(parts[2])
 		if err != nil {
-			return protocol.Message{}, errors.New(fmt.Sprintf("Invalid input, couldn't parse '%s' to an int.", parts[2]))
+			return protocol.Message{}, err
 		}
 
 		data := parts[3]
-		msg, err := protocol.NewMessage(command, key, []byte(data), ttl, c{})
+		msg, err := protocol.NewMessageTTL(command, key, []byte(data), ttl, c{})
 		if err != nil {
 			return protocol.Message{}, err
 		}
@@ -70,45 +143,253 @@ func ToMessage(input string) (protocol.Message, error) {
 	}
 }
 
-func Dial(port int) error {
-	log.Println("Connecting client to port", port)
-	for scanner := bufio.NewScanner(os.Stdin); scanner.Scan(); {
-		// TODO: 1 connection, multiple messages
-		conn, err := net.DialTCP("tcp", nil, &net.TCPAddr{Port: port})
+// TTLs are in whole seconds, or a duration with its unit like 500ms.
+func parseTTL(input string) (time.Duration, error) {
+	seconds, err := strconv.Atoi(input)
+	if err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+
+	ttl, err := time.ParseDuration(input)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Invalid input, couldn't parse '%s' to a TTL.", input))
+	}
+	return ttl, nil
+}
+
+func toCompareAndSet(parts []string) (protocol.Message, error) {
+	if len(parts) != 5 {
+		return protocol.Message{}, errors.New("Invalid input, expected format: CAS <key> <ttl> <cas> <data>.")
+	}
+
+	ttl, err := parseTTL(parts[2])
+	if err != nil {
+		return protocol.Message{}, err
+	}
+
+	cas, err := strconv.ParseUint(parts[3], 10, 64)
+	if err != nil {
+		return protocol.Message{}, errors.New(fmt.Sprintf("Invalid input, couldn't parse '%s' to a CAS.", parts[3]))
+	}
+	return protocol.NewCompareAndSetTTL(parts[1], []byte(parts[4]), ttl, cas, c{})
+}
+
+func toBatch(command protocol.Command, args []string) (protocol.Message, error) {
+	if command == protocol.MGet {
+		if len(args) == 0 {
+			return protocol.Message{}, errors.New("Invalid input, expected format: MGET <key> [<key> ...].")
+		}
+		return protocol.NewMGet(args, c{})
+	}
+
+	if len(args) == 0 || len(args)%3 != 0 {
+		return protocol.Message{}, errors.New("Invalid input, expected format: MSET <key> <ttl> <data> [<key> <ttl> <data> ...].")
+	}
+
+	entries := []protocol.Entry{}
+	for i := 0; i < len(args); i += 3 {
+		ttl, err := parseTTL(args[i+1])
 		if err != nil {
-			return err
+			return protocol.Message{}, err
 		}
 
-		go func() {
-			// Read responses from server
-			for scanner := bufio.NewScanner(conn); scanner.Scan(); {
-				fmt.Printf("%s\n", scanner.Text())
+		entry, err := protocol.NewEntry(args[i], []byte(args[i+2]), ttl, c{})
+		if err != nil {
+			return protocol.Message{}, err
+		}
+		entries = append(entries, entry)
+	}
+	return protocol.NewMSet(entries, c{})
+}
 
-				if err := scanner.Err(); err != nil {
-					log.Fatal(err)
-				}
-			}
-		}()
+// SCAN <count> [<pattern> [<cursor>]], the cursor being from the page before.
+func toScan(args []string) (protocol.Message, error) {
+	if len(args) == 0 || len(args) > 3 {
+		return protocol.Message{}, errors.New("Invalid input, expected format: SCAN <count> [<pattern> [<cursor>]].")
+	}
+
+	count, err := strconv.Atoi(args[0])
+	if err != nil {
+		return protocol.Message{}, errors.New(fmt.Sprintf("Invalid input, couldn't parse '%s' to an int.", args[0]))
+	}
 
-		line := scanner.Text()
+	var pattern, cursor string
+	if len(args) > 1 {
+		pattern = args[1]
+	}
 
-		msg, err := ToMessage(line)
+	if len(args) > 2 {
+		cursor = args[2]
+	}
+	return protocol.NewScan(cursor, pattern, count, c{})
+}
+
+// Describe formats the response to the message for people to read.
+func Describe(msg protocol.Message, response protocol.Response) string {
+	if response.Status != protocol.OK {
+		return fmt.Sprintf("%s: %s", msg.Cmd, response.Value)
+	}
+
+	switch msg.Cmd {
+	case protocol.Get:
+		if response.CAS == 0 {
+			return fmt.Sprintf("GET: %s", response.Value)
+		}
+		return fmt.Sprintf("GET: %s (CAS %d)", response.Value, response.CAS)
+	case protocol.Set, protocol.SetNX, protocol.SetXX:
+		return fmt.Sprintf("Set '%s'. Expires: %s", msg.Key, response.Expires)
+	case protocol.CompareAndSet:
+		return fmt.Sprintf("Set '%s'. Expires: %s (CAS %d)", msg.Key, response.Expires, response.CAS)
+	case protocol.Incr, protocol.Decr, protocol.IncrBy:
+		return fmt.Sprintf("%s: %s", msg.Cmd, response.Value)
+	case protocol.TTL:
+		if response.Expires.IsZero() {
+			return "TTL: no expiry"
+		}
+		ms, err := strconv.ParseInt(string(response.Value), 10, 64)
+		if err != nil {
+			return fmt.Sprintf("TTL: %s", err)
+		}
+		return fmt.Sprintf("TTL: %s", time.Duration(ms)*time.Millisecond)
+	case protocol.Expire:
+		return fmt.Sprintf("'%s' expires: %s", msg.Key, response.Expires)
+	case protocol.Persist:
+		return fmt.Sprintf("'%s' no longer expires.", msg.Key)
+	case protocol.Delete:
+		return fmt.Sprintf("Deleted '%s'.", msg.Key)
+	case protocol.Flush:
+		flushed, err := response.Count()
+		if err != nil {
+			return fmt.Sprintf("FLUSH: %s", err)
+		}
+		return fmt.Sprintf("Flushed %d items.", flushed)
+	case protocol.Usage:
+		items, bytes, err := response.Usage()
+		if err != nil {
+			return fmt.Sprintf("USAGE: %s", err)
+		}
+		return fmt.Sprintf("Items: %d. Bytes: %d.", items, bytes)
+	case protocol.Stats:
+		stats, err := response.Stats()
+		if err != nil {
+			return fmt.Sprintf("STATS: %s", err)
+		}
+
+		lines := make([]string, len(stats))
+		for i, stat := range stats {
+			lines[i] = fmt.Sprintf("%s: %d", stat.Name, stat.Value)
+		}
+		return strings.Join(lines, "\n")
+	case protocol.MGet, protocol.MSet:
+		return describeBatch(msg, response)
+	case protocol.Scan:
+		keys, next, err := response.Page()
+		if err != nil {
+			return fmt.Sprintf("SCAN: %s", err)
+		}
+
+		lines := append([]string{}, keys...)
+		if next == "" {
+			lines = append(lines, "Done.")
+		} else {
+			lines = append(lines, fmt.Sprintf("Next cursor: %s", next))
+		}
+		return strings.Join(lines, "\n")
+	default:
+		return fmt.Sprintf("%s: OK", msg.Cmd)
+	}
+}
+
+// One line per key, as if each had been sent on its own.
+func describeBatch(msg protocol.Message, response protocol.Response) string {
+	results, err := response.Results()
+	if err != nil {
+		return fmt.Sprintf("%s: %s", msg.Cmd, err)
+	}
+
+	var msgs []protocol.Message
+	if msg.Cmd == protocol.MGet {
+		keys, _ := msg.Keys()
+		for _, key := range keys {
+			msgs = append(msgs, protocol.Message{Cmd: protocol.Get, Key: key})
+		}
+	} else {
+		entries, _ := msg.Entries()
+		for _, entry := range entries {
+			msgs = append(msgs, protocol.Message{Cmd: protocol.Set, Key: entry.Key})
+		}
+	}
+
+	if len(msgs) != len(results) {
+		return fmt.Sprintf("%s: Expected %d results, got %d.", msg.Cmd, len(msgs), len(results))
+	}
+
+	lines := make([]string, len(results))
+	for i, result := range results {
+		lines[i] = fmt.Sprintf("%s: %s", msgs[i].Key, Describe(msgs[i], result))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func Dial(port int, namespace string) error {
+	log.Println("Connecting client to port", port)
+	client := New((&net.TCPAddr{Port: port}).String(), Options{PoolSize: 1, Namespace: namespace})
+	defer client.Close()
+
+	for scanner := bufio.NewScanner(os.Stdin); scanner.Scan(); {
+		msg, err := ToMessage(scanner.Text())
 		if err != nil {
 			log.Println(err)
 			continue
 		}
 
-		data, err := msg.MarshalBinary(c{})
+		response, err := client.Do(context.Background(), msg)
 		if err != nil {
 			log.Println(err)
 			continue
 		}
+		fmt.Println(Describe(msg, response))
+	}
+	return nil
+}
+
+// DialPipelined reads commands from stdin like Dial, but sends them in batches
+// of up to batch at a time without waiting for each reply.
+func DialPipelined(port int, batch int, namespace string) error {
+	log.Println("Connecting client to port", port, "in batches of", batch)
+	client := New((&net.TCPAddr{Port: port}).String(), Options{PoolSize: 1, Namespace: namespace})
+	defer client.Close()
+
+	msgs := []protocol.Message{}
+	flush := func() {
+		if len(msgs) == 0 {
+			return
+		}
 
-		_, err = conn.Write(data)
+		responses, err := client.Pipeline(context.Background(), msgs)
+		if err != nil {
+			log.Println(err)
+		} else {
+			for i, response := range responses {
+				fmt.Println(Describe(msgs[i], response))
+			}
+		}
+		msgs = msgs[:0]
+	}
+
+	scanner := bufio.NewScanner(os.Stdin)
+	for scanner.Scan() {
+		msg, err := ToMessage(scanner.Text())
 		if err != nil {
 			log.Println(err)
 			continue
 		}
+
+		msgs = append(msgs, msg)
+		if len(msgs) >= batch {
+			flush()
+		}
 	}
-	return nil
+	flush()
+	return scanner.Err()
 }
@@ -3,6 +3,7 @@ package client_test
 import (
 	"errors"
 	"fmt"
+	"strings"
 	"testing"
 	"time"
 
@@ -35,7 +36,7 @@ func TestSend(t *testing.T) {
 			t.Fatal("Expecting err, got nil.")
 		}
 
-		expected := errors.New("Invalid command: should be SET or GET.").Error()
+		expected := errors.New("Invalid command: should be one of GET, SET, SETNX, SETXX, DELETE, FLUSH, USAGE, MGET, MSET, INCR, DECR, INCRBY, CAS, TTL, EXPIRE, PERSIST, SCAN or STATS.").Error()
 		actual := err.Error()
 
 		if actual != expected {
@@ -64,9 +65,9 @@ func TestSend(t *testing.T) {
 			args     string
 			expected string
 		}{
-			{"123", "Invalid input, expected format: SET <key> <ttl> <data>."},           // Just TTL
-			{"", "Invalid input, expected format: SET <key> <ttl> <data>."},              // Not enough args
-			{"InvalidTTL data", "Invalid input, couldn't parse 'InvalidTTL' to an int."}, // Invalid TTL
+			{"123", "Invalid input, expected format: SET <key> <ttl> <data>."},          // Just TTL
+			{"", "Invalid input, expected format: SET <key> <ttl> <data>."},             // Not enough args
+			{"InvalidTTL data", "Invalid input, couldn't parse 'InvalidTTL' to a TTL."}, // Invalid TTL
 		}
 
 		for _, tc := range cases {
@@ -173,4 +174,434 @@ func TestSend(t *testing.T) {
 			}
 		}
 	})
+
+	t.Run("Test conditional SET", func(t *testing.T) {
+		cases := []struct {
+			input    string
+			expected protocol.Command
+		}{
+			{"SETNX key 420 data", protocol.SetNX},
+			{"setxx key 420 data", protocol.SetXX},
+		}
+
+		for _, tc := range cases {
+			actual, err := client.ToMessage(tc.input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual.Cmd != tc.expected {
+				t.Errorf("Expected %d, got %d", tc.expected, actual.Cmd)
+			}
+
+			if string(actual.Data) != "data" {
+				t.Errorf("Expected %s, got %s", "data", actual.Data)
+			}
+		}
+	})
+
+	t.Run("Invalid SETNX", func(t *testing.T) {
+		_, err := client.ToMessage("SETNX key 420")
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := errors.New("Invalid input, expected format: SETNX <key> <ttl> <data>.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Test DELETE", func(t *testing.T) {
+		actual, err := client.ToMessage("DELETE key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Cmd != protocol.Delete {
+			t.Errorf("Expected %d, got %d", protocol.Delete, actual.Cmd)
+		}
+
+		if actual.Key != "key" {
+			t.Errorf("Expected %s, got %s", "key", actual.Key)
+		}
+	})
+
+	t.Run("Invalid DELETE", func(t *testing.T) {
+		_, err := client.ToMessage("DELETE key 123")
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := errors.New("Invalid input, expected format: DELETE <key>.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Test FLUSH", func(t *testing.T) {
+		actual, err := client.ToMessage("FLUSH")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Cmd != protocol.Flush {
+			t.Errorf("Expected %d, got %d", protocol.Flush, actual.Cmd)
+		}
+
+		if actual.Key != "" {
+			t.Errorf("Expected no key, got %s", actual.Key)
+		}
+	})
+
+	t.Run("Invalid FLUSH", func(t *testing.T) {
+		_, err := client.ToMessage("FLUSH key")
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := errors.New("Invalid input, expected format: FLUSH.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Test USAGE", func(t *testing.T) {
+		actual, err := client.ToMessage("USAGE")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Cmd != protocol.Usage {
+			t.Errorf("Expected %d, got %d", protocol.Usage, actual.Cmd)
+		}
+	})
+
+	t.Run("Test MGET", func(t *testing.T) {
+		actual, err := client.ToMessage("MGET a b c")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Cmd != protocol.MGet {
+			t.Errorf("Expected %d, got %d", protocol.MGet, actual.Cmd)
+		}
+
+		keys, err := actual.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if strings.Join(keys, " ") != "a b c" {
+			t.Errorf("Expected 'a b c', got '%s'", strings.Join(keys, " "))
+		}
+	})
+
+	t.Run("Test MSET", func(t *testing.T) {
+		actual, err := client.ToMessage("MSET a 60 1 b 120 2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := actual.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(entries) != 2 {
+			t.Fatalf("Expected 2 entries, got %d", len(entries))
+		}
+
+		if entries[1].Key != "b" || string(entries[1].Value) != "2" {
+			t.Errorf("Expected 'b' = '2', got '%s' = '%s'", entries[1].Key, entries[1].Value)
+		}
+
+		diff := entries[1].Expires.Sub(entries[0].Expires)
+		if diff < 59*time.Second || diff > 61*time.Second {
+			t.Errorf("Expected 'b' to expire a minute after 'a', got %s", diff)
+		}
+	})
+
+	t.Run("TTLs under a second", func(t *testing.T) {
+		for _, input := range []string{"SET key 500ms value", "INCR key 500ms", "EXPIRE key 500ms", "CAS key 500ms 42 value", "MSET key 500ms value"} {
+			msg, err := client.ToMessage(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expires := msg.Expires
+			if msg.Cmd == protocol.MSet {
+				entries, err := msg.Entries()
+				if err != nil {
+					t.Fatal(err)
+				}
+				expires = entries[0].Expires
+			}
+
+			ttl := time.Until(expires)
+			if ttl <= 0 || ttl > time.Millisecond*500 {
+				t.Errorf("Expected '%s' to expire in 500ms, got %s", input, ttl)
+			}
+		}
+	})
+
+	t.Run("Invalid batches", func(t *testing.T) {
+		tests := map[string]string{
+			"MSET a 60":    "Invalid input, expected format: MSET <key> <ttl> <data> [<key> <ttl> <data> ...].",
+			"MSET a 0 one": "TTL must be at least 1ms.",
+		}
+
+		for input, message := range tests {
+			_, err := client.ToMessage(input)
+			if err == nil {
+				t.Fatalf("Expecting err for '%s', got nil.", input)
+			}
+
+			expected := errors.New(message).Error()
+			actual := err.Error()
+			if actual != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, actual)
+			}
+		}
+	})
+
+	t.Run("Test counters", func(t *testing.T) {
+		tests := map[string]protocol.Command{
+			"INCR key 60":      protocol.Incr,
+			"DECR key 60":      protocol.Decr,
+			"INCRBY key 60 -3": protocol.IncrBy,
+		}
+
+		for input, cmd := range tests {
+			actual, err := client.ToMessage(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual.Cmd != cmd || actual.Key != "key" {
+				t.Errorf("Expected %s 'key', got %s '%s'", cmd, actual.Cmd, actual.Key)
+			}
+		}
+	})
+
+	t.Run("Invalid counters", func(t *testing.T) {
+		tests := map[string]string{
+			"INCR key":          "Invalid input, expected format: INCR <key> <ttl>.",
+			"INCRBY key 60":     "Invalid input, expected format: INCRBY <key> <ttl> <amount>.",
+			"INCRBY key 60 one": "Amount for INCRBY must be an integer.",
+		}
+
+		for input, message := range tests {
+			_, err := client.ToMessage(input)
+			if err == nil {
+				t.Fatalf("Expecting err for '%s', got nil.", input)
+			}
+
+			expected := errors.New(message).Error()
+			actual := err.Error()
+			if actual != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, actual)
+			}
+		}
+	})
+
+	t.Run("Test CAS", func(t *testing.T) {
+		actual, err := client.ToMessage("CAS key 60 42 some data")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Cmd != protocol.CompareAndSet || actual.CAS != 42 {
+			t.Errorf("Expected CAS 42, got %s %d", actual.Cmd, actual.CAS)
+		}
+
+		if string(actual.Data) != "some data" {
+			t.Errorf("Expected 'some data', got '%s'", actual.Data)
+		}
+	})
+
+	t.Run("Invalid CAS", func(t *testing.T) {
+		tests := map[string]string{
+			"CAS key 60 data":    "Invalid input, expected format: CAS <key> <ttl> <cas> <data>.",
+			"CAS key 60 -1 data": "Invalid input, couldn't parse '-1' to a CAS.",
+		}
+
+		for input, message := range tests {
+			_, err := client.ToMessage(input)
+			if err == nil {
+				t.Fatalf("Expecting err for '%s', got nil.", input)
+			}
+
+			expected := errors.New(message).Error()
+			actual := err.Error()
+			if actual != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, actual)
+			}
+		}
+	})
+
+	t.Run("Test expiry commands", func(t *testing.T) {
+		tests := map[string]protocol.Command{
+			"TTL key":       protocol.TTL,
+			"EXPIRE key 60": protocol.Expire,
+			"PERSIST key":   protocol.Persist,
+		}
+
+		for input, cmd := range tests {
+			actual, err := client.ToMessage(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual.Cmd != cmd || actual.Key != "key" {
+				t.Errorf("Expected %s 'key', got %s '%s'", cmd, actual.Cmd, actual.Key)
+			}
+
+			if actual.Expires.IsZero() != (cmd != protocol.Expire) {
+				t.Errorf("Expected an expiry only for EXPIRE, got %s for %s", actual.Expires, cmd)
+			}
+		}
+	})
+
+	t.Run("Invalid expiry commands", func(t *testing.T) {
+		tests := map[string]string{
+			"TTL key 60":        "Invalid input, expected format: TTL <key>.",
+			"EXPIRE key":        "Invalid input, expected format: EXPIRE <key> <ttl>.",
+			"EXPIRE key 0":      "TTL must be at least 1ms.",
+			"PERSIST key extra": "Invalid input, expected format: PERSIST <key>.",
+		}
+
+		for input, message := range tests {
+			_, err := client.ToMessage(input)
+			if err == nil {
+				t.Fatalf("Expecting err for '%s', got nil.", input)
+			}
+
+			expected := errors.New(message).Error()
+			actual := err.Error()
+			if actual != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, actual)
+			}
+		}
+	})
+
+	t.Run("Describe TTL", func(t *testing.T) {
+		msg, err := client.ToMessage("TTL key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := map[string]struct {
+			remaining string
+			expires   time.Time
+			expected  string
+		}{
+			"With expiry":    {"60000", time.Now().Add(time.Minute), "TTL: 1m0s"},
+			"Under a second": {"250", time.Now().Add(time.Millisecond * 250), "TTL: 250ms"},
+			"No expiry":      {"", time.Time{}, "TTL: no expiry"},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				actual := client.Describe(msg, protocol.Success([]byte(tc.remaining), tc.expires))
+				if actual != tc.expected {
+					t.Errorf("Expected '%s', got '%s'", tc.expected, actual)
+				}
+			})
+		}
+	})
+
+	t.Run("Test SCAN", func(t *testing.T) {
+		tests := map[string]protocol.Query{
+			"SCAN 10":              {Cursor: "", Match: "", Count: 10},
+			"SCAN 10 user:*":       {Cursor: "", Match: "user:*", Count: 10},
+			"SCAN 5 user:* user:4": {Cursor: "user:4", Match: "user:*", Count: 5},
+		}
+
+		for input, expected := range tests {
+			msg, err := client.ToMessage(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := msg.Query()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != expected {
+				t.Errorf("Expected %+v for '%s', got %+v", expected, input, actual)
+			}
+		}
+	})
+
+	t.Run("Invalid SCAN", func(t *testing.T) {
+		tests := map[string]string{
+			"SCAN":         "Invalid format, should have 2/3 parts: CMD <KEY> <DATA (for SET)>",
+			"SCAN ten":     "Invalid input, couldn't parse 'ten' to an int.",
+			"SCAN 0":       "Count must be greater than 0.",
+			"SCAN 1 a b c": "Invalid input, expected format: SCAN <count> [<pattern> [<cursor>]].",
+		}
+
+		for input, message := range tests {
+			_, err := client.ToMessage(input)
+			if err == nil {
+				t.Fatalf("Expecting err for '%s', got nil.", input)
+			}
+
+			expected := errors.New(message).Error()
+			actual := err.Error()
+			if actual != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, actual)
+			}
+		}
+	})
+
+	t.Run("Describe SCAN", func(t *testing.T) {
+		msg, err := client.ToMessage("SCAN 2")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tests := map[string]struct {
+			response protocol.Response
+			expected string
+		}{
+			"More to come": {protocol.ScanResponse([]string{"a", "b"}, "b"), "a\nb\nNext cursor: b"},
+			"Last page":    {protocol.ScanResponse([]string{"c"}, ""), "c\nDone."},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				actual := client.Describe(msg, tc.response)
+				if actual != tc.expected {
+					t.Errorf("Expected '%s', got '%s'", tc.expected, actual)
+				}
+			})
+		}
+	})
+
+	t.Run("Test STATS", func(t *testing.T) {
+		msg, err := client.ToMessage("STATS")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if msg.Cmd != protocol.Stats {
+			t.Errorf("Expected %d, got %d", protocol.Stats, msg.Cmd)
+		}
+
+		response := protocol.StatsResponse([]protocol.Stat{{Name: "hits", Value: 3}, {Name: "misses", Value: 1}})
+		expected := "hits: 3\nmisses: 1"
+		actual := client.Describe(msg, response)
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
 }
@@ -0,0 +1,358 @@
+package client
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+	"github.com/todaatsushi/handrolled-cache/pkg/ring"
+)
+
+// How long a node that couldn't be reached is skipped before trying it again.
+const retryDown = 5 * time.Second
+
+// Cluster spreads keys over several cache nodes with a consistent hash ring.
+// Keys on a node which can't be reached go to the next node on the ring until
+// it's back.
+type Cluster struct {
+	ring    *ring.Ring
+	clients map[string]*Client
+
+	mu   sync.Mutex
+	down map[string]time.Time // When to next try each unreachable node
+}
+
+func NewCluster(addrs []string) (*Cluster, error) {
+	return NewClusterWithOptions(addrs, Options{})
+}
+
+// NewClusterWithOptions creates a client for each node with the options.
+func NewClusterWithOptions(addrs []string, opts Options) (*Cluster, error) {
+	if len(addrs) == 0 {
+		return nil, errors.New("No nodes provided.")
+	}
+
+	clients := map[string]*Client{}
+	for _, addr := range addrs {
+		clients[addr] = New(addr, opts)
+	}
+
+	return &Cluster{
+		ring:    ring.New(ring.DEFAULT_REPLICAS, addrs...),
+		clients: clients,
+		down:    map[string]time.Time{},
+	}, nil
+}
+
+func (cluster *Cluster) isDown(node string) bool {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	retry, ok := cluster.down[node]
+	return ok && time.Now().Before(retry)
+}
+
+func (cluster *Cluster) markDown(node string) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	log.Println("Node unreachable:", node)
+	cluster.down[node] = time.Now().Add(retryDown)
+}
+
+func (cluster *Cluster) markUp(node string) {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	delete(cluster.down, node)
+}
+
+// Node returns the address of the reachable node the key lives on.
+func (cluster *Cluster) Node(key string) (string, error) {
+	nodes := cluster.ring.GetN(key, len(cluster.ring.Nodes()))
+	for _, node := range nodes {
+		if !cluster.isDown(node) {
+			return node, nil
+		}
+	}
+	return "", errors.New("No nodes available.")
+}
+
+// Whether the node couldn't be connected to, so never got the message and it's
+// safe to try elsewhere.
+func unreachable(err error) bool {
+	var opErr *net.OpError
+	return errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// Do sends the message to the node which owns its key, falling back along the
+// ring if it can't be reached. FLUSH, USAGE and STATS go to every node, with
+// the counts added up, as does SCAN with the pages merged.
+func (cluster *Cluster) Do(ctx context.Context, msg protocol.Message) (protocol.Response, error) {
+	if msg.Cmd == protocol.MGet || msg.Cmd == protocol.MSet {
+		return cluster.batch(ctx, msg)
+	}
+
+	if msg.Key == "" {
+		return cluster.all(ctx, msg)
+	}
+
+	for {
+		node, err := cluster.Node(msg.Key)
+		if err != nil {
+			return protocol.Response{}, err
+		}
+
+		response, err := cluster.clients[node].Do(ctx, msg)
+		if err != nil {
+			// The caller gave up, which says nothing about the node.
+			if err := contextErr(ctx); err != nil {
+				return protocol.Response{}, err
+			}
+			cluster.markDown(node)
+
+			if unreachable(err) {
+				continue
+			}
+			return protocol.Response{}, err
+		}
+
+		cluster.markUp(node)
+		return response, nil
+	}
+}
+
+// Splits the batch into one per node and puts the results back in order.
+func (cluster *Cluster) batch(ctx context.Context, msg protocol.Message) (protocol.Response, error) {
+	var keys []string
+	var entries []protocol.Entry
+	if msg.Cmd == protocol.MGet {
+		var err error
+		keys, err = msg.Keys()
+		if err != nil {
+			return protocol.Response{}, err
+		}
+	} else {
+		var err error
+		entries, err = msg.Entries()
+		if err != nil {
+			return protocol.Response{}, err
+		}
+
+		for _, entry := range entries {
+			keys = append(keys, entry.Key)
+		}
+	}
+
+	results := make([]protocol.Response, len(keys))
+	remaining := make([]int, len(keys))
+	for i := range keys {
+		remaining[i] = i
+	}
+
+	// Keys are regrouped whenever a node turns out to be down.
+	for len(remaining) > 0 {
+		groups := map[string][]int{}
+		for _, i := range remaining {
+			node, err := cluster.Node(keys[i])
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			groups[node] = append(groups[node], i)
+		}
+		remaining = nil
+
+		for node, indexes := range groups {
+			var sub protocol.Message
+			var err error
+			if msg.Cmd == protocol.MGet {
+				subKeys := make([]string, len(indexes))
+				for j, i := range indexes {
+					subKeys[j] = keys[i]
+				}
+				sub, err = protocol.NewMGet(subKeys, c{})
+			} else {
+				subEntries := make([]protocol.Entry, len(indexes))
+				for j, i := range indexes {
+					subEntries[j] = entries[i]
+				}
+				sub, err = protocol.NewMSet(subEntries, c{})
+			}
+			if err != nil {
+				return protocol.Response{}, err
+			}
+
+			response, err := cluster.clients[node].Do(ctx, sub)
+			if err != nil {
+				if err := contextErr(ctx); err != nil {
+					return protocol.Response{}, err
+				}
+				cluster.markDown(node)
+				if unreachable(err) {
+					remaining = append(remaining, indexes...)
+					continue
+				}
+				return protocol.Response{}, err
+			}
+			cluster.markUp(node)
+
+			if response.Status != protocol.OK {
+				return response, nil
+			}
+
+			subResults, err := response.Results()
+			if err != nil {
+				return protocol.Response{}, err
+			}
+
+			if len(subResults) != len(indexes) {
+				return protocol.Response{}, errors.New(fmt.Sprintf("Expected %d results from %s, got %d.", len(indexes), node, len(subResults)))
+			}
+
+			for j, i := range indexes {
+				results[i] = subResults[j]
+			}
+		}
+	}
+	return protocol.BatchResponse(results), nil
+}
+
+func (cluster *Cluster) all(ctx context.Context, msg protocol.Message) (protocol.Response, error) {
+	var count, items, bytes uint64
+	keys := []string{}
+	more := false
+	stats := []protocol.Stat{}
+	for _, node := range cluster.ring.Nodes() {
+		response, err := cluster.clients[node].Do(ctx, msg)
+		if err != nil {
+			if err := contextErr(ctx); err != nil {
+				return protocol.Response{}, err
+			}
+			cluster.markDown(node)
+			return protocol.Response{}, errors.New(fmt.Sprintf("Couldn't reach %s: %s", node, err))
+		}
+
+		if response.Status != protocol.OK {
+			return response, nil
+		}
+
+		switch msg.Cmd {
+		case protocol.Flush:
+			flushed, err := response.Count()
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			count += flushed
+		case protocol.Usage:
+			i, b, err := response.Usage()
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			items += i
+			bytes += b
+		case protocol.Scan:
+			page, next, err := response.Page()
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			keys = append(keys, page...)
+			more = more || next != ""
+		case protocol.Stats:
+			nodeStats, err := response.Stats()
+			if err != nil {
+				return protocol.Response{}, err
+			}
+			stats = addStats(stats, nodeStats)
+		}
+	}
+
+	if msg.Cmd == protocol.Usage {
+		return protocol.UsageResponse(items, bytes), nil
+	}
+
+	if msg.Cmd == protocol.Scan {
+		return scanResponse(msg, keys, more)
+	}
+
+	if msg.Cmd == protocol.Stats {
+		return protocol.StatsResponse(stats), nil
+	}
+	return protocol.CountResponse(count), nil
+}
+
+// Adds up stats with the same name. Nodes only send stats for the commands
+// they've handled, so new ones go on the end.
+func addStats(total []protocol.Stat, stats []protocol.Stat) []protocol.Stat {
+	for _, stat := range stats {
+		i := slices.IndexFunc(total, func(t protocol.Stat) bool { return t.Name == stat.Name })
+		if i == -1 {
+			total = append(total, stat)
+		} else {
+			total[i].Value += stat.Value
+		}
+	}
+	return total
+}
+
+// Every node is scanned with the same cursor, as it's the last key sent back
+// rather than anything about the node. Keeps the first of all their pages.
+func scanResponse(msg protocol.Message, keys []string, more bool) (protocol.Response, error) {
+	query, err := msg.Query()
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	slices.Sort(keys)
+	if len(keys) > query.Count {
+		keys = keys[:query.Count]
+		more = true
+	}
+
+	var next string
+	if more {
+		next = keys[len(keys)-1]
+	}
+	return protocol.ScanResponse(keys, next), nil
+}
+
+// Close closes the connections to every node.
+func (cluster *Cluster) Close() error {
+	for _, client := range cluster.clients {
+		client.Close()
+	}
+	return nil
+}
+
+func DialCluster(addrs []string, namespace string) error {
+	cluster, err := NewClusterWithOptions(addrs, Options{Namespace: namespace})
+	if err != nil {
+		return err
+	}
+	defer cluster.Close()
+
+	log.Println("Connecting client to nodes", strings.Join(addrs, ", "))
+	for scanner := bufio.NewScanner(os.Stdin); scanner.Scan(); {
+		msg, err := ToMessage(scanner.Text())
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+
+		response, err := cluster.Do(context.Background(), msg)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		fmt.Println(Describe(msg, response))
+	}
+	return nil
+}
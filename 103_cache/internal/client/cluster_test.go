@@ -0,0 +1,295 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/todaatsushi/handrolled-cache/internal/client"
+	"github.com/todaatsushi/handrolled-cache/internal/server"
+)
+
+// Starts a cache node on a random port, returning its address and listener.
+func node(t *testing.T) (string, net.Listener) {
+	t.Helper()
+
+	s, err := server.NewServer(server.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go s.Serve(listener)
+	return listener.Addr().String(), listener
+}
+
+func do(t *testing.T, cluster *client.Cluster, input string) string {
+	t.Helper()
+
+	msg, err := client.ToMessage(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := cluster.Do(context.Background(), msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return client.Describe(msg, response)
+}
+
+func TestCluster(t *testing.T) {
+	t.Run("No nodes", func(t *testing.T) {
+		_, err := client.NewCluster([]string{})
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := "No nodes provided."
+		actual := err.Error()
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Keys are spread over nodes", func(t *testing.T) {
+		a, _ := node(t)
+		b, _ := node(t)
+		c, _ := node(t)
+
+		cluster, err := client.NewCluster([]string{a, b, c})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 30; i++ {
+			do(t, cluster, fmt.Sprintf("set key-%d 60 value-%d", i, i))
+		}
+
+		for i := 0; i < 30; i++ {
+			expected := fmt.Sprintf("GET: value-%d (CAS ", i)
+			actual := do(t, cluster, fmt.Sprintf("get key-%d", i))
+			if !strings.HasPrefix(actual, expected) {
+				t.Errorf("Expected '%s', got '%s'", expected, actual)
+			}
+		}
+
+		expected := "Items: 30. Bytes: 400."
+		actual := do(t, cluster, "usage")
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+
+		for _, addr := range []string{a, b, c} {
+			single, err := client.NewCluster([]string{addr})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			usage := do(t, single, "usage")
+			if usage == "Items: 0. Bytes: 0." {
+				t.Errorf("Expected keys on '%s', got '%s'", addr, usage)
+			}
+		}
+
+		expected = "Flushed 30 items."
+		actual = do(t, cluster, "flush")
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Keys move off a failed node", func(t *testing.T) {
+		a, _ := node(t)
+		b, listener := node(t)
+
+		cluster, err := client.NewCluster([]string{a, b})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		key := ""
+		for i := 0; key == ""; i++ {
+			candidate := fmt.Sprintf("key-%d", i)
+			owner, err := cluster.Node(candidate)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if owner == b {
+				key = candidate
+			}
+		}
+
+		listener.Close()
+
+		expected := fmt.Sprintf("Set '%s'.", key)
+		actual := do(t, cluster, fmt.Sprintf("set %s 60 value", key))
+		if !strings.HasPrefix(actual, expected) {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+
+		owner, err := cluster.Node(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if owner != a {
+			t.Errorf("Expected '%s' on '%s', got '%s'", key, a, owner)
+		}
+
+		expected = "GET: value (CAS "
+		actual = do(t, cluster, "get "+key)
+		if !strings.HasPrefix(actual, expected) {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Cancelled requests don't take nodes down", func(t *testing.T) {
+		a, _ := node(t)
+		b, _ := node(t)
+
+		cluster, err := client.NewCluster([]string{a, b})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		owner, err := cluster.Node("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		for _, input := range []string{"get key", "mget key other", "usage"} {
+			msg, err := client.ToMessage(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = cluster.Do(cancelled, msg)
+			if !errors.Is(err, context.Canceled) {
+				t.Errorf("Expected '%s' to be cancelled, got '%v'", input, err)
+			}
+		}
+
+		actual, err := cluster.Node("key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual != owner {
+			t.Errorf("Expected 'key' on '%s', got '%s'", owner, actual)
+		}
+
+		expected := "Set 'key'."
+		set := do(t, cluster, "set key 60 value")
+		if !strings.HasPrefix(set, expected) {
+			t.Errorf("Expected '%s', got '%s'", expected, set)
+		}
+	})
+
+	t.Run("Batches span nodes", func(t *testing.T) {
+		a, _ := node(t)
+		b, _ := node(t)
+		c, _ := node(t)
+
+		cluster, err := client.NewCluster([]string{a, b, c})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		set := []string{"mset"}
+		get := []string{"mget"}
+		expected := []string{}
+		for i := 0; i < 30; i++ {
+			set = append(set, fmt.Sprintf("key-%d 60 value-%d", i, i))
+			get = append(get, fmt.Sprintf("key-%d", i))
+			expected = append(expected, fmt.Sprintf("key-%d: GET: value-%d", i, i))
+		}
+
+		do(t, cluster, strings.Join(set, " "))
+
+		actual := do(t, cluster, strings.Join(get, " "))
+		if actual != strings.Join(expected, "\n") {
+			t.Errorf("Expected '%s', got '%s'", strings.Join(expected, "\n"), actual)
+		}
+
+		for _, addr := range []string{a, b, c} {
+			single, err := client.NewCluster([]string{addr})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			usage := do(t, single, "usage")
+			if usage == "Items: 0. Bytes: 0." {
+				t.Errorf("Expected keys on '%s', got '%s'", addr, usage)
+			}
+		}
+	})
+
+	t.Run("Scan spans nodes", func(t *testing.T) {
+		a, _ := node(t)
+		b, _ := node(t)
+		c, _ := node(t)
+
+		cluster, err := client.NewCluster([]string{a, b, c})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{}
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("key-%02d", i)
+			do(t, cluster, fmt.Sprintf("set %s 60 value", key))
+			expected = append(expected, key)
+		}
+		do(t, cluster, "set other 60 value")
+
+		actual := []string{}
+		scanner := cluster.Scan("key-*", 7)
+		for scanner.Next(context.Background()) {
+			actual = append(actual, scanner.Key())
+		}
+
+		if scanner.Err() != nil {
+			t.Fatal(scanner.Err())
+		}
+
+		if strings.Join(actual, " ") != strings.Join(expected, " ") {
+			t.Errorf("Expected %v, got %v", expected, actual)
+		}
+	})
+
+	t.Run("Stats added up over nodes", func(t *testing.T) {
+		a, _ := node(t)
+		b, _ := node(t)
+
+		cluster, err := client.NewCluster([]string{a, b})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i := 0; i < 10; i++ {
+			do(t, cluster, fmt.Sprintf("set key-%d 60 value", i))
+			do(t, cluster, fmt.Sprintf("get key-%d", i))
+		}
+		do(t, cluster, "get missing")
+
+		actual := do(t, cluster, "stats")
+		for _, expected := range []string{"items: 10\n", "hits: 10\n", "misses: 1\n", "set_calls: 10\n", "get_calls: 11\n"} {
+			if !strings.Contains(actual+"\n", expected) {
+				t.Errorf("Expected '%s' in '%s'", expected, actual)
+			}
+		}
+	})
+}
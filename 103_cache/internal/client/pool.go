@@ -0,0 +1,621 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+)
+
+// Error is a request the server couldn't carry out. Compare with errors.Is
+// against the Err values, which match on Code.
+type Error struct {
+	Code    protocol.ErrorCode
+	Message string
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+func (e *Error) Is(target error) bool {
+	t, ok := target.(*Error)
+	return ok && t.Code == e.Code
+}
+
+var (
+	ErrNotFound   = &Error{protocol.NotFound, "Value doesn't exist."}
+	ErrExpired    = &Error{protocol.Expired, "Expired."}
+	ErrExists     = &Error{protocol.Exists, "Value already exists."}
+	ErrTooLarge   = &Error{protocol.TooLarge, "Value too large for cache."}
+	ErrPastExpiry = &Error{protocol.PastExpiry, "Expiry can't be in the past."}
+	ErrBadRequest = &Error{protocol.BadRequest, "Bad request."}
+	ErrReadOnly   = &Error{protocol.ReadOnly, "Read only replica."}
+	ErrNotInteger = &Error{protocol.NotInteger, "Value isn't an integer."}
+	ErrOverflow   = &Error{protocol.Overflow, "Increment would overflow."}
+	ErrChanged    = &Error{protocol.Changed, "Value has changed."}
+	ErrEvicted    = &Error{protocol.Evicted, "Evicted to make room."}
+
+	ErrClosed = errors.New("Client closed.")
+)
+
+// Returned by TTL for keys that have had their expiry removed by Persist.
+const NO_EXPIRY time.Duration = -1
+
+type Options struct {
+	PoolSize    int           // Idle connections kept open, defaults to 4
+	DialTimeout time.Duration // Defaults to 1s, or the context deadline if sooner
+	Namespace   string        // Selected on every new connection, "" == the server's default
+}
+
+// SELECT only lasts as long as the connection, which the pool hides.
+var errSelect = errors.New("Namespaces can't be selected per request, set Options.Namespace instead.")
+
+// Client talks to a single cache server over a pool of persistent connections.
+// It's safe for concurrent use.
+type Client struct {
+	addr string
+	opts Options
+	idle chan net.Conn
+	ids  atomic.Uint32 // Last request ID used
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func New(addr string, opts Options) *Client {
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 4
+	}
+
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = time.Second
+	}
+
+	return &Client{
+		addr: addr,
+		opts: opts,
+		idle: make(chan net.Conn, opts.PoolSize),
+	}
+}
+
+// Takes an idle connection, or opens a new one if there aren't any.
+func (client *Client) conn(ctx context.Context) (conn net.Conn, reused bool, err error) {
+	select {
+	case conn := <-client.idle:
+		return conn, true, nil
+	default:
+	}
+
+	dialer := net.Dialer{Timeout: client.opts.DialTimeout}
+	conn, err = dialer.DialContext(ctx, "tcp", client.addr)
+	if err != nil || client.opts.Namespace == "" {
+		return conn, false, err
+	}
+
+	err = client.selectNamespace(ctx, conn)
+	if err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	return conn, false, nil
+}
+
+func (client *Client) selectNamespace(ctx context.Context, conn net.Conn) error {
+	msg, err := protocol.NewMessage(protocol.Select, client.opts.Namespace, []byte{}, 0, c{})
+	if err != nil {
+		return err
+	}
+
+	msg.ID = client.ids.Add(1)
+	data, err := msg.MarshalBinary(c{})
+	if err != nil {
+		return err
+	}
+
+	response, err := client.roundTrip(ctx, conn, data)
+	if err != nil {
+		return err
+	}
+	return responseError(response)
+}
+
+// Returns the connection to the pool, closing it if the pool is full.
+func (client *Client) release(conn net.Conn) {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		conn.Close()
+		return
+	}
+
+	select {
+	case client.idle <- conn:
+	default:
+		conn.Close()
+	}
+}
+
+func (client *Client) roundTrip(ctx context.Context, conn net.Conn, data []byte) (protocol.Response, error) {
+	deadline, _ := ctx.Deadline()
+	err := conn.SetDeadline(deadline)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	// Unblock the read or write as soon as the context is cancelled.
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	_, err = conn.Write(data)
+	if err != nil {
+		return protocol.Response{}, &writeError{err}
+	}
+	return protocol.ReadResponse(conn)
+}
+
+// Sending the request failed, so the server never got all of it and it's safe
+// to send again.
+type writeError struct {
+	err error
+}
+
+func (e *writeError) Error() string {
+	return e.err.Error()
+}
+
+func (e *writeError) Unwrap() error {
+	return e.err
+}
+
+// The connection deadline can pass a moment before the context notices, so
+// check the deadline as well.
+func contextErr(ctx context.Context) error {
+	deadline, ok := ctx.Deadline()
+	if ok && !time.Now().Before(deadline) {
+		return context.DeadlineExceeded
+	}
+	return ctx.Err()
+}
+
+// Do sends the message and waits for the response. Errors are only returned
+// for failing to talk to the server, check the response for whether the
+// request itself failed.
+func (client *Client) Do(ctx context.Context, msg protocol.Message) (protocol.Response, error) {
+	client.mu.Lock()
+	closed := client.closed
+	client.mu.Unlock()
+	if closed {
+		return protocol.Response{}, ErrClosed
+	}
+
+	if msg.Cmd == protocol.Select {
+		return protocol.Response{}, errSelect
+	}
+
+	msg.ID = client.ids.Add(1)
+	data, err := msg.MarshalBinary(c{})
+	if err != nil {
+		return protocol.Response{}, err
+	}
+
+	for {
+		conn, reused, err := client.conn(ctx)
+		if err != nil {
+			return protocol.Response{}, err
+		}
+
+		response, err := client.roundTrip(ctx, conn, data)
+		if err != nil {
+			conn.Close()
+			if err := contextErr(ctx); err != nil {
+				return protocol.Response{}, err
+			}
+
+			// The server may have closed an idle connection, try a fresh one.
+			// Once it's been sent, a write could have been applied already, so
+			// only reads are sent again.
+			var writeErr *writeError
+			if reused && (errors.As(err, &writeErr) || !msg.Cmd.Writes()) {
+				continue
+			}
+			return protocol.Response{}, err
+		}
+
+		if response.ID != msg.ID {
+			conn.Close()
+			return protocol.Response{}, errors.New(fmt.Sprintf("Unexpected response ID %d.", response.ID))
+		}
+
+		client.release(conn)
+		return response, nil
+	}
+}
+
+// Pipeline sends the messages on a single connection without waiting for each
+// reply, returning the responses in the same order. If the connection drops,
+// anything the server didn't get to is sent again on a new one. Writes the
+// server might have got but not answered aren't, and the error is returned.
+func (client *Client) Pipeline(ctx context.Context, msgs []protocol.Message) ([]protocol.Response, error) {
+	client.mu.Lock()
+	closed := client.closed
+	client.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+
+	frames := make([][]byte, len(msgs))
+	pending := map[uint32]int{} // ID to index in msgs
+	for i, msg := range msgs {
+		if msg.Cmd == protocol.Select {
+			return nil, errSelect
+		}
+
+		msg.ID = client.ids.Add(1)
+		data, err := msg.MarshalBinary(c{})
+		if err != nil {
+			return nil, err
+		}
+
+		frames[i] = data
+		pending[msg.ID] = i
+	}
+
+	responses := make([]protocol.Response, len(msgs))
+	for len(pending) > 0 {
+		conn, reused, err := client.conn(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		before := len(pending)
+		sent, err := client.pipeline(ctx, conn, frames, pending, responses)
+		if err != nil {
+			conn.Close()
+			if err := contextErr(ctx); err != nil {
+				return nil, err
+			}
+
+			// Sending a write again could apply it twice.
+			for _, index := range sent {
+				if msgs[index].Cmd.Writes() {
+					return nil, err
+				}
+			}
+
+			// Only give up if the connection was fresh and nothing came back.
+			if !reused && len(pending) == before {
+				return nil, err
+			}
+			continue
+		}
+		client.release(conn)
+	}
+	return responses, nil
+}
+
+// Sends every pending frame and reads responses until they're all answered,
+// removing each from pending as its response arrives. On failure, returns the
+// unanswered frames which were sent in full, as the server may have run them.
+func (client *Client) pipeline(ctx context.Context, conn net.Conn, frames [][]byte, pending map[uint32]int, responses []protocol.Response) ([]int, error) {
+	deadline, _ := ctx.Deadline()
+	err := conn.SetDeadline(deadline)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetDeadline(time.Now())
+	})
+	defer stop()
+
+	unanswered := make([]bool, len(frames))
+	for _, index := range pending {
+		unanswered[index] = true
+	}
+
+	batch := []byte{}
+	order := []int{} // Index of each frame in the batch
+	for i, frame := range frames {
+		if unanswered[i] {
+			batch = append(batch, frame...)
+			order = append(order, i)
+		}
+	}
+
+	// Written alongside reading, or both ends could block on full buffers.
+	var written int
+	var writeErr error
+	done := make(chan struct{})
+	go func() {
+		written, writeErr = conn.Write(batch)
+		close(done)
+	}()
+
+	fail := func(err error) ([]int, error) {
+		// Stop the write to find out how far it got.
+		conn.SetDeadline(time.Now())
+		<-done
+
+		waiting := map[int]bool{}
+		for _, index := range pending {
+			waiting[index] = true
+		}
+
+		sent := []int{}
+		end := 0
+		for _, index := range order {
+			end += len(frames[index])
+			if end > written {
+				break
+			}
+
+			if waiting[index] {
+				sent = append(sent, index)
+			}
+		}
+		return sent, err
+	}
+
+	for len(pending) > 0 {
+		response, err := protocol.ReadResponse(conn)
+		if err != nil {
+			return fail(err)
+		}
+
+		index, ok := pending[response.ID]
+		if !ok {
+			return fail(errors.New(fmt.Sprintf("Unexpected response ID %d.", response.ID)))
+		}
+		responses[index] = response
+		delete(pending, response.ID)
+	}
+
+	<-done
+	return nil, writeErr
+}
+
+func responseError(response protocol.Response) error {
+	if response.Status == protocol.OK {
+		return nil
+	}
+	return &Error{response.Code, string(response.Value)}
+}
+
+func (client *Client) do(ctx context.Context, msg protocol.Message) (protocol.Response, error) {
+	response, err := client.Do(ctx, msg)
+	if err != nil {
+		return protocol.Response{}, err
+	}
+	return response, responseError(response)
+}
+
+func (client *Client) Get(ctx context.Context, key string) ([]byte, error) {
+	msg, err := protocol.NewMessage(protocol.Get, key, []byte{}, 0, c{})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.do(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return response.Value, nil
+}
+
+// Set stores the value until the TTL has passed, returning when it expires.
+func (client *Client) Set(ctx context.Context, key string, value []byte, ttl time.Duration) (time.Time, error) {
+	msg, err := protocol.NewMessageTTL(protocol.Set, key, value, ttl, c{})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	response, err := client.do(ctx, msg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return response.Expires, nil
+}
+
+func (client *Client) Delete(ctx context.Context, key string) error {
+	msg, err := protocol.NewMessage(protocol.Delete, key, []byte{}, 0, c{})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.do(ctx, msg)
+	return err
+}
+
+// TTL returns how long until the key expires, NO_EXPIRY if it never does.
+func (client *Client) TTL(ctx context.Context, key string) (time.Duration, error) {
+	msg, err := protocol.NewMessage(protocol.TTL, key, []byte{}, 0, c{})
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := client.do(ctx, msg)
+	if err != nil {
+		return 0, err
+	}
+
+	if response.Expires.IsZero() {
+		return NO_EXPIRY, nil
+	}
+	return remaining(response)
+}
+
+// How long the server says is left, rather than going by our own clock.
+func remaining(response protocol.Response) (time.Duration, error) {
+	ms, err := strconv.ParseInt(string(response.Value), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return max(time.Duration(ms)*time.Millisecond, 0), nil
+}
+
+// Expire changes the key to expire after the TTL instead, leaving the value.
+func (client *Client) Expire(ctx context.Context, key string, ttl time.Duration) (time.Time, error) {
+	msg, err := protocol.NewMessageTTL(protocol.Expire, key, []byte{}, ttl, c{})
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	response, err := client.do(ctx, msg)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return response.Expires, nil
+}
+
+// Persist removes the key's expiry, so it stays until deleted or evicted.
+func (client *Client) Persist(ctx context.Context, key string) error {
+	msg, err := protocol.NewMessage(protocol.Persist, key, []byte{}, 0, c{})
+	if err != nil {
+		return err
+	}
+
+	_, err = client.do(ctx, msg)
+	return err
+}
+
+// GetCAS gets the value along with its CAS, to pass to CompareAndSet.
+func (client *Client) GetCAS(ctx context.Context, key string) ([]byte, uint64, error) {
+	msg, err := protocol.NewMessage(protocol.Get, key, []byte{}, 0, c{})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	response, err := client.do(ctx, msg)
+	if err != nil {
+		return nil, 0, err
+	}
+	return response.Value, response.CAS, nil
+}
+
+// CompareAndSet stores the value only if nothing else has since the CAS was
+// read, returning the new CAS. Fails with ErrChanged if something has.
+func (client *Client) CompareAndSet(ctx context.Context, key string, value []byte, ttl time.Duration, cas uint64) (uint64, error) {
+	msg, err := protocol.NewCompareAndSetTTL(key, value, ttl, cas, c{})
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := client.do(ctx, msg)
+	if err != nil {
+		return 0, err
+	}
+	return response.CAS, nil
+}
+
+// Incr adds the amount to the integer stored at the key, returning the new
+// count. A missing key starts from 0 and expires after the TTL.
+func (client *Client) Incr(ctx context.Context, key string, amount int64, ttl time.Duration) (int64, error) {
+	msg, err := protocol.NewMessageTTL(protocol.IncrBy, key, []byte(strconv.FormatInt(amount, 10)), ttl, c{})
+	if err != nil {
+		return 0, err
+	}
+
+	response, err := client.do(ctx, msg)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseInt(string(response.Value), 10, 64)
+}
+
+// Result of one key in a batch. Err is an *Error for anything the server
+// couldn't do with that key.
+type Result struct {
+	Value   []byte
+	Expires time.Time
+	Err     error
+}
+
+// Item is one key to store with MSet.
+type Item struct {
+	Key   string
+	Value []byte
+	TTL   time.Duration
+}
+
+func batchResults(response protocol.Response) ([]Result, error) {
+	responses, err := response.Results()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]Result, len(responses))
+	for i, r := range responses {
+		results[i] = Result{r.Value, r.Expires, responseError(r)}
+	}
+	return results, nil
+}
+
+// MGet gets every key in a single round trip, with a result for each in the
+// same order.
+func (client *Client) MGet(ctx context.Context, keys []string) ([]Result, error) {
+	msg, err := protocol.NewMGet(keys, c{})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.do(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return batchResults(response)
+}
+
+// MSet stores every item in a single round trip, with a result for each in the
+// same order. Nobody sees only some of the items stored. Items pushed out to
+// make room for later ones in the batch fail with ErrEvicted.
+func (client *Client) MSet(ctx context.Context, items []Item) ([]Result, error) {
+	entries := make([]protocol.Entry, len(items))
+	for i, item := range items {
+		entry, err := protocol.NewEntry(item.Key, item.Value, item.TTL, c{})
+		if err != nil {
+			return nil, err
+		}
+		entries[i] = entry
+	}
+
+	msg, err := protocol.NewMSet(entries, c{})
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := client.do(ctx, msg)
+	if err != nil {
+		return nil, err
+	}
+	return batchResults(response)
+}
+
+// Close closes every idle connection, requests after are rejected.
+func (client *Client) Close() error {
+	client.mu.Lock()
+	defer client.mu.Unlock()
+
+	if client.closed {
+		return nil
+	}
+	client.closed = true
+
+	for {
+		select {
+		case conn := <-client.idle:
+			conn.Close()
+		default:
+			return nil
+		}
+	}
+}
@@ -0,0 +1,739 @@
+package client_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/client"
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+	"github.com/todaatsushi/handrolled-cache/internal/server"
+)
+
+// Counts the connections accepted.
+type countingListener struct {
+	net.Listener
+	accepted atomic.Int64
+}
+
+func (l *countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err == nil {
+		l.accepted.Add(1)
+	}
+	return conn, err
+}
+
+func countingNode(t *testing.T) (string, *countingListener) {
+	t.Helper()
+
+	s, err := server.NewServer(server.Config{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener := &countingListener{Listener: inner}
+	t.Cleanup(func() { listener.Close() })
+
+	go s.Serve(listener)
+	return listener.Addr().String(), listener
+}
+
+type wallClock struct{}
+
+func (wallClock) Now() time.Time {
+	return time.Now()
+}
+
+// Answers the first replies requests, then drops the connection on any more
+// without replying, as though it went away after reading them.
+func droppingNode(t *testing.T, replies int64) (string, *atomic.Int64) {
+	t.Helper()
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	received := &atomic.Int64{}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+
+			go func() {
+				defer conn.Close()
+
+				reader := protocol.NewReader(conn)
+				for {
+					data, err := reader.Read()
+					if err != nil {
+						return
+					}
+
+					msg, err := protocol.UnmarshalBinary(data, wallClock{})
+					if err != nil || received.Add(1) > replies {
+						return
+					}
+
+					response := protocol.Success([]byte("1"), time.Time{})
+					response.ID = msg.ID
+					data, err = response.MarshalBinary()
+					if err != nil {
+						return
+					}
+					conn.Write(data)
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String(), received
+}
+
+func TestClient(t *testing.T) {
+	ctx := context.Background()
+
+	t.Run("Set, get and delete", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		expires, err := c.Set(ctx, "key", []byte("value"), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if time.Until(expires) < 58*time.Second {
+			t.Errorf("Expected expiry in a minute, got %s", expires)
+		}
+
+		value, err := c.Get(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "value" {
+			t.Errorf("Expected 'value', got '%s'", value)
+		}
+
+		ttl, err := c.TTL(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl <= 58*time.Second || ttl > time.Minute {
+			t.Errorf("Expected TTL of about a minute, got %s", ttl)
+		}
+
+		err = c.Delete(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.Get(ctx, "key")
+		if !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("Typed errors", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		err := c.Delete(ctx, "missing")
+		if !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+
+		var clientErr *client.Error
+		if !errors.As(err, &clientErr) {
+			t.Fatalf("Expected *client.Error, got %T", err)
+		}
+
+		expected := errors.New("Value doesn't exist.").Error()
+		actual := clientErr.Message
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+
+		if errors.Is(err, client.ErrExpired) {
+			t.Error("Expected not to match ErrExpired")
+		}
+
+		// Still usable after the error.
+		_, err = c.Set(ctx, "key", []byte("value"), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	t.Run("Connections are reused", func(t *testing.T) {
+		addr, listener := countingNode(t)
+		c := client.New(addr, client.Options{PoolSize: 2})
+		defer c.Close()
+
+		for i := 0; i < 20; i++ {
+			_, err := c.Set(ctx, fmt.Sprint("key-", i), []byte("value"), time.Minute)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Failed requests don't cost the connection either.
+			err = c.Delete(ctx, "missing")
+			if !errors.Is(err, client.ErrNotFound) {
+				t.Fatalf("Expected ErrNotFound, got %v", err)
+			}
+		}
+
+		accepted := listener.accepted.Load()
+		if accepted != 1 {
+			t.Errorf("Expected 1 connection, got %d", accepted)
+		}
+	})
+
+	t.Run("Concurrent use", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{PoolSize: 4})
+		defer c.Close()
+
+		var wg sync.WaitGroup
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				key := fmt.Sprint("key-", i)
+				for j := 0; j < 20; j++ {
+					_, err := c.Set(ctx, key, []byte(fmt.Sprint(j)), time.Minute)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					value, err := c.Get(ctx, key)
+					if err != nil {
+						t.Error(err)
+						return
+					}
+
+					if string(value) != fmt.Sprint(j) {
+						t.Errorf("Expected '%d', got '%s'", j, value)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	})
+
+	t.Run("Context deadline", func(t *testing.T) {
+		// Accepts but never replies
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		c := client.New(listener.Addr().String(), client.Options{})
+		defer c.Close()
+
+		timeout, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+
+		start := time.Now()
+		_, err = c.Get(timeout, "key")
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected deadline exceeded, got %v", err)
+		}
+
+		if time.Since(start) > time.Second {
+			t.Errorf("Expected to give up at the deadline, took %s", time.Since(start))
+		}
+	})
+
+	t.Run("Closed", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{})
+		c.Close()
+
+		_, err := c.Get(ctx, "key")
+		if !errors.Is(err, client.ErrClosed) {
+			t.Errorf("Expected ErrClosed, got %v", err)
+		}
+	})
+	t.Run("Writes aren't sent again once the server may have them", func(t *testing.T) {
+		addr, received := droppingNode(t, 1)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		_, err := c.Set(ctx, "key", []byte("value"), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The connection is reused, and goes away after the server reads this.
+		_, err = c.Set(ctx, "key", []byte("value"), time.Minute)
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		if received.Load() != 2 {
+			t.Errorf("Expected 2 requests, got %d", received.Load())
+		}
+	})
+
+	t.Run("Reads are sent again on a fresh connection", func(t *testing.T) {
+		addr, received := droppingNode(t, 1)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		_, err := c.Get(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.Get(ctx, "key")
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		if received.Load() != 3 {
+			t.Errorf("Expected 3 requests, got %d", received.Load())
+		}
+	})
+
+	t.Run("Pipeline doesn't send writes again", func(t *testing.T) {
+		addr, received := droppingNode(t, 1)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		msgs := []protocol.Message{}
+		for _, input := range []string{"incr a 60", "incr b 60", "incr c 60"} {
+			msg, err := client.ToMessage(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+		}
+
+		_, err := c.Pipeline(ctx, msgs)
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		if received.Load() != 2 {
+			t.Errorf("Expected 2 requests, got %d", received.Load())
+		}
+	})
+
+	t.Run("Pipeline", func(t *testing.T) {
+		addr, listener := countingNode(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		msgs := []protocol.Message{}
+		for i := 0; i < 100; i++ {
+			msg, err := client.ToMessage(fmt.Sprintf("set key-%d 60 value-%d", i, i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+		}
+
+		for i := 0; i < 100; i++ {
+			msg, err := client.ToMessage(fmt.Sprintf("get key-%d", i))
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+		}
+
+		responses, err := c.Pipeline(ctx, msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(responses) != len(msgs) {
+			t.Fatalf("Expected %d responses, got %d", len(msgs), len(responses))
+		}
+
+		for i, response := range responses[100:] {
+			expected := fmt.Sprintf("value-%d", i)
+			actual := string(response.Value)
+			if actual != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, actual)
+			}
+		}
+
+		accepted := listener.accepted.Load()
+		if accepted != 1 {
+			t.Errorf("Expected 1 connection, got %d", accepted)
+		}
+	})
+
+	t.Run("Pipeline continues past a failed request", func(t *testing.T) {
+		addr, listener := countingNode(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		msgs := []protocol.Message{}
+		for _, input := range []string{"set a 60 1", "get missing", "set b 60 2", "get b"} {
+			msg, err := client.ToMessage(input)
+			if err != nil {
+				t.Fatal(err)
+			}
+			msgs = append(msgs, msg)
+		}
+
+		responses, err := c.Pipeline(ctx, msgs)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []string{"Set 'a'.", "GET: Value doesn't exist.", "Set 'b'.", "GET: 2"}
+		for i, response := range responses {
+			actual := client.Describe(msgs[i], response)
+			if !strings.HasPrefix(actual, expected[i]) {
+				t.Errorf("Expected '%s', got '%s'", expected[i], actual)
+			}
+		}
+
+		accepted := listener.accepted.Load()
+		if accepted != 1 {
+			t.Errorf("Expected 1 connection, got %d", accepted)
+		}
+	})
+
+	t.Run("MGet and MSet", func(t *testing.T) {
+		addr, listener := countingNode(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		results, err := c.MSet(ctx, []client.Item{
+			{Key: "a", Value: []byte("1"), TTL: time.Minute},
+			{Key: "b", Value: []byte("2"), TTL: time.Hour},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for i, result := range results {
+			if result.Err != nil {
+				t.Errorf("Expected result %d to succeed, got '%s'", i, result.Err)
+			}
+		}
+
+		results, err = c.MGet(ctx, []string{"a", "missing", "b"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(results) != 3 {
+			t.Fatalf("Expected 3 results, got %d", len(results))
+		}
+
+		if string(results[0].Value) != "1" || string(results[2].Value) != "2" {
+			t.Errorf("Expected '1' and '2', got '%s' and '%s'", results[0].Value, results[2].Value)
+		}
+
+		if time.Until(results[2].Expires) < 59*time.Minute {
+			t.Errorf("Expected 'b' to expire in an hour, got %s", results[2].Expires)
+		}
+
+		if !errors.Is(results[1].Err, client.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got '%v'", results[1].Err)
+		}
+
+		accepted := listener.accepted.Load()
+		if accepted != 1 {
+			t.Errorf("Expected 1 connection, got %d", accepted)
+		}
+	})
+
+	t.Run("Incr", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		var wg sync.WaitGroup
+		for range 10 {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for range 10 {
+					_, err := c.Incr(ctx, "counter", 2, time.Minute)
+					if err != nil {
+						t.Error(err)
+					}
+				}
+			}()
+		}
+		wg.Wait()
+
+		n, err := c.Incr(ctx, "counter", -200, time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 0 {
+			t.Errorf("Expected 0, got %d", n)
+		}
+
+		c.Set(ctx, "key", []byte("value"), time.Minute)
+		_, err = c.Incr(ctx, "key", 1, time.Minute)
+		if !errors.Is(err, client.ErrNotInteger) {
+			t.Errorf("Expected ErrNotInteger, got '%v'", err)
+		}
+	})
+
+	t.Run("CompareAndSet", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		c.Set(ctx, "key", []byte("first"), time.Minute)
+		_, cas, err := c.GetCAS(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Someone else gets there first.
+		c.Set(ctx, "key", []byte("theirs"), time.Minute)
+
+		_, err = c.CompareAndSet(ctx, "key", []byte("mine"), time.Minute, cas)
+		if !errors.Is(err, client.ErrChanged) {
+			t.Fatalf("Expected ErrChanged, got '%v'", err)
+		}
+
+		value, cas, err := c.GetCAS(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.CompareAndSet(ctx, "key", append(value, "+mine"...), time.Minute, cas)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		value, err = c.Get(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "theirs+mine" {
+			t.Errorf("Expected 'theirs+mine', got '%s'", value)
+		}
+	})
+
+	t.Run("Expire and Persist", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		c.Set(ctx, "key", []byte("value"), time.Minute)
+
+		expires, err := c.Expire(ctx, "key", time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if time.Until(expires) <= 58*time.Minute {
+			t.Errorf("Expected expiry in an hour, got %s", expires)
+		}
+
+		ttl, err := c.TTL(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl <= 58*time.Minute || ttl > time.Hour {
+			t.Errorf("Expected TTL of about an hour, got %s", ttl)
+		}
+
+		err = c.Persist(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ttl, err = c.TTL(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if ttl != client.NO_EXPIRY {
+			t.Errorf("Expected no expiry, got %s", ttl)
+		}
+
+		err = c.Persist(ctx, "missing")
+		if !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("Expected ErrNotFound, got %v", err)
+		}
+	})
+
+	t.Run("TTL under a second", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		_, err := c.Set(ctx, "key", []byte("value"), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, cas, err := c.GetCAS(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = c.CompareAndSet(ctx, "key", []byte("changed"), time.Millisecond*200, cas)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		results, err := c.MSet(ctx, []client.Item{{Key: "batched", Value: []byte("value"), TTL: time.Millisecond * 200}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if results[0].Err != nil {
+			t.Fatal(results[0].Err)
+		}
+
+		for _, key := range []string{"key", "batched"} {
+			ttl, err := c.TTL(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ttl <= 0 || ttl > time.Millisecond*200 {
+				t.Errorf("Expected under 200ms left for '%s', got %s", key, ttl)
+			}
+		}
+
+		time.Sleep(time.Millisecond * 250)
+		for _, key := range []string{"key", "batched"} {
+			_, err = c.Get(ctx, key)
+			if !errors.Is(err, client.ErrNotFound) && !errors.Is(err, client.ErrExpired) {
+				t.Errorf("Expected '%s' to have expired, got %v", key, err)
+			}
+		}
+	})
+
+	t.Run("Scan and delete", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		for i := range 25 {
+			c.Set(ctx, fmt.Sprintf("tmp:%d", i), []byte("value"), time.Minute)
+		}
+		c.Set(ctx, "kept", []byte("value"), time.Minute)
+
+		deleted := 0
+		scanner := c.Scan("tmp:*", 10)
+		for scanner.Next(ctx) {
+			err := c.Delete(ctx, scanner.Key())
+			if err != nil {
+				t.Fatal(err)
+			}
+			deleted++
+		}
+
+		if scanner.Err() != nil {
+			t.Fatal(scanner.Err())
+		}
+
+		if deleted != 25 {
+			t.Errorf("Expected 25 deleted, got %d", deleted)
+		}
+
+		scanner = c.Scan("", 10)
+		for scanner.Next(ctx) {
+			if scanner.Key() != "kept" {
+				t.Errorf("Expected only 'kept' left, got '%s'", scanner.Key())
+			}
+		}
+	})
+
+	t.Run("Scan with a bad count", func(t *testing.T) {
+		addr, _ := node(t)
+		c := client.New(addr, client.Options{})
+		defer c.Close()
+
+		scanner := c.Scan("", 0)
+		if scanner.Next(ctx) {
+			t.Error("Expected no keys")
+		}
+
+		expected := errors.New("Count must be greater than 0.").Error()
+		if scanner.Err() == nil || scanner.Err().Error() != expected {
+			t.Errorf("Expected '%s', got '%v'", expected, scanner.Err())
+		}
+	})
+	t.Run("Namespace", func(t *testing.T) {
+		s, err := server.NewServer(server.Config{Namespaces: []server.Namespace{{Name: "sessions"}}})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+		go s.Serve(listener)
+		addr := listener.Addr().String()
+
+		sessions := client.New(addr, client.Options{Namespace: "sessions"})
+		defer sessions.Close()
+
+		_, err = sessions.Set(ctx, "key", []byte("value"), time.Minute)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		defaults := client.New(addr, client.Options{})
+		defer defaults.Close()
+
+		_, err = defaults.Get(ctx, "key")
+		if !errors.Is(err, client.ErrNotFound) {
+			t.Errorf("Expected '%s', got '%v'", client.ErrNotFound, err)
+		}
+
+		value, err := sessions.Get(ctx, "key")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "value" {
+			t.Errorf("Expected 'value', got '%s'", value)
+		}
+
+		_, err = sessions.Do(ctx, protocol.Message{Cmd: protocol.Select, Key: server.DEFAULT_NAMESPACE})
+		if err == nil {
+			t.Error("Expected SELECT to be rejected")
+		}
+
+		missing := client.New(addr, client.Options{Namespace: "missing"})
+		defer missing.Close()
+
+		_, err = missing.Get(ctx, "key")
+		expected := "Unknown namespace: missing"
+		if err == nil || err.Error() != expected {
+			t.Errorf("Expected '%s', got '%v'", expected, err)
+		}
+	})
+}
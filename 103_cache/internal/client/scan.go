@@ -0,0 +1,97 @@
+package client
+
+import (
+	"context"
+
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+)
+
+// Scanner pages through the keys matching a pattern with SCAN, fetching the
+// next page as it runs out:
+//
+//	scanner := client.Scan("session:*", 100)
+//	for scanner.Next(ctx) {
+//		client.Delete(ctx, scanner.Key())
+//	}
+//	err := scanner.Err()
+//
+// Keys there for the whole scan are seen exactly once, so deleting as it goes
+// is fine. Keys added or removed part way might not be seen.
+type Scanner struct {
+	do    func(context.Context, protocol.Message) (protocol.Response, error)
+	match string
+	count int
+
+	cursor string
+	keys   []string // Left in the current page
+	key    string
+	done   bool
+	err    error
+}
+
+func newScanner(do func(context.Context, protocol.Message) (protocol.Response, error), match string, count int) *Scanner {
+	return &Scanner{do: do, match: match, count: count}
+}
+
+// Scan iterates over the keys matching the glob pattern, count at a time. See
+// Scanner.
+func (client *Client) Scan(match string, count int) *Scanner {
+	return newScanner(client.do, match, count)
+}
+
+// Scan iterates over the keys matching the glob pattern on every node, count
+// at a time. See Scanner.
+func (cluster *Cluster) Scan(match string, count int) *Scanner {
+	do := func(ctx context.Context, msg protocol.Message) (protocol.Response, error) {
+		response, err := cluster.Do(ctx, msg)
+		if err != nil {
+			return protocol.Response{}, err
+		}
+		return response, responseError(response)
+	}
+	return newScanner(do, match, count)
+}
+
+// Next moves on to the next key, returning false once there are none left or
+// something went wrong.
+func (scanner *Scanner) Next(ctx context.Context) bool {
+	for len(scanner.keys) == 0 {
+		if scanner.done || scanner.err != nil {
+			return false
+		}
+		scanner.err = scanner.fetch(ctx)
+	}
+
+	scanner.key, scanner.keys = scanner.keys[0], scanner.keys[1:]
+	return true
+}
+
+func (scanner *Scanner) fetch(ctx context.Context) error {
+	msg, err := protocol.NewScan(scanner.cursor, scanner.match, scanner.count, c{})
+	if err != nil {
+		return err
+	}
+
+	response, err := scanner.do(ctx, msg)
+	if err != nil {
+		return err
+	}
+
+	keys, next, err := response.Page()
+	if err != nil {
+		return err
+	}
+
+	scanner.keys, scanner.cursor, scanner.done = keys, next, next == ""
+	return nil
+}
+
+// Key is the key Next moved on to.
+func (scanner *Scanner) Key() string {
+	return scanner.key
+}
+
+// Err is what stopped the scan early, nil if it got through every key.
+func (scanner *Scanner) Err() error {
+	return scanner.err
+}
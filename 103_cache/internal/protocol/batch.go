@@ -0,0 +1,350 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// MGET data:     Count (4B) | { KeyLen (4B) | Key (x) } ...
+// MSET data:     Count (4B) | { TTL (8B) | KeyLen (4B) | ValueLen (4B) | Key (x) | Value (x) } ...
+// Results value: Count (4B) | { Status (1B) | Code (1B) | Expires (8B) | Length (4B) | Value (x) } ...
+//
+// Like the header, each entry's TTL is in milliseconds from when the message
+// was sent and results expire as a Unix timestamp in milliseconds. Older
+// versions send both as a Unix timestamp in whole seconds. Until it's sent, an
+// MSET keeps when each entry expires in Unix milliseconds.
+const BATCH_ENTRY_HEADER_SIZE = 16
+const BATCH_RESULT_HEADER_SIZE = 14
+
+// Entry is one key to store with MSET.
+type Entry struct {
+	Key     string
+	Value   []byte
+	Expires time.Time
+}
+
+// NewEntry is an entry which expires after the TTL, at least a millisecond.
+func NewEntry(key string, value []byte, ttl time.Duration, c Clock) (Entry, error) {
+	if ttl < time.Millisecond {
+		return Entry{}, errors.New("TTL must be at least 1ms.")
+	}
+	return Entry{Key: key, Value: value, Expires: c.Now().Add(ttl)}, nil
+}
+
+// Whether the command carries many keys in its data rather than one in the
+// header.
+func (c Command) batch() bool {
+	return c == MGet || c == MSet
+}
+
+func NewMGet(keys []string, c Clock) (Message, error) {
+	if len(keys) == 0 {
+		return Message{}, errors.New("No keys provided.")
+	}
+
+	data := binary.BigEndian.AppendUint32([]byte{}, uint32(len(keys)))
+	for _, key := range keys {
+		if key == "" {
+			return Message{}, errors.New("No key provided.")
+		}
+
+		data = binary.BigEndian.AppendUint32(data, uint32(len(key)))
+		data = append(data, key...)
+	}
+	return Message{Cmd: MGet, Data: data}, nil
+}
+
+func NewMSet(entries []Entry, c Clock) (Message, error) {
+	if len(entries) == 0 {
+		return Message{}, errors.New("No entries provided.")
+	}
+
+	data := binary.BigEndian.AppendUint32([]byte{}, uint32(len(entries)))
+	for _, entry := range entries {
+		err := validateEntry(entry, c)
+		if err != nil {
+			return Message{}, err
+		}
+
+		data = binary.BigEndian.AppendUint64(data, uint64(entry.Expires.UnixMilli()))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(entry.Key)))
+		data = binary.BigEndian.AppendUint32(data, uint32(len(entry.Value)))
+		data = append(data, entry.Key...)
+		data = append(data, entry.Value...)
+	}
+	return Message{Cmd: MSet, Data: data}, nil
+}
+
+func validateEntry(entry Entry, c Clock) error {
+	if entry.Key == "" {
+		return errors.New("No key provided.")
+	}
+
+	if len(entry.Value) == 0 {
+		return errors.New(fmt.Sprintf("No data provided for %s.", MSet))
+	}
+
+	if entry.Expires.Compare(c.Now()) < 0 {
+		return errors.New("Expires in the past.")
+	}
+	return nil
+}
+
+// Rewrites the expiry of every item in a batch, which is at the offset in each
+// item's header and followed by the lengths of what's in the item.
+func mapExpiries(data []byte, headerSize int, offset int, f func(int64) (int64, error)) ([]byte, error) {
+	count, _, err := batchCount(data)
+	if err != nil {
+		return nil, err
+	}
+
+	mapped := append([]byte{}, data...)
+	item := mapped[4:]
+	for range count {
+		if len(item) < headerSize {
+			return nil, errors.New("Batch is truncated.")
+		}
+
+		expires, err := f(int64(binary.BigEndian.Uint64(item[offset : offset+8])))
+		if err != nil {
+			return nil, err
+		}
+		binary.BigEndian.PutUint64(item[offset:offset+8], uint64(expires))
+
+		size := headerSize
+		for i := offset + 8; i < headerSize; i += 4 {
+			size += int(binary.BigEndian.Uint32(item[i : i+4]))
+		}
+
+		if len(item) < size {
+			return nil, errors.New("Batch is truncated.")
+		}
+		item = item[size:]
+	}
+	return mapped, nil
+}
+
+// MSET data as it's sent, with a TTL for each entry.
+func encodeEntries(data []byte, clock Clock) ([]byte, error) {
+	return mapExpiries(data, BATCH_ENTRY_HEADER_SIZE, 0, func(expiresMilli int64) (int64, error) {
+		if expiresMilli == 0 {
+			return 0, nil
+		}
+
+		ttl := ttlMillis(time.UnixMilli(expiresMilli), clock)
+		if ttl < 0 {
+			return 0, errors.New("Negative TTL.")
+		}
+		return ttl, nil
+	})
+}
+
+// MSET data as it was sent in the version, with when each entry expires.
+func receiveEntries(data []byte, version byte, clock Clock) ([]byte, error) {
+	return mapExpiries(data, BATCH_ENTRY_HEADER_SIZE, 0, func(field int64) (int64, error) {
+		expires, err := expiresAt(field, version, clock)
+		if err != nil || expires.IsZero() {
+			return 0, err
+		}
+		return expires.UnixMilli(), nil
+	})
+}
+
+// Reads the count at the start of batch data, returning what's after it.
+func batchCount(data []byte) (int, []byte, error) {
+	if len(data) < 4 {
+		return 0, nil, errors.New("Batch is truncated.")
+	}
+	return int(binary.BigEndian.Uint32(data[:4])), data[4:], nil
+}
+
+func decodeKeys(data []byte) ([]string, error) {
+	count, data, err := batchCount(data)
+	if err != nil {
+		return nil, err
+	}
+
+	keys := []string{}
+	for range count {
+		if len(data) < 4 {
+			return nil, errors.New("Batch is truncated.")
+		}
+
+		lenKey := int(binary.BigEndian.Uint32(data[:4]))
+		if len(data) < 4+lenKey {
+			return nil, errors.New("Batch is truncated.")
+		}
+
+		keys = append(keys, string(data[4:4+lenKey]))
+		data = data[4+lenKey:]
+	}
+
+	if len(data) > 0 {
+		return nil, errors.New("Batch has trailing data.")
+	}
+	return keys, nil
+}
+
+func decodeEntries(data []byte) ([]Entry, error) {
+	count, data, err := batchCount(data)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []Entry{}
+	for range count {
+		if len(data) < BATCH_ENTRY_HEADER_SIZE {
+			return nil, errors.New("Batch is truncated.")
+		}
+
+		var expires time.Time
+		expiresMilli := int64(binary.BigEndian.Uint64(data[0:8]))
+		if expiresMilli != 0 {
+			expires = time.UnixMilli(expiresMilli).UTC()
+		}
+
+		lenKey := int(binary.BigEndian.Uint32(data[8:12]))
+		lenValue := int(binary.BigEndian.Uint32(data[12:16]))
+		data = data[BATCH_ENTRY_HEADER_SIZE:]
+
+		if len(data) < lenKey+lenValue {
+			return nil, errors.New("Batch is truncated.")
+		}
+
+		entries = append(entries, Entry{
+			Key:     string(data[:lenKey]),
+			Value:   data[lenKey : lenKey+lenValue],
+			Expires: expires,
+		})
+		data = data[lenKey+lenValue:]
+	}
+
+	if len(data) > 0 {
+		return nil, errors.New("Batch has trailing data.")
+	}
+	return entries, nil
+}
+
+// Keys returns the keys of an MGET.
+func (m Message) Keys() ([]string, error) {
+	if m.Cmd != MGet {
+		return nil, errors.New(fmt.Sprintf("No keys in %s.", m.Cmd))
+	}
+	return decodeKeys(m.Data)
+}
+
+// Entries returns what to store for an MSET.
+func (m Message) Entries() ([]Entry, error) {
+	if m.Cmd != MSet {
+		return nil, errors.New(fmt.Sprintf("No entries in %s.", m.Cmd))
+	}
+	return decodeEntries(m.Data)
+}
+
+func validateBatch(cmd Command, data []byte, clock Clock) error {
+	if len(data) == 0 {
+		return errors.New(fmt.Sprintf("Data not passed to %s.", cmd))
+	}
+
+	if cmd == MGet {
+		keys, err := decodeKeys(data)
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if key == "" {
+				return errors.New("No key provided.")
+			}
+		}
+		return nil
+	}
+
+	entries, err := decodeEntries(data)
+	if err != nil {
+		return err
+	}
+
+	for _, entry := range entries {
+		err := validateEntry(entry, clock)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// BatchResponse packs the response to each key of an MGET or MSET into one.
+func BatchResponse(results []Response) Response {
+	value := binary.BigEndian.AppendUint32([]byte{}, uint32(len(results)))
+	for _, result := range results {
+		var expiresMilli int64
+		if !result.Expires.IsZero() {
+			expiresMilli = result.Expires.UnixMilli()
+		}
+
+		value = append(value, byte(result.Status), byte(result.Code))
+		value = binary.BigEndian.AppendUint64(value, uint64(expiresMilli))
+		value = binary.BigEndian.AppendUint32(value, uint32(len(result.Value)))
+		value = append(value, result.Value...)
+	}
+
+	response := Success(value, time.Time{})
+	response.batch = true
+	return response
+}
+
+// Results with when they expire in whole seconds, for older versions.
+func resultsInSeconds(value []byte) ([]byte, error) {
+	return mapExpiries(value, BATCH_RESULT_HEADER_SIZE, 2, func(expiresMilli int64) (int64, error) {
+		if expiresMilli == 0 {
+			return 0, nil
+		}
+		return time.UnixMilli(expiresMilli).Unix(), nil
+	})
+}
+
+// Results unpacks the response to each key of an MGET or MSET, in the order
+// they were sent.
+func (r Response) Results() ([]Response, error) {
+	count, data, err := batchCount(r.Value)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []Response{}
+	for range count {
+		if len(data) < BATCH_RESULT_HEADER_SIZE {
+			return nil, errors.New("Batch is truncated.")
+		}
+
+		status, err := parseStatus(data[0])
+		if err != nil {
+			return nil, err
+		}
+
+		code := ErrorCode(data[1])
+
+		var expires time.Time
+		expiresMilli := int64(binary.BigEndian.Uint64(data[2:10]))
+		if expiresMilli != 0 {
+			expires = time.UnixMilli(expiresMilli).UTC()
+		}
+
+		lenValue := int(binary.BigEndian.Uint32(data[10:14]))
+		data = data[BATCH_RESULT_HEADER_SIZE:]
+		if len(data) < lenValue {
+			return nil, errors.New("Batch is truncated.")
+		}
+
+		results = append(results, Response{status, code, expires, data[:lenValue], r.ID, 0, false})
+		data = data[lenValue:]
+	}
+
+	if len(data) > 0 {
+		return nil, errors.New("Batch has trailing data.")
+	}
+	return results, nil
+}
@@ -0,0 +1,323 @@
+package protocol_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+)
+
+func TestBatch(t *testing.T) {
+	c := clock{}
+
+	t.Run("MGET survives encoding", func(t *testing.T) {
+		expected := []string{"a", "bb", "ccc"}
+		msg, err := protocol.NewMGet(expected, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.Cmd != protocol.MGet {
+			t.Errorf("Commands don't match: expected '%d', got '%d'", protocol.MGet, decoded.Cmd)
+		}
+
+		actual, err := decoded.Keys()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual) != len(expected) {
+			t.Fatalf("Expected %v, got %v", expected, actual)
+		}
+
+		for i := range expected {
+			if actual[i] != expected[i] {
+				t.Errorf("Expected '%s', got '%s'", expected[i], actual[i])
+			}
+		}
+	})
+
+	t.Run("MSET survives encoding", func(t *testing.T) {
+		expires := c.Now().Add(time.Minute)
+		expected := []protocol.Entry{
+			{Key: "a", Value: []byte("1"), Expires: expires},
+			{Key: "b", Value: []byte("two words"), Expires: expires.Add(time.Hour)},
+		}
+
+		msg, err := protocol.NewMSet(expected, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := decoded.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual) != len(expected) {
+			t.Fatalf("Expected %d entries, got %d", len(expected), len(actual))
+		}
+
+		for i := range expected {
+			if actual[i].Key != expected[i].Key || string(actual[i].Value) != string(expected[i].Value) {
+				t.Errorf("Expected '%s' = '%s', got '%s' = '%s'", expected[i].Key, expected[i].Value, actual[i].Key, actual[i].Value)
+			}
+
+			if !actual[i].Expires.Equal(expected[i].Expires) {
+				t.Errorf("Expected expires '%s', got '%s'", expected[i].Expires, actual[i].Expires)
+			}
+		}
+	})
+
+	t.Run("Invalid batches", func(t *testing.T) {
+		tests := map[string]struct {
+			build    func() (protocol.Message, error)
+			expected string
+		}{
+			"No keys": {
+				func() (protocol.Message, error) { return protocol.NewMGet([]string{}, c) },
+				"No keys provided.",
+			},
+			"Empty key": {
+				func() (protocol.Message, error) { return protocol.NewMGet([]string{"a", ""}, c) },
+				"No key provided.",
+			},
+			"No entries": {
+				func() (protocol.Message, error) { return protocol.NewMSet([]protocol.Entry{}, c) },
+				"No entries provided.",
+			},
+			"Entry without data": {
+				func() (protocol.Message, error) {
+					return protocol.NewMSet([]protocol.Entry{{Key: "a", Expires: c.Now()}}, c)
+				},
+				"No data provided for MSET.",
+			},
+			"Entry in the past": {
+				func() (protocol.Message, error) {
+					return protocol.NewMSet([]protocol.Entry{{Key: "a", Value: []byte("1"), Expires: c.Now().Add(-time.Minute)}}, c)
+				},
+				"Expires in the past.",
+			},
+			"Through NewMessage": {
+				func() (protocol.Message, error) { return protocol.NewMessage(protocol.MGet, "", []byte{}, 0, c) },
+				"Use NewMGet or NewMSet for MGET.",
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				_, err := tc.build()
+				if err == nil {
+					t.Fatal("Expected err, got nil.")
+				}
+
+				expected := errors.New(tc.expected).Error()
+				actual := err.Error()
+				if actual != expected {
+					t.Errorf("Expected '%s', got '%s'", expected, actual)
+				}
+			})
+		}
+	})
+
+	t.Run("Truncated batch", func(t *testing.T) {
+		msg, err := protocol.NewMGet([]string{"a", "b"}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.Data = msg.Data[:len(msg.Data)-1]
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = protocol.UnmarshalBinary(data, c)
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Batch is truncated.").Error()
+		actual := err.Error()
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Results survive encoding", func(t *testing.T) {
+		expires := time.Unix(1700000000, 0).UTC()
+		expected := []protocol.Response{
+			protocol.Success([]byte("value"), expires),
+			protocol.Failure(protocol.NotFound, errors.New("Value doesn't exist.")),
+		}
+
+		data, err := protocol.BatchResponse(expected).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := response.Results()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual) != 2 {
+			t.Fatalf("Expected 2 results, got %d", len(actual))
+		}
+
+		if actual[0].Status != protocol.OK || string(actual[0].Value) != "value" || !actual[0].Expires.Equal(expires) {
+			t.Errorf("Expected OK 'value' expiring %s, got %s '%s' expiring %s", expires, actual[0].Status, actual[0].Value, actual[0].Expires)
+		}
+
+		if actual[1].Status != protocol.Failed || actual[1].Code != protocol.NotFound {
+			t.Errorf("Expected FAILED %s, got %s %s", protocol.NotFound, actual[1].Status, actual[1].Code)
+		}
+	})
+
+	t.Run("Keyless messages have no TTL", func(t *testing.T) {
+		mget, err := protocol.NewMGet([]string{"a"}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		mset, err := protocol.NewMSet([]protocol.Entry{{Key: "a", Value: []byte("1"), Expires: c.Now().Add(time.Minute)}}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		scan, err := protocol.NewScan("", "", 10, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, msg := range []protocol.Message{mget, mset, scan} {
+			data, err := msg.MarshalBinary(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ttl := binary.BigEndian.Uint64(data[6:14])
+			if ttl != 0 {
+				t.Errorf("Expected no TTL for %s, got %d", msg.Cmd, ttl)
+			}
+		}
+	})
+
+	t.Run("MSET TTLs to the millisecond, relative to now", func(t *testing.T) {
+		expires := c.Now().Add(time.Millisecond * 500)
+		msg, err := protocol.NewMSet([]protocol.Entry{{Key: "a", Value: []byte("1"), Expires: expires}}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ttl := binary.BigEndian.Uint64(data[protocol.HEADER_SIZE+4 : protocol.HEADER_SIZE+12])
+		if ttl == 0 || ttl > 500 {
+			t.Errorf("Expected a TTL of up to 500ms, got %d", ttl)
+		}
+
+		decoded, err := protocol.UnmarshalBinary(data, aheadClock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := decoded.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := aheadClock{}.Now().Add(time.Millisecond * 500)
+		if entries[0].Expires.After(expected) || entries[0].Expires.Before(expected.Add(-time.Second)) {
+			t.Errorf("Expected expires around '%s', got '%s'", expected, entries[0].Expires)
+		}
+	})
+
+	t.Run("Version 4 MSET in whole seconds", func(t *testing.T) {
+		expires := c.Now().Add(time.Minute).Truncate(time.Second)
+		msg, err := protocol.NewMSet([]protocol.Entry{{Key: "a", Value: []byte("1"), Expires: expires}}, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data[0] = protocol.VERSION_4
+		binary.BigEndian.PutUint64(data[protocol.HEADER_SIZE+4:protocol.HEADER_SIZE+12], uint64(expires.Unix()))
+
+		decoded, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries, err := decoded.Entries()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !entries[0].Expires.Equal(expires) {
+			t.Errorf("Expected expires '%s', got '%s'", expires, entries[0].Expires)
+		}
+	})
+
+	t.Run("Results have milliseconds, version 4 whole seconds", func(t *testing.T) {
+		expires := time.UnixMilli(1700000000500).UTC()
+		tests := map[byte]time.Time{
+			protocol.VERSION:   expires,
+			protocol.VERSION_4: expires.Truncate(time.Second),
+		}
+
+		for version, expected := range tests {
+			data, err := protocol.BatchResponse([]protocol.Response{protocol.Success([]byte("value"), expires)}).MarshalVersion(version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := protocol.UnmarshalResponse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Read back as it was sent, rather than as Results would.
+			actual := int64(binary.BigEndian.Uint64(response.Value[6:14]))
+			if version == protocol.VERSION && actual != expected.UnixMilli() {
+				t.Errorf("Expected version %d to expire at %d, got %d", version, expected.UnixMilli(), actual)
+			} else if version == protocol.VERSION_4 && actual != expected.Unix() {
+				t.Errorf("Expected version %d to expire at %d, got %d", version, expected.Unix(), actual)
+			}
+		}
+	})
+}
@@ -4,12 +4,71 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
+	"strconv"
 	"time"
 )
 
-// Version (1B) | Command (1B) | Expires (8B) | KeyLen (2B) | Length (2B) | Key (x) | Data (x)
-const VERSION byte = 1
-const HEADER_SIZE = 14
+// Version (1B) | Command (1B) | ID (4B) | TTL (8B) | CAS (8B) | KeyLen (4B) | Length (4B) | Key (x) | Data (x)
+//
+// TTL is in milliseconds from when the message was sent, 0 for no expiry.
+const VERSION byte = 5
+const HEADER_SIZE = 30
+
+// Older versions are still accepted from older clients. They all send when the
+// message expires as a Unix timestamp in whole seconds, where 5 sends the TTL.
+// Version 4 is otherwise the same as 5, the rest have no CAS so can't use
+// CompareAndSet. Versions 1 and 2 have 2 byte lengths, so keys and data are
+// under 64 KB, and version 1 has no ID.
+const VERSION_1 byte = 1
+const V1_HEADER_SIZE = 14
+const VERSION_2 byte = 2
+const V2_HEADER_SIZE = 18
+const VERSION_3 byte = 3
+const V3_HEADER_SIZE = 22
+const VERSION_4 byte = 4
+const V4_HEADER_SIZE = 30
+
+// Size of the message header for the version, 0 if it isn't supported.
+func headerSize(version byte) int {
+	switch version {
+	case VERSION_1:
+		return V1_HEADER_SIZE
+	case VERSION_2:
+		return V2_HEADER_SIZE
+	case VERSION_3:
+		return V3_HEADER_SIZE
+	case VERSION_4:
+		return V4_HEADER_SIZE
+	case VERSION:
+		return HEADER_SIZE
+	default:
+		return 0
+	}
+}
+
+// Key and data lengths, always at the end of the header.
+func lengths(header []byte) (lenKey int, lenData int) {
+	size := len(header)
+	if header[0] == VERSION_1 || header[0] == VERSION_2 {
+		lenKey = int(binary.BigEndian.Uint16(header[size-4 : size-2]))
+		lenData = int(binary.BigEndian.Uint16(header[size-2 : size]))
+		return lenKey, lenData
+	}
+
+	lenKey = int(binary.BigEndian.Uint32(header[size-8 : size-4]))
+	lenData = int(binary.BigEndian.Uint32(header[size-4 : size]))
+	return lenKey, lenData
+}
+
+// PeekID returns the ID from a message header without checking the rest of it,
+// 0 for version 1.
+func PeekID(header []byte) uint32 {
+	if len(header) < V2_HEADER_SIZE || header[0] == VERSION_1 || headerSize(header[0]) == 0 {
+		return 0
+	}
+	return binary.BigEndian.Uint32(header[2:6])
+}
 
 type Command byte
 
@@ -17,129 +76,528 @@ const (
 	_ Command = iota
 	Get
 	Set
+	Delete
+	Flush
+	SetNX
+	SetXX
+	Usage
+	Sync // Sent by a follower, turns the connection into a replication stream
+	MGet
+	MSet
+	Incr
+	Decr
+	IncrBy
+	CompareAndSet
+	TTL
+	Expire
+	Persist // Removes the key's expiry, sent with 0 in the expires field
+	Scan
+	Stats
+	Select // Switches the connection to the namespace named by the key
 )
 
+func (c Command) String() string {
+	switch c {
+	case Get:
+		return "GET"
+	case Set:
+		return "SET"
+	case Delete:
+		return "DELETE"
+	case Flush:
+		return "FLUSH"
+	case SetNX:
+		return "SETNX"
+	case SetXX:
+		return "SETXX"
+	case Usage:
+		return "USAGE"
+	case Sync:
+		return "SYNC"
+	case MGet:
+		return "MGET"
+	case MSet:
+		return "MSET"
+	case Incr:
+		return "INCR"
+	case Decr:
+		return "DECR"
+	case IncrBy:
+		return "INCRBY"
+	case CompareAndSet:
+		return "CAS"
+	case TTL:
+		return "TTL"
+	case Expire:
+		return "EXPIRE"
+	case Persist:
+		return "PERSIST"
+	case Scan:
+		return "SCAN"
+	case Stats:
+		return "STATS"
+	case Select:
+		return "SELECT"
+	default:
+		return fmt.Sprintf("Command(%d)", byte(c))
+	}
+}
+
+// Whether the command stores data in the cache, i.e. one of the SET variants.
+func (c Command) stores() bool {
+	return c == Set || c == SetNX || c == SetXX || c == CompareAndSet
+}
+
+// Whether the command adds to a counter, which is created with the TTL if it's
+// missing.
+func (c Command) counts() bool {
+	return c == Incr || c == Decr || c == IncrBy
+}
+
+// Whether the command takes a TTL.
+func (c Command) expires() bool {
+	return c.stores() || c.counts() || c == Expire
+}
+
+// Whether the command has data: the value to store, or how much to add for
+// INCRBY.
+func (c Command) hasData() bool {
+	return c.stores() || c == IncrBy
+}
+
+// Whether the command has no key in the header, as it acts on the whole cache
+// or carries its keys in the data.
+func (c Command) keyless() bool {
+	return c == Flush || c == Usage || c == Sync || c == Scan || c == Stats || c.batch()
+}
+
+// Writes is whether the command changes the cache. Followers leave these to
+// the leader, and clients don't send them again unless they know the server
+// never got them.
+func (c Command) Writes() bool {
+	switch c {
+	case Set, SetNX, SetXX, Delete, Flush, MSet, Incr, Decr, IncrBy, CompareAndSet, Expire, Persist:
+		return true
+	default:
+		return false
+	}
+}
+
 type Message struct {
 	Cmd     Command
 	Key     string
 	Data    []byte
 	Expires time.Time
+	ID      uint32 // Sent back in the response, so replies can be matched to pipelined requests
+	CAS     uint64 // Version the key must still have for CompareAndSet to store it
 }
 
+// NewMessage takes the TTL in whole seconds, see NewMessageTTL for anything
+// shorter.
 func NewMessage(cmd Command, key string, data []byte, ttl int, c Clock) (Message, error) {
-	if key == "" {
-		return Message{}, errors.New("No key provided.")
+	err := checkCommand(cmd)
+	if err != nil {
+		return Message{}, err
+	}
+	return newMessage(cmd, key, data, ttl, c)
+}
+
+// NewMessageTTL is NewMessage with the TTL to the millisecond.
+func NewMessageTTL(cmd Command, key string, data []byte, ttl time.Duration, c Clock) (Message, error) {
+	err := checkCommand(cmd)
+	if err != nil {
+		return Message{}, err
+	}
+	return newMessageTTL(cmd, key, data, ttl, c)
+}
+
+// Commands with their own constructor.
+func checkCommand(cmd Command) error {
+	if cmd.batch() {
+		return errors.New(fmt.Sprintf("Use NewMGet or NewMSet for %s.", cmd))
+	}
+
+	if cmd == CompareAndSet {
+		return errors.New(fmt.Sprintf("Use NewCompareAndSet for %s.", cmd))
 	}
 
-	if cmd == Set && len(data) == 0 {
-		return Message{}, errors.New("No data provided for SET.")
+	if cmd == Scan {
+		return errors.New(fmt.Sprintf("Use NewScan for %s.", cmd))
 	}
+	return nil
+}
 
-	if cmd == Get && len(data) > 0 {
-		return Message{}, errors.New("Data provided for GET.")
+// NewCompareAndSet stores the data only if the key's version is still cas, as
+// sent back when it was read.
+func NewCompareAndSet(key string, data []byte, ttl int, cas uint64, c Clock) (Message, error) {
+	if cas == 0 {
+		return Message{}, errors.New("No CAS provided.")
+	}
+
+	msg, err := newMessage(CompareAndSet, key, data, ttl, c)
+	if err != nil {
+		return Message{}, err
+	}
+	msg.CAS = cas
+	return msg, nil
+}
+
+// NewCompareAndSetTTL is NewCompareAndSet with the TTL to the millisecond.
+func NewCompareAndSetTTL(key string, data []byte, ttl time.Duration, cas uint64, c Clock) (Message, error) {
+	if cas == 0 {
+		return Message{}, errors.New("No CAS provided.")
+	}
+
+	msg, err := newMessageTTL(CompareAndSet, key, data, ttl, c)
+	if err != nil {
+		return Message{}, err
+	}
+	msg.CAS = cas
+	return msg, nil
+}
+
+func newMessage(cmd Command, key string, data []byte, ttl int, c Clock) (Message, error) {
+	err := validateMessage(cmd, key, data)
+	if err != nil {
+		return Message{}, err
 	}
 
-	if cmd == Get && ttl != 0 {
-		return Message{}, errors.New("TTL must be 0 for GET.")
+	if !cmd.expires() && ttl != 0 {
+		return Message{}, errors.New(fmt.Sprintf("TTL must be 0 for %s.", cmd))
 	}
 
-	if cmd == Set && ttl <= 2 {
+	if cmd.expires() && ttl <= 2 {
 		return Message{}, errors.New("TTL must be greater than 2.")
 	}
+	return buildMessage(cmd, key, data, time.Second*time.Duration(ttl), c), nil
+}
+
+func newMessageTTL(cmd Command, key string, data []byte, ttl time.Duration, c Clock) (Message, error) {
+	err := validateMessage(cmd, key, data)
+	if err != nil {
+		return Message{}, err
+	}
 
-	expires := c.Now().Add(time.Second * time.Duration(ttl))
-	return Message{cmd, key, data, expires}, nil
+	if !cmd.expires() && ttl != 0 {
+		return Message{}, errors.New(fmt.Sprintf("TTL must be 0 for %s.", cmd))
+	}
+
+	if cmd.expires() && ttl < time.Millisecond {
+		return Message{}, errors.New("TTL must be at least 1ms.")
+	}
+	return buildMessage(cmd, key, data, ttl, c), nil
 }
 
-func (m Message) MarshalBinary(clock Clock) ([]byte, error) {
-	expiresUnix := m.Expires.Unix()
-	nowUnix := clock.Now().Unix()
+func validateMessage(cmd Command, key string, data []byte) error {
+	if key == "" && !cmd.keyless() {
+		return errors.New("No key provided.")
+	}
+
+	if cmd.keyless() && key != "" {
+		return errors.New(fmt.Sprintf("Key provided for %s.", cmd))
+	}
+
+	if cmd.hasData() && len(data) == 0 {
+		return errors.New(fmt.Sprintf("No data provided for %s.", cmd))
+	}
+
+	if !cmd.hasData() && len(data) > 0 {
+		return errors.New(fmt.Sprintf("Data provided for %s.", cmd))
+	}
+
+	if cmd == IncrBy {
+		_, err := parseAmount(data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
 
-	if m.Cmd == Set {
-		if expiresUnix < nowUnix {
+func buildMessage(cmd Command, key string, data []byte, ttl time.Duration, c Clock) Message {
+	var expires time.Time
+	if cmd.expires() {
+		expires = c.Now().Add(ttl)
+	}
+	return Message{cmd, key, data, expires, 0, 0}
+}
+
+func (m Message) MarshalBinary(clock Clock) ([]byte, error) {
+	// The SET variants can send no expiry, like when replicating a persisted key.
+	if m.Cmd.expires() && !(m.Cmd.stores() && m.Expires.IsZero()) {
+		if m.Expires.Before(clock.Now()) {
 			return []byte{}, errors.New("Negative TTL.")
 		}
 	}
 
+	if uint64(len(m.Key)) > 1<<32-1 {
+		return []byte{}, errors.New("Key too large.")
+	}
+
+	body := m.Data
+	if m.Cmd == MSet {
+		var err error
+		body, err = encodeEntries(m.Data, clock)
+		if err != nil {
+			return []byte{}, err
+		}
+	}
+
+	if uint64(len(body)) > 1<<32-1 {
+		return []byte{}, errors.New("Data too large.")
+	}
+
+	id := make([]byte, 4)
+	binary.BigEndian.PutUint32(id, m.ID)
+
 	expires := make([]byte, 8)
-	binary.BigEndian.PutUint64(expires, uint64(expiresUnix))
+	binary.BigEndian.PutUint64(expires, uint64(ttlMillis(m.Expires, clock)))
+
+	cas := make([]byte, 8)
+	binary.BigEndian.PutUint64(cas, m.CAS)
 
 	keyBytes := []byte(m.Key)
-	keyLen := make([]byte, 2)
-	binary.BigEndian.PutUint16(keyLen, uint16(len(keyBytes)))
+	keyLen := make([]byte, 4)
+	binary.BigEndian.PutUint32(keyLen, uint32(len(keyBytes)))
 
-	dataLen := make([]byte, 2)
-	binary.BigEndian.PutUint16(dataLen, uint16(len(m.Data)))
+	dataLen := make([]byte, 4)
+	binary.BigEndian.PutUint32(dataLen, uint32(len(body)))
 
 	data := []byte{}
 	data = append(data, VERSION)
 	data = append(data, byte(m.Cmd))
+	data = append(data, id...)
 	data = append(data, expires...)
+	data = append(data, cas...)
 	data = append(data, keyLen...)
 	data = append(data, dataLen...)
 	data = append(data, keyBytes...)
-	data = append(data, m.Data...)
+	data = append(data, body...)
 	return data, nil
 }
 
+// Sent instead of when the message expires, so it doesn't matter if the clocks
+// on either end disagree. Any part of a millisecond rounds up to a whole one,
+// so nothing under a millisecond goes out as 0, which is no expiry.
+func ttlMillis(expires time.Time, clock Clock) int64 {
+	if expires.IsZero() {
+		return 0
+	}
+
+	ttl := expires.Sub(clock.Now())
+	if ttl <= 0 {
+		return min(ttl.Milliseconds(), -1)
+	}
+	return int64((ttl + time.Millisecond - 1) / time.Millisecond)
+}
+
+// Longest TTL that fits in a time.Duration, around 292 years.
+const maxTTLMillis = math.MaxInt64 / int64(time.Millisecond)
+
+// When the expires field says the message expires. 0 is no expiry, for
+// commands without a TTL, PERSIST and the SET variants. Older versions send
+// when it expires in whole seconds rather than the TTL.
+func expiresAt(field int64, version byte, clock Clock) (time.Time, error) {
+	if field == 0 {
+		return time.Time{}, nil
+	}
+
+	if version != VERSION {
+		return time.Unix(field, 0).UTC(), nil
+	}
+
+	if field > maxTTLMillis || field < -maxTTLMillis {
+		return time.Time{}, errors.New("TTL too large.")
+	}
+	return clock.Now().Add(time.Duration(field) * time.Millisecond), nil
+}
+
 func parseCommand(cmd byte) (Command, error) {
 	switch cmd {
 	case 1:
 		return Get, nil
 	case 2:
 		return Set, nil
+	case 3:
+		return Delete, nil
+	case 4:
+		return Flush, nil
+	case 5:
+		return SetNX, nil
+	case 6:
+		return SetXX, nil
+	case 7:
+		return Usage, nil
+	case 8:
+		return Sync, nil
+	case 9:
+		return MGet, nil
+	case 10:
+		return MSet, nil
+	case 11:
+		return Incr, nil
+	case 12:
+		return Decr, nil
+	case 13:
+		return IncrBy, nil
+	case 14:
+		return CompareAndSet, nil
+	case 15:
+		return TTL, nil
+	case 16:
+		return Expire, nil
+	case 17:
+		return Persist, nil
+	case 18:
+		return Scan, nil
+	case 19:
+		return Stats, nil
+	case 20:
+		return Select, nil
 	default:
 		return Get, errors.New(fmt.Sprintf("Invalid command: %d", int(cmd)))
 	}
 }
 
-func validateData(cmd Command, data []byte, expires time.Time, clock Clock) error {
+func validateData(cmd Command, key string, data []byte, expires time.Time, clock Clock) error {
 	switch cmd {
-	case Get:
+	case Get, Delete, TTL, Persist, Select:
 		if len(data) > 0 {
-			return errors.New("Data passed to GET.")
+			return errors.New(fmt.Sprintf("Data passed to %s.", cmd))
 		}
-	case Set:
-		if len(data) == 0 {
-			return errors.New("Data not passed to SET.")
+	case Flush, Usage, Sync, Stats:
+		if key != "" {
+			return errors.New(fmt.Sprintf("Key passed to %s.", cmd))
+		}
+
+		if len(data) > 0 {
+			return errors.New(fmt.Sprintf("Data passed to %s.", cmd))
+		}
+	case MGet, MSet:
+		if key != "" {
+			return errors.New(fmt.Sprintf("Key passed to %s.", cmd))
+		}
+
+		return validateBatch(cmd, data, clock)
+	case Scan:
+		if key != "" {
+			return errors.New(fmt.Sprintf("Key passed to %s.", cmd))
+		}
+
+		_, err := decodeScan(data)
+		return err
+	case Incr, Decr:
+		if len(data) > 0 {
+			return errors.New(fmt.Sprintf("Data passed to %s.", cmd))
 		}
 
 		if expires.Compare(clock.Now()) < 0 {
 			return errors.New("Expires in the past.")
 		}
+	case IncrBy:
+		_, err := parseAmount(data)
+		if err != nil {
+			return err
+		}
+
+		if expires.Compare(clock.Now()) < 0 {
+			return errors.New("Expires in the past.")
+		}
+	case Expire:
+		if len(data) > 0 {
+			return errors.New(fmt.Sprintf("Data passed to %s.", cmd))
+		}
+
+		if expires.Compare(clock.Now()) < 0 {
+			return errors.New("Expires in the past.")
+		}
+	case Set, SetNX, SetXX, CompareAndSet:
+		if len(data) == 0 {
+			return errors.New(fmt.Sprintf("Data not passed to %s.", cmd))
+		}
+
+		if !expires.IsZero() && expires.Compare(clock.Now()) < 0 {
+			return errors.New("Expires in the past.")
+		}
 	}
 	return nil
 }
 
+// INCRBY carries how much to add as decimal text, like the counter is stored.
+func parseAmount(data []byte) (int64, error) {
+	amount, err := strconv.ParseInt(string(data), 10, 64)
+	if err != nil {
+		return 0, errors.New(fmt.Sprintf("Amount for %s must be an integer.", IncrBy))
+	}
+	return amount, nil
+}
+
+// Amount returns how much a counter command adds.
+func (m Message) Amount() (int64, error) {
+	switch m.Cmd {
+	case Incr:
+		return 1, nil
+	case Decr:
+		return -1, nil
+	case IncrBy:
+		return parseAmount(m.Data)
+	default:
+		return 0, errors.New(fmt.Sprintf("No amount in %s.", m.Cmd))
+	}
+}
+
 type Clock interface {
 	Now() time.Time
 }
 
 func UnmarshalBinary(data []byte, clock Clock) (Message, error) {
-	if len(data) < HEADER_SIZE {
+	if len(data) < 1 {
 		return Message{}, errors.New("Not enough data.")
 	}
 
 	version := data[0]
-	if version != VERSION {
+	size := headerSize(version)
+	if size == 0 {
 		return Message{}, errors.New("Version mismatch.")
 	}
 
-	keyLenBytes := data[10:12]
-	lenKey := int(binary.BigEndian.Uint16(keyLenBytes))
-	if lenKey == 0 {
+	if len(data) < size {
+		return Message{}, errors.New("Not enough data.")
+	}
+
+	cmd, err := parseCommand(data[1])
+	if err != nil {
+		return Message{}, err
+	}
+
+	// Only the ID was added in version 2, everything after it is shifted along.
+	var id uint32
+	header := data[2:size]
+	if version != VERSION_1 {
+		id = binary.BigEndian.Uint32(header[:4])
+		header = header[4:]
+	}
+
+	var cas uint64
+	if version == VERSION_4 || version == VERSION {
+		cas = binary.BigEndian.Uint64(header[8:16])
+	}
+
+	lenKey, lenData := lengths(data[:size])
+	if lenKey == 0 && !cmd.keyless() {
 		return Message{}, errors.New("No key provided.")
 	}
 
-	lenDataBytes := data[12:14]
-	lenData := int(binary.BigEndian.Uint16(lenDataBytes))
+	if len(data) < size+lenKey {
+		return Message{}, errors.New("Not enough data.")
+	}
 
-	keyBytes := data[14 : 14+lenKey]
+	keyBytes := data[size : size+lenKey]
 	key := string(keyBytes)
 
 	var toCache []byte
 	if lenData > 0 {
-		toCache = data[14+lenKey:]
+		toCache = data[size+lenKey:]
 		if lenData != len(toCache) {
 			return Message{}, errors.New("Length of data doesn't match header.")
 		}
@@ -147,21 +605,28 @@ func UnmarshalBinary(data []byte, clock Clock) (Message, error) {
 		toCache = []byte{}
 	}
 
-	cmd, err := parseCommand(data[1])
+	expires, err := expiresAt(int64(binary.BigEndian.Uint64(header[0:8])), version, clock)
 	if err != nil {
 		return Message{}, err
 	}
 
-	expiresBytes := data[2:10]
-	expiresUnix := int64(binary.BigEndian.Uint64(expiresBytes))
-	expires := time.Unix(expiresUnix, 0).UTC()
+	if cmd == MSet {
+		toCache, err = receiveEntries(toCache, version, clock)
+		if err != nil {
+			return Message{}, err
+		}
+	}
 
-	err = validateData(cmd, toCache, expires, clock)
+	err = validateData(cmd, key, toCache, expires, clock)
 	if err != nil {
 		return Message{}, err
 	}
 
+	if cmd == CompareAndSet && cas == 0 {
+		return Message{}, errors.New("No CAS provided.")
+	}
+
 	return Message{
-		cmd, key, toCache, expires,
+		cmd, key, toCache, expires, id, cas,
 	}, nil
 }
@@ -1,8 +1,11 @@
 package protocol_test
 
 import (
+	"bytes"
 	"encoding/binary"
 	"errors"
+	"fmt"
+	"math"
 	"testing"
 	"time"
 
@@ -49,7 +52,7 @@ func TestUnmarshalValidation(t *testing.T) {
 		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
 
 		data := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Get),
 		}
 		data = append(data, expires...)
@@ -114,7 +117,7 @@ func TestUnmarshalValidation(t *testing.T) {
 		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
 
 		data := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Get),
 		}
 		data = append(data, expires...)
@@ -147,7 +150,7 @@ func TestUnmarshalValidation(t *testing.T) {
 		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
 
 		data := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(0),
 		}
 		data = append(data, ttl...)
@@ -181,7 +184,7 @@ func TestUnmarshalGet(t *testing.T) {
 		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
 
 		data := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Get),
 		}
 		data = append(data, expires...)
@@ -195,7 +198,7 @@ func TestUnmarshalGet(t *testing.T) {
 		}
 
 		expected := protocol.Message{
-			protocol.Get, "key", []byte{}, clock{}.Now(),
+			protocol.Get, "key", []byte{}, clock{}.Now(), 0, 0,
 		}
 
 		if actual.Cmd != expected.Cmd {
@@ -221,7 +224,7 @@ func TestUnmarshalGet(t *testing.T) {
 		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
 
 		data := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Get),
 		}
 		data = append(data, expires...)
@@ -260,7 +263,7 @@ func TestUnmarshalSet(t *testing.T) {
 		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
 
 		data := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Set),
 		}
 		data = append(data, expires...)
@@ -275,7 +278,7 @@ func TestUnmarshalSet(t *testing.T) {
 		}
 
 		expected := protocol.Message{
-			protocol.Set, "key", []byte{69}, expiresAt,
+			protocol.Set, "key", []byte{69}, expiresAt, 0, 0,
 		}
 
 		if actual.Cmd != expected.Cmd {
@@ -303,7 +306,7 @@ func TestUnmarshalSet(t *testing.T) {
 		binary.BigEndian.PutUint16(size, 0)
 
 		data := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Set),
 		}
 		data = append(data, expires...)
@@ -337,7 +340,7 @@ func TestUnmarshalSet(t *testing.T) {
 		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
 
 		data := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Set),
 		}
 		data = append(data, expires...)
@@ -372,7 +375,7 @@ func TestUnmarshalSet(t *testing.T) {
 		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
 
 		data := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Set),
 		}
 		data = append(data, expires...)
@@ -397,22 +400,23 @@ func TestUnmarshalSet(t *testing.T) {
 
 func TestMarshal(t *testing.T) {
 	t.Run("Marshals", func(t *testing.T) {
-		expires := clock{}.Now().Add(time.Second * 10)
 		message := protocol.Message{
-			protocol.Set, "key", []byte{69}, clock{}.Now().Add(time.Second * 10),
+			protocol.Set, "key", []byte{69}, clock{}.Now().Add(time.Second * 10), 420, 0,
 		}
 
 		keyBytes := []byte("key")
 
 		expiresBytes := make([]byte, 8)
-		binary.BigEndian.PutUint64(expiresBytes, uint64(expires.Unix()))
+		binary.BigEndian.PutUint64(expiresBytes, 10000)
 
 		expected := []byte{}
 		expected = append(expected, protocol.VERSION)
 		expected = append(expected, byte(protocol.Set))
+		expected = append(expected, []byte{0, 0, 1, 164}...)
 		expected = append(expected, expiresBytes...)
-		expected = append(expected, []byte{0, byte(len(keyBytes))}...)
-		expected = append(expected, []byte{0, 1}...)
+		expected = append(expected, make([]byte, 8)...)
+		expected = append(expected, []byte{0, 0, 0, byte(len(keyBytes))}...)
+		expected = append(expected, []byte{0, 0, 0, 1}...)
 		expected = append(expected, keyBytes...)
 		expected = append(expected, byte(69))
 
@@ -434,15 +438,11 @@ func TestMarshal(t *testing.T) {
 		}
 	})
 
-	t.Run("Expires marshalled correctly", func(t *testing.T) {
-		expectedDt := clock{}.Now().Add(time.Second * 10)
-		expectedUnix := int(expectedDt.Unix())
-
-		expectedBytes := make([]byte, 8)
-		binary.BigEndian.PutUint64(expectedBytes, uint64(expectedUnix))
+	t.Run("TTL marshalled correctly", func(t *testing.T) {
+		expectedDt := clock{}.Now().Add(time.Millisecond * 1500)
 
 		message := protocol.Message{
-			protocol.Set, "key", []byte{69}, expectedDt,
+			protocol.Set, "key", []byte{69}, expectedDt, 0, 0,
 		}
 
 		data, err := message.MarshalBinary(clock{})
@@ -450,14 +450,14 @@ func TestMarshal(t *testing.T) {
 			t.Fatal(err)
 		}
 
-		expiresBytes := data[2:10]
-		actualUnix := int(binary.BigEndian.Uint64(expiresBytes))
+		ttlBytes := data[6:14]
+		actualTTL := int(binary.BigEndian.Uint64(ttlBytes))
 
-		if actualUnix != expectedUnix {
-			t.Errorf("Expected %d, got %d", expectedUnix, actualUnix)
+		if actualTTL != 1500 {
+			t.Errorf("Expected %d, got %d", 1500, actualTTL)
 		}
 
-		actual := time.Unix(int64(actualUnix), 0).UTC()
+		actual := clock{}.Now().Add(time.Millisecond * time.Duration(actualTTL))
 		if expectedDt.Compare(actual) != 0 {
 			t.Errorf("Expected '%s', got '%s'", expectedDt, actual)
 		}
@@ -465,7 +465,7 @@ func TestMarshal(t *testing.T) {
 
 	t.Run("Negative TTL", func(t *testing.T) {
 		message := protocol.Message{
-			protocol.Set, "key", []byte{69}, clock{}.Now().Add(time.Second * 10 * -1),
+			protocol.Set, "key", []byte{69}, clock{}.Now().Add(time.Second * 10 * -1), 0, 0,
 		}
 
 		_, err := message.MarshalBinary(clock{})
@@ -553,6 +553,62 @@ func TestNewMessage(t *testing.T) {
 		}
 	})
 
+	t.Run("Key provided for FLUSH", func(t *testing.T) {
+		_, err := protocol.NewMessage(protocol.Flush, "key", []byte{}, 0, clock{})
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Key provided for FLUSH.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("No data for SETNX", func(t *testing.T) {
+		_, err := protocol.NewMessage(protocol.SetNX, "key", []byte{}, 10, clock{})
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("No data provided for SETNX.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("TTL less than 3 for SETXX", func(t *testing.T) {
+		_, err := protocol.NewMessage(protocol.SetXX, "key", []byte{1}, 0, clock{})
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("TTL must be greater than 2.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("TTL provided for DELETE", func(t *testing.T) {
+		_, err := protocol.NewMessage(protocol.Delete, "key", []byte{}, 10, clock{})
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("TTL must be 0 for DELETE.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
 	t.Run("New message", func(t *testing.T) {
 		msg, err := protocol.NewMessage(protocol.Set, "key", []byte{1}, 10, clock{})
 		if err != nil {
@@ -646,3 +702,1032 @@ func TestEncodeDecode(t *testing.T) {
 		}
 	})
 }
+
+func TestUnmarshalConditionalSet(t *testing.T) {
+	for _, cmd := range []protocol.Command{protocol.SetNX, protocol.SetXX} {
+		t.Run(fmt.Sprintf("Unmarshal %s", cmd), func(t *testing.T) {
+			expiresAt := clock{}.Now().Add(time.Second * time.Duration(69)).UTC()
+
+			expires := make([]byte, 8)
+			binary.BigEndian.PutUint64(expires, uint64(expiresAt.Unix()))
+
+			size := make([]byte, 2)
+			binary.BigEndian.PutUint16(size, 1)
+
+			key := []byte("key")
+			keyLen := make([]byte, 2)
+			binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
+
+			data := []byte{
+				protocol.VERSION_1,
+				byte(cmd),
+			}
+			data = append(data, expires...)
+			data = append(data, keyLen...)
+			data = append(data, size...)
+			data = append(data, key...)
+			data = append(data, byte(69))
+
+			actual, err := protocol.UnmarshalBinary(data, clock{})
+			if err != nil {
+				t.Fatalf("Expected nil, got '%s'", err.Error())
+			}
+
+			if actual.Cmd != cmd {
+				t.Errorf("Commands don't match: expected '%d', got '%d'", cmd, actual.Cmd)
+			}
+
+			if !actual.Expires.Equal(expiresAt) {
+				t.Errorf("Expriry date doesn't match: expected '%s', got '%s'", expiresAt, actual.Expires)
+			}
+		})
+
+		t.Run(fmt.Sprintf("Data not passed to %s", cmd), func(t *testing.T) {
+			expires := make([]byte, 8)
+			binary.BigEndian.PutUint64(expires, uint64(clock{}.Now().Add(time.Minute).Unix()))
+
+			size := make([]byte, 2)
+
+			key := []byte("key")
+			keyLen := make([]byte, 2)
+			binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
+
+			data := []byte{
+				protocol.VERSION_1,
+				byte(cmd),
+			}
+			data = append(data, expires...)
+			data = append(data, keyLen...)
+			data = append(data, size...)
+			data = append(data, key...)
+
+			_, err := protocol.UnmarshalBinary(data, clock{})
+			if err == nil {
+				t.Fatal("Expected err, got nil.")
+			}
+
+			expected := fmt.Sprintf("Data not passed to %s.", cmd)
+			actual := err.Error()
+
+			if actual != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, actual)
+			}
+		})
+	}
+}
+
+func TestUnmarshalDelete(t *testing.T) {
+	t.Run("Unmarshal DELETE", func(t *testing.T) {
+		expires := make([]byte, 8)
+
+		size := make([]byte, 2)
+
+		key := []byte("key")
+		keyLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
+
+		data := []byte{
+			protocol.VERSION_1,
+			byte(protocol.Delete),
+		}
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+		data = append(data, key...)
+
+		actual, err := protocol.UnmarshalBinary(data, clock{})
+		if err != nil {
+			t.Fatalf("Expected nil, got '%s'", err.Error())
+		}
+
+		if actual.Cmd != protocol.Delete {
+			t.Errorf("Commands don't match: expected '%d', got '%d'", protocol.Delete, actual.Cmd)
+		}
+
+		if actual.Key != "key" {
+			t.Errorf("Expected key '%s', got '%s'", "key", actual.Key)
+		}
+	})
+
+	t.Run("Data passed to DELETE", func(t *testing.T) {
+		expires := make([]byte, 8)
+
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, 1)
+
+		key := []byte("key")
+		keyLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
+
+		data := []byte{
+			protocol.VERSION_1,
+			byte(protocol.Delete),
+		}
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+		data = append(data, key...)
+		data = append(data, byte(69))
+
+		_, err := protocol.UnmarshalBinary(data, clock{})
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Data passed to DELETE.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("No key for DELETE", func(t *testing.T) {
+		expires := make([]byte, 8)
+
+		size := make([]byte, 2)
+		keyLen := make([]byte, 2)
+
+		data := []byte{
+			protocol.VERSION_1,
+			byte(protocol.Delete),
+		}
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+
+		_, err := protocol.UnmarshalBinary(data, clock{})
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("No key provided.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+}
+
+func TestUnmarshalFlush(t *testing.T) {
+	t.Run("Unmarshal FLUSH", func(t *testing.T) {
+		expires := make([]byte, 8)
+
+		size := make([]byte, 2)
+		keyLen := make([]byte, 2)
+
+		data := []byte{
+			protocol.VERSION_1,
+			byte(protocol.Flush),
+		}
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+
+		actual, err := protocol.UnmarshalBinary(data, clock{})
+		if err != nil {
+			t.Fatalf("Expected nil, got '%s'", err.Error())
+		}
+
+		if actual.Cmd != protocol.Flush {
+			t.Errorf("Commands don't match: expected '%d', got '%d'", protocol.Flush, actual.Cmd)
+		}
+
+		if actual.Key != "" {
+			t.Errorf("Expected no key, got '%s'", actual.Key)
+		}
+	})
+
+	t.Run("Unmarshal USAGE", func(t *testing.T) {
+		expires := make([]byte, 8)
+
+		size := make([]byte, 2)
+		keyLen := make([]byte, 2)
+
+		data := []byte{
+			protocol.VERSION_1,
+			byte(protocol.Usage),
+		}
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+
+		actual, err := protocol.UnmarshalBinary(data, clock{})
+		if err != nil {
+			t.Fatalf("Expected nil, got '%s'", err.Error())
+		}
+
+		if actual.Cmd != protocol.Usage {
+			t.Errorf("Commands don't match: expected '%d', got '%d'", protocol.Usage, actual.Cmd)
+		}
+	})
+
+	t.Run("Unmarshal SYNC", func(t *testing.T) {
+		expires := make([]byte, 8)
+
+		size := make([]byte, 2)
+		keyLen := make([]byte, 2)
+
+		data := []byte{
+			protocol.VERSION_1,
+			byte(protocol.Sync),
+		}
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+
+		actual, err := protocol.UnmarshalBinary(data, clock{})
+		if err != nil {
+			t.Fatalf("Expected nil, got '%s'", err.Error())
+		}
+
+		if actual.Cmd != protocol.Sync {
+			t.Errorf("Commands don't match: expected '%d', got '%d'", protocol.Sync, actual.Cmd)
+		}
+	})
+
+	t.Run("Key passed to FLUSH", func(t *testing.T) {
+		expires := make([]byte, 8)
+
+		size := make([]byte, 2)
+
+		key := []byte("key")
+		keyLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
+
+		data := []byte{
+			protocol.VERSION_1,
+			byte(protocol.Flush),
+		}
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+		data = append(data, key...)
+
+		_, err := protocol.UnmarshalBinary(data, clock{})
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Key passed to FLUSH.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+}
+
+func TestVersions(t *testing.T) {
+	t.Run("ID survives encoding", func(t *testing.T) {
+		c := clock{}
+		expected, err := protocol.NewMessage(protocol.Get, "key", []byte{}, 0, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected.ID = 1<<32 - 1
+
+		encoded, err := expected.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if encoded[0] != protocol.VERSION {
+			t.Errorf("Expected version %d, got %d", protocol.VERSION, encoded[0])
+		}
+
+		actual, err := protocol.UnmarshalBinary(encoded, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.ID != expected.ID {
+			t.Errorf("Expected ID %d, got %d", expected.ID, actual.ID)
+		}
+	})
+
+	t.Run("Version 1 has no ID", func(t *testing.T) {
+		expires := make([]byte, 8)
+
+		size := make([]byte, 2)
+
+		key := []byte("key")
+		keyLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
+
+		data := []byte{
+			protocol.VERSION_1,
+			byte(protocol.Get),
+		}
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+		data = append(data, key...)
+
+		actual, err := protocol.UnmarshalBinary(data, clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Key != "key" {
+			t.Errorf("Expected key 'key', got '%s'", actual.Key)
+		}
+
+		if actual.ID != 0 {
+			t.Errorf("Expected ID 0, got %d", actual.ID)
+		}
+	})
+
+	t.Run("Key longer than message", func(t *testing.T) {
+		expires := make([]byte, 8)
+		id := make([]byte, 4)
+
+		size := make([]byte, 2)
+
+		keyLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(keyLen, 100)
+
+		data := []byte{
+			protocol.VERSION_2,
+			byte(protocol.Get),
+		}
+		data = append(data, id...)
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+		data = append(data, []byte("key")...)
+
+		_, err := protocol.UnmarshalBinary(data, clock{})
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Not enough data.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Version 1 response has no ID", func(t *testing.T) {
+		response := protocol.Success([]byte("value"), time.Time{})
+		response.ID = 42
+
+		data, err := response.MarshalVersion(protocol.VERSION_1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(data) != protocol.V1_RESPONSE_HEADER_SIZE+len("value") {
+			t.Errorf("Expected %d bytes, got %d", protocol.V1_RESPONSE_HEADER_SIZE+len("value"), len(data))
+		}
+
+		actual, err := protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.ID != 0 || string(actual.Value) != "value" {
+			t.Errorf("Expected ID 0 and 'value', got %d and '%s'", actual.ID, actual.Value)
+		}
+
+		data, err = response.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err = protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.ID != 42 {
+			t.Errorf("Expected ID 42, got %d", actual.ID)
+		}
+	})
+
+	t.Run("Version 2 is still accepted", func(t *testing.T) {
+		expires := make([]byte, 8)
+		binary.BigEndian.PutUint64(expires, uint64(clock{}.Now().Add(time.Minute).Unix()))
+
+		id := make([]byte, 4)
+		binary.BigEndian.PutUint32(id, 7)
+
+		key := []byte("key")
+		keyLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
+
+		value := []byte("value")
+		size := make([]byte, 2)
+		binary.BigEndian.PutUint16(size, uint16(len(value)))
+
+		data := []byte{
+			protocol.VERSION_2,
+			byte(protocol.Set),
+		}
+		data = append(data, id...)
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+		data = append(data, key...)
+		data = append(data, value...)
+
+		actual, err := protocol.UnmarshalBinary(data, clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.ID != 7 || actual.Key != "key" || string(actual.Data) != "value" {
+			t.Errorf("Expected ID 7 and 'key' = 'value', got %d and '%s' = '%s'", actual.ID, actual.Key, actual.Data)
+		}
+
+		if protocol.PeekID(data) != 7 {
+			t.Errorf("Expected to peek ID 7, got %d", protocol.PeekID(data))
+		}
+	})
+
+	t.Run("Data over 64 KB survives encoding", func(t *testing.T) {
+		c := clock{}
+		value := make([]byte, 70*1024)
+		for i := range value {
+			value[i] = byte(i)
+		}
+
+		expected, err := protocol.NewMessage(protocol.Set, "key", value, 60, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded, err := expected.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := protocol.UnmarshalBinary(encoded, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(actual.Data, value) {
+			t.Errorf("Expected %d bytes back, got %d", len(value), len(actual.Data))
+		}
+	})
+}
+
+func TestCounters(t *testing.T) {
+	c := clock{}
+
+	t.Run("Amount survives encoding", func(t *testing.T) {
+		tests := map[protocol.Command]struct {
+			data     string
+			expected int64
+		}{
+			protocol.Incr:   {"", 1},
+			protocol.Decr:   {"", -1},
+			protocol.IncrBy: {"-42", -42},
+		}
+
+		for cmd, tc := range tests {
+			msg, err := protocol.NewMessage(cmd, "counter", []byte(tc.data), 60, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			encoded, err := msg.MarshalBinary(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			decoded, err := protocol.UnmarshalBinary(encoded, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			actual, err := decoded.Amount()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual != tc.expected {
+				t.Errorf("Expected %s to add %d, got %d", cmd, tc.expected, actual)
+			}
+		}
+	})
+
+	t.Run("Invalid counters", func(t *testing.T) {
+		tests := map[string]struct {
+			cmd      protocol.Command
+			data     string
+			ttl      int
+			expected string
+		}{
+			"Amount not an integer": {protocol.IncrBy, "lots", 60, "Amount for INCRBY must be an integer."},
+			"No amount":             {protocol.IncrBy, "", 60, "No data provided for INCRBY."},
+			"Data for INCR":         {protocol.Incr, "1", 60, "Data provided for INCR."},
+			"No TTL":                {protocol.Decr, "", 0, "TTL must be greater than 2."},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				_, err := protocol.NewMessage(tc.cmd, "counter", []byte(tc.data), tc.ttl, c)
+				if err == nil {
+					t.Fatal("Expected err, got nil.")
+				}
+
+				expected := errors.New(tc.expected).Error()
+				actual := err.Error()
+				if actual != expected {
+					t.Errorf("Expected '%s', got '%s'", expected, actual)
+				}
+			})
+		}
+	})
+}
+
+func TestCompareAndSet(t *testing.T) {
+	c := clock{}
+
+	t.Run("CAS survives encoding", func(t *testing.T) {
+		expected, err := protocol.NewCompareAndSet("key", []byte("value"), 60, 1<<40+1, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		encoded, err := expected.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := protocol.UnmarshalBinary(encoded, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Cmd != protocol.CompareAndSet || actual.CAS != expected.CAS {
+			t.Errorf("Expected CAS %d, got %s %d", expected.CAS, actual.Cmd, actual.CAS)
+		}
+
+		response := protocol.Success([]byte("value"), time.Time{})
+		response.CAS = 1<<40 + 2
+
+		data, err := response.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.CAS != response.CAS {
+			t.Errorf("Expected CAS %d, got %d", response.CAS, decoded.CAS)
+		}
+	})
+
+	t.Run("Version 3 is still accepted", func(t *testing.T) {
+		expires := make([]byte, 8)
+		id := make([]byte, 4)
+		binary.BigEndian.PutUint32(id, 7)
+
+		key := []byte("key")
+		keyLen := make([]byte, 4)
+		binary.BigEndian.PutUint32(keyLen, uint32(len(key)))
+
+		data := []byte{
+			protocol.VERSION_3,
+			byte(protocol.Get),
+		}
+		data = append(data, id...)
+		data = append(data, expires...)
+		data = append(data, keyLen...)
+		data = append(data, make([]byte, 4)...)
+		data = append(data, key...)
+
+		actual, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.ID != 7 || actual.Key != "key" {
+			t.Errorf("Expected ID 7 and 'key', got %d and '%s'", actual.ID, actual.Key)
+		}
+
+		response := protocol.Success([]byte("value"), time.Time{})
+		response.CAS = 9
+
+		encoded, err := response.MarshalVersion(protocol.VERSION_3)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(encoded) != protocol.V2_RESPONSE_HEADER_SIZE+len("value") {
+			t.Errorf("Expected %d bytes, got %d", protocol.V2_RESPONSE_HEADER_SIZE+len("value"), len(encoded))
+		}
+
+		decoded, err := protocol.UnmarshalResponse(encoded)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if decoded.CAS != 0 || string(decoded.Value) != "value" {
+			t.Errorf("Expected no CAS and 'value', got %d and '%s'", decoded.CAS, decoded.Value)
+		}
+	})
+
+	t.Run("Invalid CAS", func(t *testing.T) {
+		tests := map[string]struct {
+			build    func() (protocol.Message, error)
+			expected string
+		}{
+			"Through NewMessage": {
+				func() (protocol.Message, error) {
+					return protocol.NewMessage(protocol.CompareAndSet, "key", []byte("value"), 60, c)
+				},
+				"Use NewCompareAndSet for CAS.",
+			},
+			"No CAS": {
+				func() (protocol.Message, error) { return protocol.NewCompareAndSet("key", []byte("value"), 60, 0, c) },
+				"No CAS provided.",
+			},
+			"No data": {
+				func() (protocol.Message, error) { return protocol.NewCompareAndSet("key", []byte{}, 60, 1, c) },
+				"No data provided for CAS.",
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				_, err := tc.build()
+				if err == nil {
+					t.Fatal("Expected err, got nil.")
+				}
+
+				expected := errors.New(tc.expected).Error()
+				actual := err.Error()
+				if actual != expected {
+					t.Errorf("Expected '%s', got '%s'", expected, actual)
+				}
+			})
+		}
+	})
+}
+
+func TestExpire(t *testing.T) {
+	c := clock{}
+
+	t.Run("No expiry survives encoding", func(t *testing.T) {
+		for _, cmd := range []protocol.Command{protocol.TTL, protocol.Persist} {
+			msg, err := protocol.NewMessage(cmd, "key", []byte{}, 0, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := msg.MarshalBinary(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			expires := binary.BigEndian.Uint64(data[6:14])
+			if expires != 0 {
+				t.Errorf("Expected 0 for no expiry, got %d", expires)
+			}
+
+			actual, err := protocol.UnmarshalBinary(data, c)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if actual.Cmd != cmd || !actual.Expires.IsZero() {
+				t.Errorf("Expected %s with no expiry, got %s expiring %s", cmd, actual.Cmd, actual.Expires)
+			}
+		}
+	})
+
+	t.Run("SET can be sent without an expiry", func(t *testing.T) {
+		msg := protocol.Message{Cmd: protocol.Set, Key: "key", Data: []byte("value")}
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !actual.Expires.IsZero() {
+			t.Errorf("Expected no expiry, got %s", actual.Expires)
+		}
+	})
+
+	t.Run("EXPIRE survives encoding", func(t *testing.T) {
+		msg, err := protocol.NewMessage(protocol.Expire, "key", []byte{}, 60, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := c.Now().Add(time.Minute)
+		if actual.Cmd != protocol.Expire || !actual.Expires.Equal(expected) {
+			t.Errorf("Expected EXPIRE at %s, got %s at %s", expected, actual.Cmd, actual.Expires)
+		}
+	})
+
+	t.Run("Invalid expiries", func(t *testing.T) {
+		tests := map[string]struct {
+			build    func() error
+			expected string
+		}{
+			"EXPIRE without a TTL": {
+				func() error {
+					_, err := protocol.NewMessage(protocol.Expire, "key", []byte{}, 0, c)
+					return err
+				},
+				"TTL must be greater than 2.",
+			},
+			"PERSIST with a TTL": {
+				func() error {
+					_, err := protocol.NewMessage(protocol.Persist, "key", []byte{}, 60, c)
+					return err
+				},
+				"TTL must be 0 for PERSIST.",
+			},
+			"EXPIRE without an expiry": {
+				func() error {
+					_, err := protocol.Message{Cmd: protocol.Expire, Key: "key"}.MarshalBinary(c)
+					return err
+				},
+				"Negative TTL.",
+			},
+			"TTL with data": {
+				func() error {
+					_, err := protocol.NewMessage(protocol.TTL, "key", []byte("data"), 0, c)
+					return err
+				},
+				"Data provided for TTL.",
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				err := tc.build()
+				if err == nil {
+					t.Fatal("Expected err, got nil.")
+				}
+
+				expected := errors.New(tc.expected).Error()
+				actual := err.Error()
+				if actual != expected {
+					t.Errorf("Expected '%s', got '%s'", expected, actual)
+				}
+			})
+		}
+	})
+}
+
+// A clock an hour ahead of clock, like a server that's drifted.
+type aheadClock struct{}
+
+func (c aheadClock) Now() time.Time {
+	return clock{}.Add(time.Hour)
+}
+
+func TestMillisecondTTL(t *testing.T) {
+	c := clock{}
+
+	t.Run("TTL under a second survives encoding", func(t *testing.T) {
+		msg, err := protocol.NewMessageTTL(protocol.Set, "key", []byte("value"), time.Millisecond*250, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := c.Add(time.Millisecond * 250)
+		if !actual.Expires.Equal(expected) {
+			t.Errorf("Expected expires '%s', got '%s'", expected, actual.Expires)
+		}
+	})
+
+	t.Run("Clocks don't have to agree", func(t *testing.T) {
+		msg, err := protocol.NewMessageTTL(protocol.Set, "key", []byte("value"), time.Second*5, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := protocol.UnmarshalBinary(data, aheadClock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := aheadClock{}.Now().Add(time.Second * 5)
+		if !actual.Expires.Equal(expected) {
+			t.Errorf("Expected expires '%s', got '%s'", expected, actual.Expires)
+		}
+	})
+
+	t.Run("Anything under a millisecond is rounded up", func(t *testing.T) {
+		msg := protocol.Message{Cmd: protocol.Set, Key: "key", Data: []byte("value"), Expires: c.Add(time.Microsecond)}
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ttl := binary.BigEndian.Uint64(data[6:14])
+		if ttl != 1 {
+			t.Errorf("Expected a TTL of 1, got %d", ttl)
+		}
+	})
+
+	t.Run("TTLs too long for a duration", func(t *testing.T) {
+		msg, err := protocol.NewMessageTTL(protocol.Set, "key", []byte("value"), time.Second, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, ttl := range []int64{1 << 53, math.MaxInt64, math.MinInt64 + 1} {
+			binary.BigEndian.PutUint64(data[6:14], uint64(ttl))
+
+			_, err = protocol.UnmarshalBinary(data, c)
+			expected := "TTL too large."
+			if err == nil || err.Error() != expected {
+				t.Errorf("Expected '%s' for %d, got '%v'", expected, ttl, err)
+			}
+		}
+	})
+
+	t.Run("Version 4 is still accepted", func(t *testing.T) {
+		expires := make([]byte, 8)
+		binary.BigEndian.PutUint64(expires, uint64(c.Add(time.Minute).Unix()))
+
+		cas := make([]byte, 8)
+		binary.BigEndian.PutUint64(cas, 42)
+
+		key := []byte("key")
+		keyLen := make([]byte, 4)
+		binary.BigEndian.PutUint32(keyLen, uint32(len(key)))
+
+		value := []byte("value")
+		size := make([]byte, 4)
+		binary.BigEndian.PutUint32(size, uint32(len(value)))
+
+		data := []byte{
+			protocol.VERSION_4,
+			byte(protocol.CompareAndSet),
+		}
+		data = append(data, make([]byte, 4)...)
+		data = append(data, expires...)
+		data = append(data, cas...)
+		data = append(data, keyLen...)
+		data = append(data, size...)
+		data = append(data, key...)
+		data = append(data, value...)
+
+		actual, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.CAS != 42 || !actual.Expires.Equal(c.Add(time.Minute)) {
+			t.Errorf("Expected CAS 42 expiring %s, got %d expiring %s", c.Add(time.Minute), actual.CAS, actual.Expires)
+		}
+	})
+
+	t.Run("Responses have milliseconds, version 4 whole seconds", func(t *testing.T) {
+		expires := c.Add(time.Millisecond * 1500)
+		tests := map[byte]time.Time{
+			protocol.VERSION:   expires,
+			protocol.VERSION_4: expires.Truncate(time.Second),
+		}
+
+		for version, expected := range tests {
+			data, err := protocol.Success([]byte{}, expires).MarshalVersion(version)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := protocol.UnmarshalResponse(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !response.Expires.Equal(expected) {
+				t.Errorf("Expected version %d to expire at '%s', got '%s'", version, expected, response.Expires)
+			}
+		}
+	})
+
+	t.Run("Invalid TTLs", func(t *testing.T) {
+		tests := map[string]struct {
+			cmd      protocol.Command
+			ttl      time.Duration
+			expected string
+		}{
+			"Under a millisecond": {protocol.Set, time.Microsecond * 500, "TTL must be at least 1ms."},
+			"TTL for GET":         {protocol.Get, time.Second, "TTL must be 0 for GET."},
+			"CAS":                 {protocol.CompareAndSet, time.Second, "Use NewCompareAndSet for CAS."},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				data := []byte{}
+				if tc.cmd != protocol.Get {
+					data = []byte("value")
+				}
+
+				_, err := protocol.NewMessageTTL(tc.cmd, "key", data, tc.ttl, c)
+				if err == nil {
+					t.Fatal("Expected err, got nil.")
+				}
+
+				expected := errors.New(tc.expected).Error()
+				actual := err.Error()
+				if actual != expected {
+					t.Errorf("Expected '%s', got '%s'", expected, actual)
+				}
+			})
+		}
+	})
+}
+
+func TestSelect(t *testing.T) {
+	c := clock{}
+
+	t.Run("Namespace survives encoding", func(t *testing.T) {
+		msg, err := protocol.NewMessage(protocol.Select, "sessions", []byte{}, 0, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Cmd != protocol.Select || actual.Key != "sessions" {
+			t.Errorf("Expected SELECT of 'sessions', got %s of '%s'", actual.Cmd, actual.Key)
+		}
+	})
+
+	t.Run("Invalid", func(t *testing.T) {
+		tests := map[string]struct {
+			key      string
+			data     []byte
+			ttl      int
+			expected string
+		}{
+			"No namespace": {"", []byte{}, 0, "No key provided."},
+			"With data":    {"sessions", []byte("data"), 0, "Data provided for SELECT."},
+			"With a TTL":   {"sessions", []byte{}, 60, "TTL must be 0 for SELECT."},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				_, err := protocol.NewMessage(protocol.Select, tc.key, tc.data, tc.ttl, c)
+				if err == nil {
+					t.Fatal("Expected err, got nil.")
+				}
+
+				actual := err.Error()
+				if actual != tc.expected {
+					t.Errorf("Expected '%s', got '%s'", tc.expected, actual)
+				}
+			})
+		}
+	})
+}
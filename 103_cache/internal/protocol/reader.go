@@ -1,15 +1,22 @@
 package protocol
 
 import (
-	"encoding/binary"
 	"errors"
 	"io"
 )
 
+// Returned by DataReader.Read for messages over its limit.
+var ErrTooLarge = errors.New("Message too large.")
+
 type DataReader struct {
 	stream  io.Reader
 	buf     []byte
 	scratch []byte
+	skip    int // Left of a message over the limit, dropped as it's read
+
+	// Messages bigger than this aren't buffered, Read returns ErrTooLarge with
+	// just the header and drops the rest. 0 == unlimited.
+	Limit int
 }
 
 func NewReader(r io.Reader) *DataReader {
@@ -20,59 +27,57 @@ func NewReader(r io.Reader) *DataReader {
 	}
 }
 
-func (r *DataReader) lenData() (int, error) {
-	if len(r.buf) < HEADER_SIZE {
-		return -1, errors.New("Not enough data read.")
-	}
-
-	dataLenBytes := r.buf[12:14]
-	return int(binary.BigEndian.Uint16(dataLenBytes)), nil
-}
-
-func (r *DataReader) lenKey() (int, error) {
-	if len(r.buf) < HEADER_SIZE {
+// Total size of the message at the front of the buffer.
+func (r *DataReader) lenTotal() (int, error) {
+	if len(r.buf) < 1 {
 		return -1, errors.New("Not enough data read.")
 	}
 
-	keyLenBytes := r.buf[10:12]
-	return int(binary.BigEndian.Uint16(keyLenBytes)), nil
-}
-
-func (r *DataReader) lenTotal() (int, error) {
-	lenKey, err := r.lenKey()
-	if err != nil {
-		return -1, err
+	size := headerSize(r.buf[0])
+	if size == 0 {
+		return -1, errors.New("Version mismatch.")
 	}
 
-	lenData, err := r.lenData()
-	if err != nil {
-		return -1, err
+	if len(r.buf) < size {
+		return -1, errors.New("Not enough data read.")
 	}
 
-	return HEADER_SIZE + lenData + lenKey, nil
+	lenKey, lenData := lengths(r.buf[:size])
+	return size + lenKey + lenData, nil
 }
 
-func (r *DataReader) complete() bool {
-	lenTotal, err := r.lenTotal()
-	if err != nil {
-		return false
-	}
-	return lenTotal == len(r.buf)
+// Drops what's buffered of a message over the limit.
+func (r *DataReader) drop() {
+	n := min(r.skip, len(r.buf))
+	r.buf = r.buf[n:]
+	r.skip -= n
 }
 
 func (r *DataReader) Read() (data []byte, err error) {
-	ptr := 0
 	for {
-		isComplete := r.complete()
-		if isComplete {
+		r.drop()
+
+		if r.skip == 0 && len(r.buf) > 0 {
+			// Can't tell where the message ends, so nothing after it can be read.
+			size := headerSize(r.buf[0])
+			if size == 0 {
+				return []byte{}, errors.New("Version mismatch.")
+			}
+
 			lenTotal, err := r.lenTotal()
-			if err != nil {
-				return []byte{}, err
+			if err == nil && r.Limit > 0 && lenTotal > r.Limit {
+				header := append([]byte{}, r.buf[:size]...)
+				r.skip = lenTotal
+				r.drop()
+				return header, ErrTooLarge
 			}
 
-			message := r.buf[:lenTotal]
-			r.buf = r.buf[lenTotal:]
-			return message, nil
+			// There may be more after the message.
+			if err == nil && len(r.buf) >= lenTotal {
+				message := r.buf[:lenTotal:lenTotal]
+				r.buf = r.buf[lenTotal:]
+				return message, nil
+			}
 		}
 
 		numRead, err := r.stream.Read(r.scratch)
@@ -80,9 +85,6 @@ func (r *DataReader) Read() (data []byte, err error) {
 			return []byte{}, err
 		}
 
-		toCopy := r.scratch[ptr : ptr+numRead]
-		r.buf = append(r.buf, toCopy...)
-
-		ptr += numRead
+		r.buf = append(r.buf, r.scratch[:numRead]...)
 	}
 }
@@ -1,8 +1,12 @@
 package protocol_test
 
 import (
+	"bytes"
 	"encoding/binary"
+	"errors"
+	"io"
 	"testing"
+	"time"
 
 	"github.com/todaatsushi/handrolled-cache/internal/protocol"
 )
@@ -34,7 +38,7 @@ func TestReader(t *testing.T) {
 		binary.BigEndian.PutUint16(dataLen, uint16(len(data)))
 
 		header := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Set),
 		}
 		header = append(header, expires...)
@@ -77,7 +81,7 @@ func TestReader(t *testing.T) {
 		dataLen := make([]byte, 2)
 
 		header := []byte{
-			protocol.VERSION,
+			protocol.VERSION_1,
 			byte(protocol.Get),
 		}
 		header = append(header, expires...)
@@ -108,3 +112,157 @@ func TestReader(t *testing.T) {
 		}
 	})
 }
+
+// Hands out data a few bytes at a time, like a slow connection.
+type chunkedStream struct {
+	data  []byte
+	chunk int
+}
+
+func (s *chunkedStream) Read(buf []byte) (n int, err error) {
+	if len(s.data) == 0 {
+		return 0, io.EOF
+	}
+
+	n = copy(buf[:min(len(buf), s.chunk)], s.data)
+	s.data = s.data[n:]
+	return n, nil
+}
+
+func setMessage(key string, value []byte) []byte {
+	expires := make([]byte, 8)
+	expires[7] = 1
+
+	keyLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
+
+	dataLen := make([]byte, 2)
+	binary.BigEndian.PutUint16(dataLen, uint16(len(value)))
+
+	message := []byte{
+		protocol.VERSION_1,
+		byte(protocol.Set),
+	}
+	message = append(message, expires...)
+	message = append(message, keyLen...)
+	message = append(message, dataLen...)
+	message = append(message, key...)
+	message = append(message, value...)
+	return message
+}
+
+func TestReaderStream(t *testing.T) {
+	t.Run("Message split across reads", func(t *testing.T) {
+		message := setMessage("key", bytes.Repeat([]byte("a"), 3000))
+
+		reader := protocol.NewReader(&chunkedStream{message, 7})
+		read, err := reader.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(read, message) {
+			t.Errorf("Expected message of len %d, got len %d", len(message), len(read))
+		}
+	})
+
+	t.Run("Multiple messages in one read", func(t *testing.T) {
+		first := setMessage("first", []byte("1"))
+		second := setMessage("second", []byte("2"))
+		stream := append(append([]byte{}, first...), second...)
+
+		reader := protocol.NewReader(&chunkedStream{stream, len(stream)})
+
+		for _, expected := range [][]byte{first, second} {
+			read, err := reader.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(read, expected) {
+				t.Errorf("Expected %v, got %v", expected, read)
+			}
+		}
+
+		_, err := reader.Read()
+		if err != io.EOF {
+			t.Errorf("Expected EOF, got %v", err)
+		}
+	})
+	t.Run("Mixed versions", func(t *testing.T) {
+		first := setMessage("first", []byte("1"))
+
+		msg := protocol.Message{Cmd: protocol.Set, Key: "second", Data: []byte("2"), Expires: clock{}.Now().Add(time.Minute), ID: 7}
+		second, err := msg.MarshalBinary(clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream := append(append([]byte{}, first...), second...)
+
+		reader := protocol.NewReader(&chunkedStream{stream, 5})
+		for _, expected := range [][]byte{first, second} {
+			read, err := reader.Read()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if !bytes.Equal(read, expected) {
+				t.Errorf("Expected %v, got %v", expected, read)
+			}
+		}
+	})
+
+	t.Run("Unknown version", func(t *testing.T) {
+		message := setMessage("key", []byte("value"))
+		message[0] = 0
+
+		reader := protocol.NewReader(&chunkedStream{message, len(message)})
+		_, err := reader.Read()
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Version mismatch.").Error()
+		actual := err.Error()
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Messages over the limit are dropped", func(t *testing.T) {
+		c := clock{}
+		msg, err := protocol.NewMessage(protocol.Set, "big", bytes.Repeat([]byte("a"), 70*1024), 60, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.ID = 9
+
+		big, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		small := setMessage("small", []byte("1"))
+		stream := append(append([]byte{}, big...), small...)
+
+		reader := protocol.NewReader(&chunkedStream{stream, 1000})
+		reader.Limit = 64 * 1024
+
+		header, err := reader.Read()
+		if err != protocol.ErrTooLarge {
+			t.Fatalf("Expected ErrTooLarge, got %v", err)
+		}
+
+		if protocol.PeekID(header) != 9 {
+			t.Errorf("Expected ID 9 in the header, got %d", protocol.PeekID(header))
+		}
+
+		read, err := reader.Read()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(read, small) {
+			t.Errorf("Expected %v, got %v", small, read)
+		}
+	})
+}
@@ -0,0 +1,318 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Version (1B) | Status (1B) | Code (1B) | ID (4B) | Expires (8B) | CAS (8B) | Length (4B) | Value (x)
+//
+// Expires is a Unix timestamp in milliseconds, 0 for no expiry.
+const RESPONSE_HEADER_SIZE = 27
+
+// Sent in reply to older versions, 1 has no ID and only 4 has a CAS. They all
+// have expires in whole seconds. The value length was always 4 bytes.
+const V1_RESPONSE_HEADER_SIZE = 15
+const V2_RESPONSE_HEADER_SIZE = 19
+
+func responseHeaderSize(version byte) int {
+	switch version {
+	case VERSION_1:
+		return V1_RESPONSE_HEADER_SIZE
+	case VERSION_2, VERSION_3:
+		return V2_RESPONSE_HEADER_SIZE
+	case VERSION_4, VERSION:
+		return RESPONSE_HEADER_SIZE
+	default:
+		return 0
+	}
+}
+
+type Status byte
+
+const (
+	_ Status = iota
+	OK
+	Failed
+)
+
+func (s Status) String() string {
+	switch s {
+	case OK:
+		return "OK"
+	case Failed:
+		return "FAILED"
+	default:
+		return fmt.Sprintf("Status(%d)", byte(s))
+	}
+}
+
+// Why a request failed, the value of a failed response has the error message.
+type ErrorCode byte
+
+const (
+	NoError ErrorCode = iota
+	NotFound
+	Expired
+	Exists
+	TooLarge
+	PastExpiry
+	BadRequest
+	ReadOnly
+	Unknown
+	NotInteger
+	Overflow
+	Changed
+	Internal // Something went wrong on the server, rather than with the request
+	Evicted  // Stored by an MSET, then pushed out by a later item in it
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case NoError:
+		return "NO_ERROR"
+	case NotFound:
+		return "NOT_FOUND"
+	case Expired:
+		return "EXPIRED"
+	case Exists:
+		return "EXISTS"
+	case TooLarge:
+		return "TOO_LARGE"
+	case PastExpiry:
+		return "PAST_EXPIRY"
+	case BadRequest:
+		return "BAD_REQUEST"
+	case ReadOnly:
+		return "READ_ONLY"
+	case Unknown:
+		return "UNKNOWN"
+	case NotInteger:
+		return "NOT_INTEGER"
+	case Overflow:
+		return "OVERFLOW"
+	case Changed:
+		return "CHANGED"
+	case Internal:
+		return "INTERNAL"
+	case Evicted:
+		return "EVICTED"
+	default:
+		return fmt.Sprintf("ErrorCode(%d)", byte(c))
+	}
+}
+
+// Response is sent back for every message. What's in it depends on the command:
+//   - GET: the value, when it expires and its CAS.
+//   - SET, SETNX and SETXX: when the value expires.
+//   - CAS: when the value expires and its new CAS.
+//   - INCR, DECR and INCRBY: the new count as decimal text, and when it expires.
+//   - FLUSH: the number of items flushed, see Count.
+//   - USAGE: the number of items and bytes stored, see Usage.
+//   - SCAN: a page of keys and the cursor for the next, see Page.
+//   - STATS: counts of what the server's done, see Stats.
+type Response struct {
+	Status  Status
+	Code    ErrorCode
+	Expires time.Time // Zero when there's no expiry to report
+	Value   []byte
+	ID      uint32 // Of the message being responded to
+	CAS     uint64 // Version of the key, 0 when there isn't one to report
+
+	batch bool // Made by BatchResponse, so results are sent in seconds to older versions
+}
+
+func Success(value []byte, expires time.Time) Response {
+	return Response{OK, NoError, expires, value, 0, 0, false}
+}
+
+func Failure(code ErrorCode, err error) Response {
+	return Response{Failed, code, time.Time{}, []byte(err.Error()), 0, 0, false}
+}
+
+func CountResponse(count uint64) Response {
+	value := make([]byte, 8)
+	binary.BigEndian.PutUint64(value, count)
+	return Success(value, time.Time{})
+}
+
+func UsageResponse(items uint64, bytes uint64) Response {
+	value := make([]byte, 16)
+	binary.BigEndian.PutUint64(value[:8], items)
+	binary.BigEndian.PutUint64(value[8:], bytes)
+	return Success(value, time.Time{})
+}
+
+// Err returns the failure as an error, nil if the request succeeded.
+func (r Response) Err() error {
+	if r.Status == OK {
+		return nil
+	}
+	return errors.New(string(r.Value))
+}
+
+func (r Response) Count() (uint64, error) {
+	if len(r.Value) != 8 {
+		return 0, errors.New("Not a count.")
+	}
+	return binary.BigEndian.Uint64(r.Value), nil
+}
+
+func (r Response) Usage() (items uint64, bytes uint64, err error) {
+	if len(r.Value) != 16 {
+		return 0, 0, errors.New("Not a usage.")
+	}
+	return binary.BigEndian.Uint64(r.Value[:8]), binary.BigEndian.Uint64(r.Value[8:]), nil
+}
+
+func (r Response) MarshalBinary() ([]byte, error) {
+	return r.MarshalVersion(VERSION)
+}
+
+// MarshalVersion encodes the response for clients speaking an older version,
+// dropping what it doesn't have room for.
+func (r Response) MarshalVersion(version byte) ([]byte, error) {
+	size := responseHeaderSize(version)
+	if size == 0 {
+		return []byte{}, errors.New("Version mismatch.")
+	}
+
+	if r.Status != OK && r.Status != Failed {
+		return []byte{}, errors.New(fmt.Sprintf("Invalid status: %d", int(r.Status)))
+	}
+
+	if uint64(len(r.Value)) > 1<<32-1 {
+		return []byte{}, errors.New("Value too large.")
+	}
+
+	value := r.Value
+	if r.batch && version != VERSION {
+		var err error
+		value, err = resultsInSeconds(r.Value)
+		if err != nil {
+			return []byte{}, err
+		}
+	}
+
+	var expiresUnix int64
+	if !r.Expires.IsZero() && version == VERSION {
+		expiresUnix = r.Expires.UnixMilli()
+	} else if !r.Expires.IsZero() {
+		expiresUnix = r.Expires.Unix()
+	}
+
+	data := make([]byte, size, size+len(value))
+	data[0] = version
+	data[1] = byte(r.Status)
+	data[2] = byte(r.Code)
+
+	header := data[3:]
+	if version != VERSION_1 {
+		binary.BigEndian.PutUint32(header[:4], r.ID)
+		header = header[4:]
+	}
+	binary.BigEndian.PutUint64(header[0:8], uint64(expiresUnix))
+	header = header[8:]
+
+	if version == VERSION_4 || version == VERSION {
+		binary.BigEndian.PutUint64(header[0:8], r.CAS)
+		header = header[8:]
+	}
+	binary.BigEndian.PutUint32(header[0:4], uint32(len(value)))
+	return append(data, value...), nil
+}
+
+func parseStatus(status byte) (Status, error) {
+	switch Status(status) {
+	case OK, Failed:
+		return Status(status), nil
+	default:
+		return Failed, errors.New(fmt.Sprintf("Invalid status: %d", int(status)))
+	}
+}
+
+func UnmarshalResponse(data []byte) (Response, error) {
+	if len(data) < 1 {
+		return Response{}, errors.New("Not enough data.")
+	}
+
+	version := data[0]
+	size := responseHeaderSize(version)
+	if size == 0 {
+		return Response{}, errors.New("Version mismatch.")
+	}
+
+	if len(data) < size {
+		return Response{}, errors.New("Not enough data.")
+	}
+
+	status, err := parseStatus(data[1])
+	if err != nil {
+		return Response{}, err
+	}
+
+	var id uint32
+	header := data[3:size]
+	if version != VERSION_1 {
+		id = binary.BigEndian.Uint32(header[:4])
+		header = header[4:]
+	}
+
+	var expires time.Time
+	expiresUnix := int64(binary.BigEndian.Uint64(header[0:8]))
+	if expiresUnix != 0 && version == VERSION {
+		expires = time.UnixMilli(expiresUnix).UTC()
+	} else if expiresUnix != 0 {
+		expires = time.Unix(expiresUnix, 0).UTC()
+	}
+	header = header[8:]
+
+	var cas uint64
+	if version == VERSION_4 || version == VERSION {
+		cas = binary.BigEndian.Uint64(header[0:8])
+		header = header[8:]
+	}
+
+	lenValue := int(binary.BigEndian.Uint32(header[0:4]))
+	value := data[size:]
+	if lenValue != len(value) {
+		return Response{}, errors.New("Length of value doesn't match header.")
+	}
+
+	return Response{status, ErrorCode(data[2]), expires, value, id, cas, false}, nil
+}
+
+// ReadResponse reads a single response from the stream.
+func ReadResponse(r io.Reader) (Response, error) {
+	version := make([]byte, 1)
+	_, err := io.ReadFull(r, version)
+	if err != nil {
+		return Response{}, err
+	}
+
+	size := responseHeaderSize(version[0])
+	if size == 0 {
+		return Response{}, errors.New("Version mismatch.")
+	}
+
+	header := make([]byte, size)
+	header[0] = version[0]
+	_, err = io.ReadFull(r, header[1:])
+	if err != nil {
+		return Response{}, err
+	}
+
+	// Length is always at the end of the header.
+	lenValue := binary.BigEndian.Uint32(header[size-4 : size])
+	data := make([]byte, size+int(lenValue))
+	copy(data, header)
+
+	_, err = io.ReadFull(r, data[size:])
+	if err != nil {
+		return Response{}, err
+	}
+	return UnmarshalResponse(data)
+}
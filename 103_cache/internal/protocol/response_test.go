@@ -0,0 +1,207 @@
+package protocol_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+)
+
+func TestResponse(t *testing.T) {
+	t.Run("Round trip value with expiry", func(t *testing.T) {
+		expires := time.Unix(1700000000, 0).UTC()
+		response := protocol.Success([]byte("line one\nline two"), expires)
+
+		data, err := response.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(data) != protocol.RESPONSE_HEADER_SIZE+len(response.Value) {
+			t.Errorf("Expected %d bytes, got %d", protocol.RESPONSE_HEADER_SIZE+len(response.Value), len(data))
+		}
+
+		actual, err := protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Status != protocol.OK {
+			t.Errorf("Expected OK, got %s", actual.Status)
+		}
+
+		if actual.Code != protocol.NoError {
+			t.Errorf("Expected %s, got %s", protocol.NoError, actual.Code)
+		}
+
+		if !actual.Expires.Equal(expires) {
+			t.Errorf("Expected %s, got %s", expires, actual.Expires)
+		}
+
+		if string(actual.Value) != string(response.Value) {
+			t.Errorf("Expected '%s', got '%s'", response.Value, actual.Value)
+		}
+
+		if actual.Err() != nil {
+			t.Errorf("Expected nil, got '%s'", actual.Err())
+		}
+	})
+
+	t.Run("Round trip failure", func(t *testing.T) {
+		response := protocol.Failure(protocol.NotFound, errors.New("Value doesn't exist."))
+
+		data, err := response.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual.Status != protocol.Failed {
+			t.Errorf("Expected FAILED, got %s", actual.Status)
+		}
+
+		if actual.Code != protocol.NotFound {
+			t.Errorf("Expected %s, got %s", protocol.NotFound, actual.Code)
+		}
+
+		if !actual.Expires.IsZero() {
+			t.Errorf("Expected no expiry, got %s", actual.Expires)
+		}
+
+		expected := errors.New("Value doesn't exist.").Error()
+		if actual.Err() == nil || actual.Err().Error() != expected {
+			t.Errorf("Expected '%s', got '%v'", expected, actual.Err())
+		}
+	})
+
+	t.Run("Round trip count and usage", func(t *testing.T) {
+		data, err := protocol.CountResponse(42).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		count, err := response.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if count != 42 {
+			t.Errorf("Expected 42, got %d", count)
+		}
+
+		data, err = protocol.UsageResponse(3, 99).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err = protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		items, bytes, err := response.Usage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if items != 3 || bytes != 99 {
+			t.Errorf("Expected 3 items and 99 bytes, got %d and %d", items, bytes)
+		}
+	})
+
+	t.Run("Read multiple responses from a stream", func(t *testing.T) {
+		first, _ := protocol.Success([]byte("first"), time.Time{}).MarshalBinary()
+		second, _ := protocol.Success([]byte{}, time.Time{}).MarshalBinary()
+		stream := bytes.NewReader(append(first, second...))
+
+		for _, expected := range []string{"first", ""} {
+			response, err := protocol.ReadResponse(stream)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(response.Value) != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, response.Value)
+			}
+		}
+
+		_, err := protocol.ReadResponse(stream)
+		if err != io.EOF {
+			t.Errorf("Expected EOF, got %v", err)
+		}
+	})
+
+	t.Run("Not enough data", func(t *testing.T) {
+		_, err := protocol.UnmarshalResponse([]byte{protocol.VERSION, byte(protocol.OK)})
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := errors.New("Not enough data.").Error()
+		actual := err.Error()
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Version mismatch", func(t *testing.T) {
+		data, _ := protocol.Success([]byte("value"), time.Time{}).MarshalBinary()
+		data[0] = protocol.VERSION + 1
+
+		_, err := protocol.UnmarshalResponse(data)
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := errors.New("Version mismatch.").Error()
+		actual := err.Error()
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Invalid status", func(t *testing.T) {
+		data, _ := protocol.Success([]byte("value"), time.Time{}).MarshalBinary()
+		data[1] = 9
+
+		_, err := protocol.UnmarshalResponse(data)
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := errors.New("Invalid status: 9").Error()
+		actual := err.Error()
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Length doesn't match header", func(t *testing.T) {
+		data, _ := protocol.Success([]byte("value"), time.Time{}).MarshalBinary()
+		binary.BigEndian.PutUint32(data[23:27], 2)
+
+		_, err := protocol.UnmarshalResponse(data)
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := errors.New("Length of value doesn't match header.").Error()
+		actual := err.Error()
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+}
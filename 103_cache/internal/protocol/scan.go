@@ -0,0 +1,97 @@
+package protocol
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SCAN data:  Count (4B) | CursorLen (4B) | Cursor (x) | Pattern (x)
+// SCAN value: CursorLen (4B) | Cursor (x) | Count (4B) | { KeyLen (4B) | Key (x) } ...
+//
+// The cursor is the last key of the page before, keys come back in order.
+// Start with an empty cursor, the next cursor is empty once it's done.
+const SCAN_HEADER_SIZE = 8
+
+// Query is what to SCAN for, see NewScan.
+type Query struct {
+	Cursor string
+	Match  string // Glob pattern, * for any run of characters and ? for any one
+	Count  int    // Most keys to send back
+}
+
+// NewScan asks for up to count keys matching the pattern after the cursor. An
+// empty pattern matches everything.
+func NewScan(cursor string, match string, count int, c Clock) (Message, error) {
+	if count <= 0 {
+		return Message{}, errors.New("Count must be greater than 0.")
+	}
+
+	if uint64(count) > 1<<32-1 {
+		return Message{}, errors.New("Count too large.")
+	}
+
+	data := binary.BigEndian.AppendUint32([]byte{}, uint32(count))
+	data = binary.BigEndian.AppendUint32(data, uint32(len(cursor)))
+	data = append(data, cursor...)
+	data = append(data, match...)
+	return Message{Cmd: Scan, Data: data}, nil
+}
+
+func decodeScan(data []byte) (Query, error) {
+	if len(data) < SCAN_HEADER_SIZE {
+		return Query{}, errors.New("Scan is truncated.")
+	}
+
+	count := int(binary.BigEndian.Uint32(data[0:4]))
+	if count == 0 {
+		return Query{}, errors.New("Count must be greater than 0.")
+	}
+
+	lenCursor := int(binary.BigEndian.Uint32(data[4:8]))
+	data = data[SCAN_HEADER_SIZE:]
+	if len(data) < lenCursor {
+		return Query{}, errors.New("Scan is truncated.")
+	}
+	return Query{string(data[:lenCursor]), string(data[lenCursor:]), count}, nil
+}
+
+// Query returns what a SCAN is looking for.
+func (m Message) Query() (Query, error) {
+	if m.Cmd != Scan {
+		return Query{}, errors.New(fmt.Sprintf("No query in %s.", m.Cmd))
+	}
+	return decodeScan(m.Data)
+}
+
+// ScanResponse sends back a page of keys, and the cursor to get the next.
+func ScanResponse(keys []string, next string) Response {
+	value := binary.BigEndian.AppendUint32([]byte{}, uint32(len(next)))
+	value = append(value, next...)
+	value = binary.BigEndian.AppendUint32(value, uint32(len(keys)))
+	for _, key := range keys {
+		value = binary.BigEndian.AppendUint32(value, uint32(len(key)))
+		value = append(value, key...)
+	}
+	return Success(value, time.Time{})
+}
+
+// Page returns the keys from a SCAN, and the cursor to get the next page which
+// is empty after the last.
+func (r Response) Page() (keys []string, next string, err error) {
+	if len(r.Value) < 4 {
+		return nil, "", errors.New("Not a page.")
+	}
+
+	lenCursor := int(binary.BigEndian.Uint32(r.Value[:4]))
+	if len(r.Value) < 4+lenCursor {
+		return nil, "", errors.New("Not a page.")
+	}
+
+	keys, err = decodeKeys(r.Value[4+lenCursor:])
+	if err != nil {
+		return nil, "", err
+	}
+	return keys, string(r.Value[4 : 4+lenCursor]), nil
+}
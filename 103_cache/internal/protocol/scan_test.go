@@ -0,0 +1,133 @@
+package protocol_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+)
+
+func TestScan(t *testing.T) {
+	c := clock{}
+
+	t.Run("Query survives encoding", func(t *testing.T) {
+		expected := protocol.Query{Cursor: "user:10", Match: "user:*", Count: 50}
+		msg, err := protocol.NewScan(expected.Cursor, expected.Match, expected.Count, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		decoded, err := protocol.UnmarshalBinary(data, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := decoded.Query()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if actual != expected {
+			t.Errorf("Expected %+v, got %+v", expected, actual)
+		}
+	})
+
+	t.Run("Page survives encoding", func(t *testing.T) {
+		data, err := protocol.ScanResponse([]string{"a", "bb"}, "bb").MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		keys, next, err := response.Page()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 2 || keys[0] != "a" || keys[1] != "bb" || next != "bb" {
+			t.Errorf("Expected [a bb] and 'bb', got %v and '%s'", keys, next)
+		}
+	})
+
+	t.Run("Last page has no cursor", func(t *testing.T) {
+		keys, next, err := protocol.ScanResponse([]string{}, "").Page()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(keys) != 0 || next != "" {
+			t.Errorf("Expected nothing, got %v and '%s'", keys, next)
+		}
+	})
+
+	t.Run("Invalid scans", func(t *testing.T) {
+		tests := map[string]struct {
+			build    func() error
+			expected string
+		}{
+			"No count": {
+				func() error {
+					_, err := protocol.NewScan("", "", 0, c)
+					return err
+				},
+				"Count must be greater than 0.",
+			},
+			"Through NewMessage": {
+				func() error {
+					_, err := protocol.NewMessage(protocol.Scan, "", []byte{}, 0, c)
+					return err
+				},
+				"Use NewScan for SCAN.",
+			},
+			"Truncated": {
+				func() error {
+					msg, err := protocol.NewScan("cursor", "", 10, c)
+					if err != nil {
+						return err
+					}
+					msg.Data = msg.Data[:10]
+
+					data, err := msg.MarshalBinary(c)
+					if err != nil {
+						return err
+					}
+
+					_, err = protocol.UnmarshalBinary(data, c)
+					return err
+				},
+				"Scan is truncated.",
+			},
+			"Not a page": {
+				func() error {
+					_, _, err := protocol.Success([]byte{}, c.Now()).Page()
+					return err
+				},
+				"Not a page.",
+			},
+		}
+
+		for name, tc := range tests {
+			t.Run(name, func(t *testing.T) {
+				err := tc.build()
+				if err == nil {
+					t.Fatal("Expected err, got nil.")
+				}
+
+				expected := errors.New(tc.expected).Error()
+				actual := err.Error()
+				if actual != expected {
+					t.Errorf("Expected '%s', got '%s'", expected, actual)
+				}
+			})
+		}
+	})
+}
@@ -0,0 +1,49 @@
+package protocol
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// STATS value: one "name value" line per stat, the value in decimal. Clients
+// skip what they don't know, so stats can be added without a new version.
+
+// Stat is a single named count from STATS.
+type Stat struct {
+	Name  string
+	Value uint64
+}
+
+// StatsResponse sends back the stats in the order given.
+func StatsResponse(stats []Stat) Response {
+	value := []byte{}
+	for _, stat := range stats {
+		value = fmt.Appendf(value, "%s %d\n", stat.Name, stat.Value)
+	}
+	return Success(value, time.Time{})
+}
+
+// Stats returns the stats from a STATS response, in the order they were sent.
+func (r Response) Stats() ([]Stat, error) {
+	stats := []Stat{}
+	for _, line := range strings.Split(strings.TrimSuffix(string(r.Value), "\n"), "\n") {
+		if line == "" {
+			continue
+		}
+
+		name, value, ok := strings.Cut(line, " ")
+		if !ok {
+			return nil, errors.New(fmt.Sprintf("Invalid stat: %s", line))
+		}
+
+		n, err := strconv.ParseUint(value, 10, 64)
+		if err != nil {
+			return nil, errors.New(fmt.Sprintf("Invalid stat: %s", line))
+		}
+		stats = append(stats, Stat{name, n})
+	}
+	return stats, nil
+}
@@ -0,0 +1,60 @@
+package protocol_test
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+)
+
+func TestStats(t *testing.T) {
+	t.Run("Stats survive encoding", func(t *testing.T) {
+		expected := []protocol.Stat{{Name: "hits", Value: 3}, {Name: "get_calls", Value: 0}}
+		data, err := protocol.StatsResponse(expected).MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := protocol.UnmarshalResponse(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := response.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual) != len(expected) || actual[0] != expected[0] || actual[1] != expected[1] {
+			t.Errorf("Expected %+v, got %+v", expected, actual)
+		}
+	})
+
+	t.Run("Invalid stat", func(t *testing.T) {
+		response := protocol.Success([]byte("hits three\n"), clock{}.Now())
+
+		_, err := response.Stats()
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := errors.New("Invalid stat: hits three").Error()
+		actual := err.Error()
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("STATS takes no key", func(t *testing.T) {
+		_, err := protocol.NewMessage(protocol.Stats, "key", []byte{}, 0, clock{})
+		if err == nil {
+			t.Fatal("Expecting err, got nil.")
+		}
+
+		expected := errors.New("Key provided for STATS.").Error()
+		actual := err.Error()
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+}
@@ -0,0 +1,175 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/snapshot"
+)
+
+// Returned by Serve once Shutdown's been called.
+var ErrServerClosed = errors.New("Server closed.")
+
+const DEFAULT_SHUTDOWN_TIMEOUT = 10 * time.Second
+
+// How often Shutdown checks for connections that have finished.
+const shutdownPollInterval = 10 * time.Millisecond
+
+// A client connection, tracked so Shutdown can close it once it's idle.
+type conn struct {
+	net.Conn
+	active bool       // Handling a message rather than waiting for one, guarded by connsMu
+	ns     *namespace // Selected by the client, the default until then
+}
+
+// Runs f in the background, for Shutdown to wait on.
+func (s *Server) goRunning(f func()) {
+	s.running.Add(1)
+	go func() {
+		defer s.running.Done()
+		f()
+	}()
+}
+
+func (s *Server) shuttingDown() bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	return s.closing
+}
+
+func (s *Server) trackListener(listener net.Listener) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.closing {
+		return false
+	}
+	s.listeners[listener] = struct{}{}
+	return true
+}
+
+func (s *Server) untrackListener(listener net.Listener) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.listeners, listener)
+}
+
+// Starts handling the connection, unless the server's shutting down or
+// already has as many as it allows.
+func (s *Server) accept(nc net.Conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	if s.closing {
+		nc.Close()
+		return
+	}
+
+	if s.maxConnections > 0 && len(s.conns) >= s.maxConnections {
+		log.Println("Too many connections, closing", nc.RemoteAddr())
+		s.metrics.rejected.Add(1)
+		nc.Close()
+		return
+	}
+
+	c := &conn{Conn: nc, ns: s.namespaces[0]}
+	s.conns[c] = struct{}{}
+	s.goRunning(func() {
+		defer s.closeConn(c)
+		s.handle(c)
+	})
+}
+
+func (s *Server) closeConn(c *conn) {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	delete(s.conns, c)
+	c.Close()
+}
+
+// Marks the connection as busy with a message, false if it should be closed
+// instead as the server's shutting down.
+func (s *Server) startRequest(c *conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	c.active = !s.closing
+	return c.active
+}
+
+// Marks the connection as waiting for the next message, false if it should be
+// closed instead as the server's shutting down.
+func (s *Server) finishRequest(c *conn) bool {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	c.active = false
+	return !s.closing
+}
+
+// Closes every connection waiting for a message, or every one at all, and
+// returns how many are left.
+func (s *Server) closeConns(all bool) int {
+	s.connsMu.Lock()
+	defer s.connsMu.Unlock()
+
+	for c := range s.conns {
+		if all || !c.active {
+			c.Close()
+			delete(s.conns, c)
+		}
+	}
+	return len(s.conns)
+}
+
+// Shutdown stops accepting connections and closes the idle ones, then waits
+// for the rest to finish the message they're on. Anything still going when
+// ctx is done is cut off. Once nothing can change the cache, the append-only
+// log is synced and closed and a last snapshot taken.
+func (s *Server) Shutdown(ctx context.Context) error {
+	s.connsMu.Lock()
+	s.closing = true
+	for listener := range s.listeners {
+		listener.Close()
+	}
+	s.connsMu.Unlock()
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+
+	var err error
+	for s.closeConns(false) > 0 && err == nil {
+		select {
+		case <-ctx.Done():
+			err = ctx.Err()
+			s.closeConns(true)
+		case <-ticker.C:
+		}
+	}
+
+	// Handlers of closed connections and the background work stopped by
+	// Serve returning.
+	s.running.Wait()
+	return errors.Join(err, s.flush())
+}
+
+// Saves everything in memory to disk.
+func (s *Server) flush() error {
+	var errs []error
+	for _, ns := range s.namespaces {
+		if ns.aof != nil {
+			errs = append(errs, ns.aof.Close())
+		}
+
+		if ns.snapshotPath != "" {
+			errs = append(errs, snapshot.Save(ns.snapshotPath, ns.store))
+		}
+	}
+	return errors.Join(errs...)
+}
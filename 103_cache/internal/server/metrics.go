@@ -0,0 +1,172 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+)
+
+// Upper bounds of the command latency histogram. Most commands take a few
+// microseconds, so it starts a lot lower than Prometheus' defaults.
+var latencyBuckets = [...]time.Duration{
+	50 * time.Microsecond,
+	100 * time.Microsecond,
+	250 * time.Microsecond,
+	500 * time.Microsecond,
+	time.Millisecond,
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+}
+
+type commandMetrics struct {
+	calls  atomic.Uint64
+	errors atomic.Uint64 // Calls that got a failed response
+	total  atomic.Uint64 // Nanoseconds spent on every call
+
+	// Calls that took up to each of latencyBuckets, the last is anything slower.
+	buckets [len(latencyBuckets) + 1]atomic.Uint64
+}
+
+// Counts and times what the server handles, for STATS and the metrics
+// endpoint. Everything's atomic so connections don't wait on each other.
+type metrics struct {
+	connections atomic.Int64
+	rejected    atomic.Uint64       // Connections closed for going over the max
+	commands    [256]commandMetrics // Indexed by command, which is a byte
+}
+
+// Records a command handled in took.
+func (m *metrics) observe(cmd protocol.Command, took time.Duration, failed bool) {
+	command := &m.commands[cmd]
+	command.calls.Add(1)
+	if failed {
+		command.errors.Add(1)
+	}
+	command.total.Add(uint64(took))
+
+	// The first bucket it fits in, counts are added up when written out.
+	i, _ := slices.BinarySearch(latencyBuckets[:], took)
+	command.buckets[i].Add(1)
+}
+
+// Every command that's been handled at least once, in order.
+func (m *metrics) called() []protocol.Command {
+	commands := []protocol.Command{}
+	for i := range m.commands {
+		if m.commands[i].calls.Load() > 0 {
+			commands = append(commands, protocol.Command(i))
+		}
+	}
+	return commands
+}
+
+// Sent in reply to STATS, with what's stored in the connection's namespace.
+// Everything's a count so a cluster can add them up.
+func (s *Server) stats(ns *namespace) []protocol.Stat {
+	stats := ns.store.Stats()
+	result := []protocol.Stat{
+		{Name: "connections", Value: uint64(s.metrics.connections.Load())},
+		{Name: "rejected_connections", Value: s.metrics.rejected.Load()},
+		{Name: "items", Value: stats.Items},
+		{Name: "bytes", Value: stats.Bytes},
+		{Name: "hits", Value: stats.Hits},
+		{Name: "misses", Value: stats.Misses},
+		{Name: "evictions", Value: stats.Evictions},
+		{Name: "expirations", Value: stats.Expirations},
+	}
+
+	for _, cmd := range s.metrics.called() {
+		command := &s.metrics.commands[cmd]
+		name := strings.ToLower(cmd.String())
+		result = append(result,
+			protocol.Stat{Name: name + "_calls", Value: command.calls.Load()},
+			protocol.Stat{Name: name + "_errors", Value: command.errors.Load()},
+			protocol.Stat{Name: name + "_usec", Value: command.total.Load() / uint64(time.Microsecond)},
+		)
+	}
+	return result
+}
+
+// WriteMetrics writes the same as STATS in Prometheus' text format, with
+// what's stored labelled by namespace and command latencies as a histogram.
+func (s *Server) WriteMetrics(w io.Writer) {
+	metric := func(name string, kind string, help string, value uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", name, help, name, kind, name, value)
+	}
+	metric("cache_connections", "gauge", "Open client connections.", uint64(s.metrics.connections.Load()))
+	metric("cache_rejected_connections_total", "counter", "Connections closed for going over the max.", s.metrics.rejected.Load())
+
+	stats := make([]cache.Stats, len(s.namespaces))
+	for i, ns := range s.namespaces {
+		stats[i] = ns.store.Stats()
+	}
+
+	storeMetric := func(name string, kind string, help string, value func(cache.Stats) uint64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+		for i, ns := range s.namespaces {
+			fmt.Fprintf(w, "%s{namespace=\"%s\"} %d\n", name, ns.name, value(stats[i]))
+		}
+	}
+	storeMetric("cache_items", "gauge", "Items stored.", func(stats cache.Stats) uint64 { return stats.Items })
+	storeMetric("cache_bytes", "gauge", "Size of the keys and values stored.", func(stats cache.Stats) uint64 { return stats.Bytes })
+	storeMetric("cache_hits_total", "counter", "Reads that found the key.", func(stats cache.Stats) uint64 { return stats.Hits })
+	storeMetric("cache_misses_total", "counter", "Reads of keys that were missing or expired.", func(stats cache.Stats) uint64 { return stats.Misses })
+	storeMetric("cache_evictions_total", "counter", "Items removed to make room.", func(stats cache.Stats) uint64 { return stats.Evictions })
+	storeMetric("cache_expirations_total", "counter", "Expired items removed.", func(stats cache.Stats) uint64 { return stats.Expirations })
+
+	called := s.metrics.called()
+	label := func(cmd protocol.Command) string {
+		return strings.ToLower(cmd.String())
+	}
+
+	fmt.Fprint(w, "# HELP cache_commands_total Commands handled.\n# TYPE cache_commands_total counter\n")
+	for _, cmd := range called {
+		fmt.Fprintf(w, "cache_commands_total{command=\"%s\"} %d\n", label(cmd), s.metrics.commands[cmd].calls.Load())
+	}
+
+	fmt.Fprint(w, "# HELP cache_command_errors_total Commands that failed.\n# TYPE cache_command_errors_total counter\n")
+	for _, cmd := range called {
+		fmt.Fprintf(w, "cache_command_errors_total{command=\"%s\"} %d\n", label(cmd), s.metrics.commands[cmd].errors.Load())
+	}
+
+	fmt.Fprint(w, "# HELP cache_command_duration_seconds Time taken to handle commands.\n# TYPE cache_command_duration_seconds histogram\n")
+	for _, cmd := range called {
+		command := &s.metrics.commands[cmd]
+
+		// Counted from the buckets rather than calls, which may have moved on
+		// since.
+		var count uint64
+		for i, bucket := range latencyBuckets {
+			count += command.buckets[i].Load()
+			fmt.Fprintf(w, "cache_command_duration_seconds_bucket{command=\"%s\",le=\"%s\"} %d\n", label(cmd), seconds(bucket), count)
+		}
+		count += command.buckets[len(latencyBuckets)].Load()
+		fmt.Fprintf(w, "cache_command_duration_seconds_bucket{command=\"%s\",le=\"+Inf\"} %d\n", label(cmd), count)
+		fmt.Fprintf(w, "cache_command_duration_seconds_sum{command=\"%s\"} %s\n", label(cmd), seconds(time.Duration(command.total.Load())))
+		fmt.Fprintf(w, "cache_command_duration_seconds_count{command=\"%s\"} %d\n", label(cmd), count)
+	}
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'g', -1, 64)
+}
+
+// MetricsHandler serves WriteMetrics over HTTP, for Prometheus to scrape.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		s.WriteMetrics(w)
+	})
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/todaatsushi/handrolled-cache/internal/aof"
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
+	"github.com/todaatsushi/handrolled-cache/internal/snapshot"
+)
+
+// Connections start in this namespace, which always exists and takes its
+// limits from the top of the Config.
+const DEFAULT_NAMESPACE = "default"
+
+// Namespace is a separate set of keys with its own limits, which connections
+// switch to with SELECT. Keys in one can't be seen from any other.
+type Namespace struct {
+	Name      string
+	CacheSize int // Max number of items, 0 == unlimited
+	MaxBytes  int // Max size of keys and values, 0 == unlimited
+}
+
+// Names end up in file names, so are kept simple.
+var namespaceName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ParseNamespaces reads comma separated namespaces, each written as
+// name[:items[:bytes]] where a missing limit is unlimited.
+func ParseNamespaces(spec string) ([]Namespace, error) {
+	namespaces := []Namespace{}
+	if spec == "" {
+		return namespaces, nil
+	}
+
+	for _, part := range strings.Split(spec, ",") {
+		fields := strings.Split(part, ":")
+		if len(fields) > 3 {
+			return nil, errors.New(fmt.Sprintf("Invalid namespace, expected format name[:items[:bytes]]: %s", part))
+		}
+
+		limits := []int{0, 0}
+		for i, field := range fields[1:] {
+			n, err := strconv.Atoi(field)
+			if err != nil || n < 0 {
+				return nil, errors.New(fmt.Sprintf("Invalid limit for namespace %s: %s", fields[0], field))
+			}
+			limits[i] = n
+		}
+		namespaces = append(namespaces, Namespace{fields[0], limits[0], limits[1]})
+	}
+	return namespaces, nil
+}
+
+// What's kept for each namespace: its store and where it's saved.
+type namespace struct {
+	name         string
+	store        cache.Cache
+	aof          *aof.Log // nil when there's no append-only log
+	snapshotPath string   // "" == no snapshots
+}
+
+// The namespace's own file next to the path, which the default keeps as is.
+func namespacePath(path string, name string) string {
+	if path == "" || name == DEFAULT_NAMESPACE {
+		return path
+	}
+	return path + "." + name
+}
+
+func (s *Server) namespace(name string) (*namespace, bool) {
+	for _, ns := range s.namespaces {
+		if ns.name == name {
+			return ns, true
+		}
+	}
+	return nil, false
+}
+
+// Creates the namespace's store and restores it from disk.
+func (s *Server) addNamespace(cfg Config, spec Namespace) error {
+	if !namespaceName.MatchString(spec.Name) {
+		return errors.New(fmt.Sprintf("Invalid namespace name: %s", spec.Name))
+	}
+
+	_, exists := s.namespace(spec.Name)
+	if exists {
+		return errors.New(fmt.Sprintf("Namespace %s given more than once.", spec.Name))
+	}
+
+	ns := &namespace{name: spec.Name}
+	opts := cache.Options{
+		MaxItems: uint64(spec.CacheSize),
+		MaxBytes: uint64(spec.MaxBytes),
+		Policy:   cfg.Policy,
+		OnChange: func(change cache.Change) { s.record(ns, change) },
+	}
+
+	if cfg.Shards > 1 {
+		ns.store = cache.NewShardedStore(cfg.Shards, opts, c{})
+	} else {
+		ns.store = cache.NewStoreWithOptions(opts, c{})
+	}
+
+	if cfg.SnapshotPath != "" {
+		ns.snapshotPath = namespacePath(cfg.SnapshotPath, ns.name)
+	}
+
+	if cfg.AOFPath != "" {
+		path := namespacePath(cfg.AOFPath, ns.name)
+		applied, err := aof.Replay(path, ns.store, c{})
+		if errors.Is(err, os.ErrNotExist) {
+			// The log's only just been turned on, so start from the snapshot
+			// rather than empty, which would then be saved over it.
+			err = ns.loadSnapshot()
+		} else if err == nil {
+			log.Println("Replayed", applied, "changes to", ns.name, "from append-only log.")
+		}
+
+		if err != nil {
+			return err
+		}
+
+		l, err := aof.Open(path, cfg.Fsync)
+		if err != nil {
+			return err
+		}
+
+		// Compact straight away, which also drops a torn record left by a crash.
+		err = l.Rewrite(ns.store)
+		if err != nil {
+			l.Close()
+			return err
+		}
+		ns.aof = l
+	} else {
+		err := ns.loadSnapshot()
+		if err != nil {
+			return err
+		}
+	}
+
+	s.namespaces = append(s.namespaces, ns)
+	return nil
+}
+
+func (ns *namespace) loadSnapshot() error {
+	if ns.snapshotPath == "" {
+		return nil
+	}
+
+	restored, err := snapshot.Load(ns.snapshotPath, ns.store, c{})
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	log.Println("Restored", restored, "items to", ns.name, "from snapshot.")
+	return nil
+}
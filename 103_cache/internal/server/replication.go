@@ -0,0 +1,256 @@
+package server
+
+import (
+	"io"
+	"log"
+	"net"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+)
+
+// Changes queued for a follower before it's considered too far behind and
+// dropped. It resyncs from scratch when it reconnects.
+const replicaBacklog = 1 << 16
+
+type replica struct {
+	changes chan []byte
+}
+
+func (s *Server) addReplica() *replica {
+	r := &replica{changes: make(chan []byte, replicaBacklog)}
+
+	s.replicasMu.Lock()
+	defer s.replicasMu.Unlock()
+	s.replicas[r] = struct{}{}
+	return r
+}
+
+func (s *Server) removeReplica(r *replica) {
+	s.replicasMu.Lock()
+	defer s.replicasMu.Unlock()
+
+	_, ok := s.replicas[r]
+	if !ok {
+		return
+	}
+	delete(s.replicas, r)
+	close(r.changes)
+}
+
+// The message a follower applies to repeat a change made on the leader.
+func changeMessage(change cache.Change) protocol.Message {
+	switch change.Op {
+	case cache.Stored:
+		return protocol.Message{Cmd: protocol.Set, Key: change.Key, Data: change.Value, Expires: change.Expire}
+	case cache.Flushed:
+		return protocol.Message{Cmd: protocol.Flush}
+	default:
+		return protocol.Message{Cmd: protocol.Delete, Key: change.Key}
+	}
+}
+
+// With more than one namespace every change is sent after a SELECT of the
+// namespace it was made in. The leader's default is the follower's default
+// otherwise.
+func (s *Server) selectMessage(ns *namespace) ([]byte, error) {
+	if len(s.namespaces) == 1 {
+		return []byte{}, nil
+	}
+	return protocol.Message{Cmd: protocol.Select, Key: ns.name}.MarshalBinary(s.clock)
+}
+
+// Queues the change for every follower. Called with the store lock held, so
+// never blocks: a follower that can't keep up is dropped instead.
+func (s *Server) broadcast(ns *namespace, change cache.Change) {
+	s.replicasMu.Lock()
+	defer s.replicasMu.Unlock()
+
+	if len(s.replicas) == 0 {
+		return
+	}
+
+	data, err := s.selectMessage(ns)
+	if err != nil {
+		log.Println("Couldn't replicate change:", err)
+		return
+	}
+
+	msg, err := changeMessage(change).MarshalBinary(s.clock)
+	if err != nil {
+		log.Println("Couldn't replicate change:", err)
+		return
+	}
+	data = append(data, msg...)
+
+	for r := range s.replicas {
+		select {
+		case r.changes <- data:
+		default:
+			log.Println("Replica fell behind, dropping.")
+			delete(s.replicas, r)
+			close(r.changes)
+		}
+	}
+}
+
+// Sends a follower everything in the cache, then every change after it.
+// Returns once the follower goes away.
+func (s *Server) replicate(rw io.ReadWriter) {
+	// Registered before copying the items so nothing made in between is missed,
+	// changes are applied in order on top so repeating some is harmless.
+	r := s.addReplica()
+	defer s.removeReplica(r)
+
+	// Followers don't send anything after SYNC, so this only returns when the
+	// connection is closed.
+	go func() {
+		io.Copy(io.Discard, rw)
+		s.removeReplica(r)
+	}()
+
+	for _, ns := range s.namespaces {
+		if !s.copyNamespace(rw, ns) {
+			return
+		}
+	}
+
+	for data := range r.changes {
+		_, err := rw.Write(data)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Replaces what the follower has in the namespace with everything in it here,
+// returning false if the connection's gone.
+func (s *Server) copyNamespace(w io.Writer, ns *namespace) bool {
+	start, err := s.selectMessage(ns)
+	if err != nil {
+		log.Println("Couldn't start replication:", err)
+		return false
+	}
+
+	flush, err := protocol.Message{Cmd: protocol.Flush}.MarshalBinary(s.clock)
+	if err != nil {
+		log.Println("Couldn't start replication:", err)
+		return false
+	}
+
+	_, err = w.Write(append(start, flush...))
+	if err != nil {
+		return false
+	}
+
+	for _, node := range ns.store.Items() {
+		data, err := changeMessage(cache.Change{Op: cache.Stored, Key: node.Key, Value: node.Value, Expire: node.Expire}).MarshalBinary(s.clock)
+		if err != nil {
+			// Expired since being copied
+			continue
+		}
+
+		_, err = w.Write(data)
+		if err != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Keeps the cache in sync with the leader until done is closed, reconnecting
+// whenever the connection drops.
+func (s *Server) follow(done <-chan struct{}) {
+	for {
+		err := s.syncFrom(done)
+		select {
+		case <-done:
+			return
+		default:
+		}
+		log.Println("Lost connection to leader:", err)
+
+		select {
+		case <-time.After(time.Second):
+		case <-done:
+			return
+		}
+	}
+}
+
+func (s *Server) syncFrom(done <-chan struct{}) error {
+	conn, err := net.DialTimeout("tcp", s.leader, 5*time.Second)
+	if err != nil {
+		return err
+	}
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-done:
+		case <-stop:
+		}
+		conn.Close()
+	}()
+
+	sync, err := protocol.Message{Cmd: protocol.Sync}.MarshalBinary(s.clock)
+	if err != nil {
+		return err
+	}
+
+	_, err = conn.Write(sync)
+	if err != nil {
+		return err
+	}
+	log.Println("Following", s.leader)
+
+	// Changes are made in the default until the leader selects another.
+	ns := s.namespaces[0]
+	reader := protocol.NewReader(conn)
+	for {
+		data, err := reader.Read()
+		if err != nil {
+			return err
+		}
+
+		msg, err := protocol.UnmarshalBinary(data, s.clock)
+		if err != nil {
+			// Most likely an item which expired on the way over
+			log.Println("Couldn't unmarshal change from leader:", err)
+			continue
+		}
+
+		if msg.Cmd == protocol.Select {
+			var ok bool
+			ns, ok = s.namespace(msg.Key)
+			if !ok {
+				log.Println("Ignoring changes to namespace missing from follower:", msg.Key)
+			}
+			continue
+		}
+
+		if ns != nil {
+			apply(ns.store, msg)
+		}
+	}
+}
+
+// Repeats a change streamed from the leader.
+func apply(store cache.Cache, msg protocol.Message) {
+	switch msg.Cmd {
+	case protocol.Set:
+		_, err := store.Set(msg.Key, string(msg.Data), msg.Expires)
+		if err != nil {
+			// Don't keep serving an older value
+			store.Delete(msg.Key)
+		}
+	case protocol.Delete:
+		store.Delete(msg.Key)
+	case protocol.Flush:
+		store.Flush()
+	default:
+		log.Println("Unexpected command from leader:", msg.Cmd)
+	}
+}
@@ -1,21 +1,93 @@
 package server
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net"
+	"net/http"
+	"os"
+	"runtime/debug"
+	"strconv"
+	"sync"
 	"time"
 
+	"github.com/todaatsushi/handrolled-cache/internal/aof"
 	"github.com/todaatsushi/handrolled-cache/internal/cache"
 	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+	"github.com/todaatsushi/handrolled-cache/internal/snapshot"
 )
 
 type Server struct {
-	store *cache.Store
+	namespaces       []*namespace // The default first
+	clock            c
+	sweepInterval    time.Duration
+	snapshotPath     string
+	snapshotInterval time.Duration
+	aofPath          string
+	maxValueSize     int
+	metricsAddr      string
+	metrics          metrics
+	readTimeout      time.Duration
+	writeTimeout     time.Duration
+	maxConnections   int
+	shutdownTimeout  time.Duration
+
+	leader     string // Address of the leader when following one
+	replicasMu sync.Mutex
+	replicas   map[*replica]struct{}
+
+	connsMu   sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[*conn]struct{}
+	closing   bool           // Set by Shutdown, nothing new is started after
+	running   sync.WaitGroup // Connections and background work, for Shutdown to wait on
+}
+
+const DEFAULT_MAX_VALUE_SIZE = 1 << 20
+
+// Room for the header and key on top of the max value size, anything bigger
+// isn't read at all. MSET values together have to fit in this too.
+const maxMessageOverhead = 1 << 16
+
+type Config struct {
+	CacheSize     int           // Max number of items, 0 == unlimited
+	MaxBytes      int           // Max size of keys and values, 0 == unlimited
+	Policy        cache.Policy  // Which items are evicted when the cache is full
+	Shards        int           // Number of independently locked shards, <= 1 == single store
+	SweepInterval time.Duration // 0 == expired items only removed lazily
+	MaxValueSize  int           // Largest value accepted in bytes, 0 == DEFAULT_MAX_VALUE_SIZE
+	MetricsAddr   string        // Serves metrics over HTTP at /metrics, e.g. ":9100". "" == off
+
+	// Connections are closed when the next message takes longer than
+	// ReadTimeout to arrive, or handling and responding to it takes longer than
+	// WriteTimeout.
+	ReadTimeout     time.Duration // 0 == no limit
+	WriteTimeout    time.Duration // 0 == no limit
+	MaxConnections  int           // New connections over this are closed straight away, 0 == unlimited
+	ShutdownTimeout time.Duration // How long Run waits for requests to finish when stopped, 0 == DEFAULT_SHUTDOWN_TIMEOUT
+
+	SnapshotPath     string        // "" == no snapshots
+	SnapshotInterval time.Duration // 0 == only restore on startup
+
+	// Restored from instead of the snapshot when set, as it's more up to date.
+	AOFPath string          // "" == no append-only log
+	Fsync   aof.FsyncPolicy // How often the log is synced to disk
+
+	// Follow the leader at this address, e.g. "localhost:420", serving reads and
+	// rejecting writes.
+	LeaderAddr string // "" == leader
+
+	// Kept separate from the default namespace and each other, saved next to
+	// the snapshot and log with the name added on the end.
+	Namespaces []Namespace
 }
 
-func (s *Server) Run(port int) error {
+// Run serves on the port until ctx is done, then shuts down, giving requests
+// up to the shutdown timeout to finish.
+func (s *Server) Run(ctx context.Context, port int) error {
 	log.Println("Starting server on port", port)
 
 	listener, err := net.ListenTCP("tcp", &net.TCPAddr{Port: port})
@@ -25,63 +97,449 @@ func (s *Server) Run(port int) error {
 	defer listener.Close()
 	log.Println("Listening.")
 
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(listener)
+	}()
+
+	select {
+	case err := <-served:
+		return err
+	case <-ctx.Done():
+	}
+
+	log.Println("Shutting down.")
+	ctx, cancel := context.WithTimeout(context.Background(), s.shutdownTimeout)
+	defer cancel()
+	return s.Shutdown(ctx)
+}
+
+// Serve accepts connections on the listener until it's closed, returning
+// ErrServerClosed if that was Shutdown.
+func (s *Server) Serve(listener net.Listener) error {
+	if !s.trackListener(listener) {
+		return ErrServerClosed
+	}
+	defer s.untrackListener(listener)
+
+	if s.sweepInterval > 0 {
+		done := make(chan struct{})
+		defer close(done)
+
+		for _, ns := range s.namespaces {
+			ticker := time.NewTicker(s.sweepInterval)
+			defer ticker.Stop()
+
+			s.goRunning(func() { ns.store.Sweep(ticker.C, done) })
+		}
+	}
+
+	if s.snapshotPath != "" && s.snapshotInterval > 0 {
+		ticker := time.NewTicker(s.snapshotInterval)
+		defer ticker.Stop()
+
+		done := make(chan struct{})
+		defer close(done)
+
+		s.goRunning(func() { s.snapshotEvery(ticker.C, done) })
+	}
+
+	if s.aofPath != "" {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+
+		done := make(chan struct{})
+		defer close(done)
+
+		s.goRunning(func() { s.maintainLog(ticker.C, done) })
+	}
+
+	if s.leader != "" {
+		done := make(chan struct{})
+		defer close(done)
+
+		s.goRunning(func() { s.follow(done) })
+	}
+
+	if s.metricsAddr != "" {
+		metricsListener, err := net.Listen("tcp", s.metricsAddr)
+		if err != nil {
+			return err
+		}
+
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", s.MetricsHandler())
+		metricsServer := &http.Server{Handler: mux}
+		defer metricsServer.Close()
+
+		log.Println("Serving metrics on", metricsListener.Addr())
+		go metricsServer.Serve(metricsListener)
+	}
+
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if s.shuttingDown() {
+				return ErrServerClosed
+			}
 			return err
 		}
 
-		go s.handle(conn)
+		s.accept(conn)
 	}
 }
 
-func respond(w io.Writer, response string) {
-	_, err := w.Write([]byte(response))
+func (s *Server) snapshotEvery(tick <-chan time.Time, done <-chan struct{}) {
+	for {
+		select {
+		case <-tick:
+			for _, ns := range s.namespaces {
+				err := snapshot.Save(ns.snapshotPath, ns.store)
+				if err != nil {
+					log.Println("Couldn't save snapshot of", ns.name+":", err)
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Syncs the log if that's left to once a second, and compacts it once it's
+// grown too much.
+func (s *Server) maintainLog(tick <-chan time.Time, done <-chan struct{}) {
+	for {
+		select {
+		case <-tick:
+			for _, ns := range s.namespaces {
+				if ns.aof.Policy() == aof.EverySecond {
+					err := ns.aof.Sync()
+					if err != nil {
+						log.Println("Couldn't sync log of", ns.name+":", err)
+					}
+				}
+
+				if ns.aof.NeedsRewrite() {
+					err := ns.aof.Rewrite(ns.store)
+					if err != nil {
+						log.Println("Couldn't rewrite log of", ns.name+":", err)
+					}
+				}
+			}
+		case <-done:
+			return
+		}
+	}
+}
+
+// Passed to each namespace's store to record every change it makes.
+func (s *Server) record(ns *namespace, change cache.Change) {
+	s.broadcast(ns, change)
+
+	if ns.aof == nil {
+		return
+	}
+
+	err := ns.aof.Append(change)
 	if err != nil {
-		log.Println(err)
+		log.Println("Couldn't append to log:", err)
 	}
+}
 
-	// Scanner used in the client, which breaks on the newline
-	w.Write([]byte("\n"))
+// Responds in the version the client spoke. Only fails when the connection
+// has, as a response that can't be encoded is sent as a failure instead.
+func respond(w io.Writer, version byte, response protocol.Response) error {
+	data, err := response.MarshalVersion(version)
+	if err != nil {
+		log.Println("Couldn't marshal response:", err)
+
+		failure := protocol.Failure(protocol.Internal, errors.New("Couldn't encode response."))
+		failure.ID = response.ID
+		data, err = failure.MarshalVersion(version)
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = w.Write(data)
+	return err
+}
+
+// What went wrong, for clients to act on without parsing the message.
+func errorCode(err error) protocol.ErrorCode {
+	switch {
+	case errors.Is(err, cache.ErrNotFound):
+		return protocol.NotFound
+	case errors.Is(err, cache.ErrExpired):
+		return protocol.Expired
+	case errors.Is(err, cache.ErrExists):
+		return protocol.Exists
+	case errors.Is(err, cache.ErrTooLarge):
+		return protocol.TooLarge
+	case errors.Is(err, cache.ErrPastExpiry):
+		return protocol.PastExpiry
+	case errors.Is(err, cache.ErrNotInteger):
+		return protocol.NotInteger
+	case errors.Is(err, cache.ErrOverflow):
+		return protocol.Overflow
+	case errors.Is(err, cache.ErrChanged):
+		return protocol.Changed
+	case errors.Is(err, cache.ErrEvicted):
+		return protocol.Evicted
+	default:
+		return protocol.Unknown
+	}
+}
+
+func (s *Server) checkSize(value []byte) error {
+	if len(value) > s.maxValueSize {
+		return errors.New(fmt.Sprintf("Value of %d bytes is over the max of %d.", len(value), s.maxValueSize))
+	}
+	return nil
 }
 
-func (s *Server) handle(rw io.ReadWriter) {
+// Stores the entries that aren't too large, all at once.
+func (s *Server) mset(store cache.Cache, entries []protocol.Entry) protocol.Response {
+	responses := make([]protocol.Response, len(entries))
+	items := []cache.Node{}
+	stored := []int{} // Index in entries of each item
+	for i, entry := range entries {
+		err := s.checkSize(entry.Value)
+		if err != nil {
+			responses[i] = protocol.Failure(protocol.TooLarge, err)
+			continue
+		}
+
+		items = append(items, cache.Node{Key: entry.Key, Value: entry.Value, Expire: entry.Expires})
+		stored = append(stored, i)
+	}
+
+	if len(items) > 0 {
+		for i, result := range store.MSet(items) {
+			responses[stored[i]] = resultResponse(result)
+		}
+	}
+	return protocol.BatchResponse(responses)
+}
+
+// The failure for an error from the store.
+func failed(err error) protocol.Response {
+	return protocol.Failure(errorCode(err), err)
+}
+
+func resultResponse(result cache.Result) protocol.Response {
+	if result.Err != nil {
+		return failed(result.Err)
+	}
+	return protocol.Success(result.Value, result.Expires)
+}
+
+func batchResponse(results []cache.Result) protocol.Response {
+	responses := make([]protocol.Response, len(results))
+	for i, result := range results {
+		responses[i] = resultResponse(result)
+	}
+	return protocol.BatchResponse(responses)
+}
+
+func (s *Server) handle(rw *conn) {
+	s.metrics.connections.Add(1)
+	defer s.metrics.connections.Add(-1)
+
 	reader := protocol.NewReader(rw)
+	reader.Limit = s.maxValueSize + maxMessageOverhead
 
 	for {
+		if s.readTimeout > 0 {
+			rw.SetReadDeadline(time.Now().Add(s.readTimeout))
+		}
+
 		data, err := reader.Read()
+		start := time.Now()
+		if !s.startRequest(rw) {
+			return
+		}
+
+		if s.writeTimeout > 0 {
+			rw.SetWriteDeadline(start.Add(s.writeTimeout))
+		}
+
+		if err != nil && !errors.Is(err, protocol.ErrTooLarge) {
+			// Closed by the client, timed out or shut down, otherwise there's no
+			// telling where the message ends so nothing after it can be read.
+			if err != io.EOF && !errors.Is(err, os.ErrDeadlineExceeded) && !errors.Is(err, net.ErrClosed) {
+				respond(rw, protocol.VERSION, protocol.Failure(protocol.BadRequest, fmt.Errorf("Couldn't read message: %w", err)))
+			}
+			return
+		}
+
+		// Anything wrong from here on is only wrong with this message, so it's
+		// answered and the connection carries on.
+		version := data[0]
+		var msg protocol.Message
+		var response protocol.Response
 		if err != nil {
-			respond(rw, fmt.Sprint("Couldn't read message: ", err))
+			// The rest of it is skipped by the reader.
+			response = protocol.Failure(protocol.TooLarge, errors.New(fmt.Sprintf("Message is over the max of %d bytes.", reader.Limit)))
+		} else if msg, err = protocol.UnmarshalBinary(data, s.clock); err != nil {
+			response = protocol.Failure(protocol.BadRequest, fmt.Errorf("Couldn't unmarshal binary: %w", err))
+		} else if msg.Cmd == protocol.Sync {
+			// Only ever written to from now on, and left for Shutdown to close.
+			rw.SetDeadline(time.Time{})
+			if s.finishRequest(rw) {
+				s.replicate(rw)
+			}
 			return
+		} else {
+			response = s.execute(rw, msg)
+
+			// Before responding, so the client can't ask for stats without it.
+			s.metrics.observe(msg.Cmd, time.Since(start), response.Status != protocol.OK)
 		}
 
-		msg, err := protocol.UnmarshalBinary(data, s.store.C)
+		response.ID = protocol.PeekID(data)
+		err = respond(rw, version, response)
 		if err != nil {
-			respond(rw, fmt.Sprint("Couldn't unmarshal binary: ", err))
+			log.Println("Couldn't respond:", err)
 			return
 		}
 
-		if msg.Cmd == protocol.Get {
-			value, err := s.store.Get(msg.Key)
-			if err != nil {
-				respond(rw, fmt.Sprintf("GET: Error handling key '%s': %s", msg.Key, err.Error()))
-				return
-			}
+		if !s.finishRequest(rw) {
+			return
+		}
+	}
+}
 
-			respond(rw, fmt.Sprintf("GET: %s", string(value)))
-			_, err = rw.Write(value)
-			if err != nil {
-				log.Fatal(err)
-			}
-		} else if msg.Cmd == protocol.Set {
-			expires, err := s.store.Set(msg.Key, string(msg.Data), msg.Expires)
-			if err != nil {
-				respond(rw, fmt.Sprintf("SET: Error setting key '%s': %s", msg.Key, err.Error()))
-				return
-			}
+// Runs the command, with anything that goes wrong sent back as a failure. A
+// panic is logged and reported as an internal error, so one bad request can't
+// take the server down.
+func (s *Server) execute(rw *conn, msg protocol.Message) (response protocol.Response) {
+	defer func() {
+		r := recover()
+		if r != nil {
+			log.Printf("Panic handling %s: %v\n%s", msg.Cmd, r, debug.Stack())
+			response = protocol.Failure(protocol.Internal, errors.New("Internal error."))
+		}
+	}()
+
+	if s.leader != "" && msg.Cmd.Writes() {
+		return protocol.Failure(protocol.ReadOnly, errors.New("Read only replica."))
+	}
+
+	store := rw.ns.store
+	switch msg.Cmd {
+	case protocol.Select:
+		ns, ok := s.namespace(msg.Key)
+		if !ok {
+			return protocol.Failure(protocol.NotFound, errors.New(fmt.Sprintf("Unknown namespace: %s", msg.Key)))
+		}
+		rw.ns = ns
+		return protocol.Success([]byte{}, time.Time{})
+	case protocol.Get:
+		node, err := store.Lookup(msg.Key)
+		if err != nil {
+			return failed(err)
+		}
+
+		response := protocol.Success(node.Value, node.Expire)
+		response.CAS = node.Version
+		return response
+	case protocol.Set, protocol.SetNX, protocol.SetXX:
+		set := store.Set
+		if msg.Cmd == protocol.SetNX {
+			set = store.SetNX
+		} else if msg.Cmd == protocol.SetXX {
+			set = store.SetXX
+		}
+
+		err := s.checkSize(msg.Data)
+		if err != nil {
+			return protocol.Failure(protocol.TooLarge, err)
+		}
 
-			respond(rw, fmt.Sprintf("Set '%s'. Expires: %s", msg.Key, expires))
+		expires, err := set(msg.Key, string(msg.Data), msg.Expires)
+		if err != nil {
+			return failed(err)
+		}
+		return protocol.Success([]byte{}, expires)
+	case protocol.CompareAndSet:
+		err := s.checkSize(msg.Data)
+		if err != nil {
+			return protocol.Failure(protocol.TooLarge, err)
 		}
+
+		expires, version, err := store.CompareAndSet(msg.Key, string(msg.Data), msg.Expires, msg.CAS)
+		response := protocol.Success([]byte{}, expires)
+		if err != nil {
+			response = failed(err)
+		}
+		response.CAS = version
+		return response
+	case protocol.Incr, protocol.Decr, protocol.IncrBy:
+		amount, err := msg.Amount()
+		if err != nil {
+			return protocol.Failure(protocol.BadRequest, err)
+		}
+
+		n, expires, err := store.Incr(msg.Key, amount, msg.Expires)
+		if err != nil {
+			return failed(err)
+		}
+		return protocol.Success([]byte(strconv.FormatInt(n, 10)), expires)
+	case protocol.TTL:
+		node, err := store.Lookup(msg.Key)
+		if err != nil {
+			return failed(err)
+		}
+
+		// Sent as how long is left too, for clients with a different clock.
+		remaining := []byte{}
+		if !node.Expire.IsZero() {
+			remaining = []byte(strconv.FormatInt(node.Expire.Sub(s.clock.Now()).Milliseconds(), 10))
+		}
+		return protocol.Success(remaining, node.Expire)
+	case protocol.Expire, protocol.Persist:
+		// PERSIST is sent without an expiry, which the store takes as never.
+		expires, err := store.Expire(msg.Key, msg.Expires)
+		if err != nil {
+			return failed(err)
+		}
+		return protocol.Success([]byte{}, expires)
+	case protocol.Delete:
+		err := store.Delete(msg.Key)
+		if err != nil {
+			return failed(err)
+		}
+		return protocol.Success([]byte{}, time.Time{})
+	case protocol.Flush:
+		return protocol.CountResponse(store.Flush())
+	case protocol.Usage:
+		items, bytes := store.Usage()
+		return protocol.UsageResponse(items, bytes)
+	case protocol.Stats:
+		return protocol.StatsResponse(s.stats(rw.ns))
+	case protocol.MGet:
+		keys, err := msg.Keys()
+		if err != nil {
+			return protocol.Failure(protocol.BadRequest, err)
+		}
+		return batchResponse(store.MGet(keys))
+	case protocol.MSet:
+		entries, err := msg.Entries()
+		if err != nil {
+			return protocol.Failure(protocol.BadRequest, err)
+		}
+		return s.mset(store, entries)
+	case protocol.Scan:
+		query, err := msg.Query()
+		if err != nil {
+			return protocol.Failure(protocol.BadRequest, err)
+		}
+
+		keys, next := store.Scan(query.Cursor, query.Match, query.Count)
+		return protocol.ScanResponse(keys, next)
+	default:
+		return protocol.Failure(protocol.BadRequest, errors.New(fmt.Sprintf("Unsupported command: %s", msg.Cmd)))
 	}
 }
 
@@ -92,9 +550,51 @@ func (clock c) Now() time.Time {
 }
 
 func (clock c) Expired(t time.Time) bool {
-	return t.Unix() < clock.Now().Unix()
+	return t.Before(clock.Now())
 }
 
-func NewServer(cacheSize int) *Server {
-	return &Server{store: cache.NewStore(uint64(cacheSize), c{})}
+func NewServer(cfg Config) (*Server, error) {
+	s := &Server{
+		clock:            c{},
+		sweepInterval:    cfg.SweepInterval,
+		snapshotPath:     cfg.SnapshotPath,
+		snapshotInterval: cfg.SnapshotInterval,
+		aofPath:          cfg.AOFPath,
+		maxValueSize:     cfg.MaxValueSize,
+		metricsAddr:      cfg.MetricsAddr,
+		readTimeout:      cfg.ReadTimeout,
+		writeTimeout:     cfg.WriteTimeout,
+		maxConnections:   cfg.MaxConnections,
+		shutdownTimeout:  cfg.ShutdownTimeout,
+		leader:           cfg.LeaderAddr,
+		replicas:         map[*replica]struct{}{},
+		listeners:        map[net.Listener]struct{}{},
+		conns:            map[*conn]struct{}{},
+	}
+
+	if s.maxValueSize <= 0 {
+		s.maxValueSize = DEFAULT_MAX_VALUE_SIZE
+	}
+
+	if s.shutdownTimeout <= 0 {
+		s.shutdownTimeout = DEFAULT_SHUTDOWN_TIMEOUT
+	}
+
+	err := s.addNamespace(cfg, Namespace{DEFAULT_NAMESPACE, cfg.CacheSize, cfg.MaxBytes})
+	for _, spec := range cfg.Namespaces {
+		if err != nil {
+			break
+		}
+		err = s.addNamespace(cfg, spec)
+	}
+
+	if err != nil {
+		for _, ns := range s.namespaces {
+			if ns.aof != nil {
+				ns.aof.Close()
+			}
+		}
+		return nil, err
+	}
+	return s, nil
 }
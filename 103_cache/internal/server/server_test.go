@@ -0,0 +1,1125 @@
+package server_test
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/protocol"
+	"github.com/todaatsushi/handrolled-cache/internal/server"
+)
+
+type clock struct{}
+
+func (c clock) Now() time.Time {
+	return time.Now().UTC()
+}
+
+// Starts a server on a random port, returning its address.
+func serve(t *testing.T, cfg server.Config) string {
+	t.Helper()
+
+	s, err := server.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	go s.Serve(listener)
+	return listener.Addr().String()
+}
+
+// Starts a server on a random port, returning it, its address and what Serve
+// returns once it stops.
+func start(t *testing.T, cfg server.Config) (*server.Server, string, <-chan error) {
+	t.Helper()
+
+	s, err := server.NewServer(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	served := make(chan error, 1)
+	go func() {
+		served <- s.Serve(listener)
+	}()
+	return s, listener.Addr().String(), served
+}
+
+// Sends a single message on a new connection, returning the response.
+func send(t *testing.T, addr string, cmd protocol.Command, key string, data string, ttl int) protocol.Response {
+	t.Helper()
+
+	msg, err := protocol.NewMessage(cmd, key, []byte(data), ttl, clock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return sendMessage(t, addr, msg)
+}
+
+func sendMessage(t *testing.T, addr string, msg protocol.Message) protocol.Response {
+	t.Helper()
+
+	encoded, err := msg.MarshalBinary(clock{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	_, err = conn.Write(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := protocol.ReadResponse(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response
+}
+
+// Polls until getting the key has the expected value or error on the server,
+// as followers catch up asynchronously.
+func eventually(t *testing.T, addr string, key string, expected string) {
+	t.Helper()
+
+	var actual string
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		actual = string(send(t, addr, protocol.Get, key, "", 0).Value)
+		if actual == expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected '%s', got '%s'", expected, actual)
+}
+
+// Polls until the key has an expiry, or doesn't, on the server.
+func eventuallyExpires(t *testing.T, addr string, key string, expected bool) {
+	t.Helper()
+
+	var actual protocol.Response
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+		actual = send(t, addr, protocol.TTL, key, "", 0)
+		if actual.Status == protocol.OK && actual.Expires.IsZero() != expected {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("Expected '%s' to have an expiry: %t, got %s expiring %s", key, expected, actual.Status, actual.Expires)
+}
+
+func TestReplication(t *testing.T) {
+	t.Run("Follower takes a full sync then streams changes", func(t *testing.T) {
+		leader := serve(t, server.Config{})
+		send(t, leader, protocol.Set, "before", "1", 60)
+		send(t, leader, protocol.Set, "deleted", "1", 60)
+
+		follower := serve(t, server.Config{LeaderAddr: leader})
+		eventually(t, follower, "before", "1")
+
+		send(t, leader, protocol.Set, "after", "2", 60)
+		send(t, leader, protocol.Set, "before", "3", 60)
+		send(t, leader, protocol.Delete, "deleted", "", 0)
+
+		eventually(t, follower, "after", "2")
+		eventually(t, follower, "before", "3")
+		eventually(t, follower, "deleted", "Value doesn't exist.")
+
+		send(t, leader, protocol.Incr, "counter", "", 60)
+		send(t, leader, protocol.IncrBy, "counter", "4", 60)
+		eventually(t, follower, "counter", "5")
+
+		send(t, leader, protocol.Flush, "", "", 0)
+		eventually(t, follower, "after", "Value doesn't exist.")
+	})
+
+	t.Run("Persisted keys replicate without an expiry", func(t *testing.T) {
+		leader := serve(t, server.Config{})
+		send(t, leader, protocol.Set, "synced", "1", 60)
+		send(t, leader, protocol.Persist, "synced", "", 0)
+
+		follower := serve(t, server.Config{LeaderAddr: leader})
+		eventually(t, follower, "synced", "1")
+		eventuallyExpires(t, follower, "synced", false)
+
+		send(t, leader, protocol.Set, "streamed", "2", 60)
+		eventuallyExpires(t, follower, "streamed", true)
+
+		send(t, leader, protocol.Persist, "streamed", "", 0)
+		eventuallyExpires(t, follower, "streamed", false)
+
+		send(t, leader, protocol.Expire, "streamed", "", 60)
+		eventuallyExpires(t, follower, "streamed", true)
+	})
+
+	t.Run("Follower rejects writes", func(t *testing.T) {
+		leader := serve(t, server.Config{})
+		follower := serve(t, server.Config{LeaderAddr: leader})
+
+		for _, cmd := range []protocol.Command{protocol.Set, protocol.Delete, protocol.Incr, protocol.Persist} {
+			data, ttl := "", 0
+			if cmd == protocol.Set {
+				data, ttl = "value", 60
+			} else if cmd == protocol.Incr {
+				ttl = 60
+			}
+
+			response := send(t, follower, cmd, "key", data, ttl)
+			if response.Code != protocol.ReadOnly {
+				t.Errorf("Expected %s, got %s", protocol.ReadOnly, response.Code)
+			}
+
+			expected := "Read only replica."
+			actual := string(response.Value)
+			if actual != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, actual)
+			}
+		}
+
+		items, bytes, err := send(t, follower, protocol.Usage, "", "", 0).Usage()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if items != 0 || bytes != 0 {
+			t.Errorf("Expected nothing stored, got %d items and %d bytes", items, bytes)
+		}
+	})
+}
+
+func TestResponses(t *testing.T) {
+	addr := serve(t, server.Config{})
+
+	t.Run("GET returns the value and expiry", func(t *testing.T) {
+		set := send(t, addr, protocol.Set, "key", "line one\nline two", 60)
+		if set.Status != protocol.OK {
+			t.Fatalf("Expected OK, got %s: %s", set.Status, set.Value)
+		}
+
+		get := send(t, addr, protocol.Get, "key", "", 0)
+		if get.Status != protocol.OK {
+			t.Fatalf("Expected OK, got %s: %s", get.Status, get.Value)
+		}
+
+		expected := "line one\nline two"
+		actual := string(get.Value)
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+
+		if !get.Expires.Equal(set.Expires) {
+			t.Errorf("Expected expiry %s, got %s", set.Expires, get.Expires)
+		}
+	})
+
+	t.Run("Errors have codes", func(t *testing.T) {
+		response := send(t, addr, protocol.Get, "missing", "", 0)
+		if response.Status != protocol.Failed {
+			t.Errorf("Expected FAILED, got %s", response.Status)
+		}
+
+		if response.Code != protocol.NotFound {
+			t.Errorf("Expected %s, got %s", protocol.NotFound, response.Code)
+		}
+
+		send(t, addr, protocol.Set, "exists", "value", 60)
+		response = send(t, addr, protocol.SetNX, "exists", "value", 60)
+		if response.Code != protocol.Exists {
+			t.Errorf("Expected %s, got %s", protocol.Exists, response.Code)
+		}
+	})
+
+	t.Run("Counters return the new count", func(t *testing.T) {
+		first := send(t, addr, protocol.Incr, "counter", "", 60)
+		if string(first.Value) != "1" || first.Expires.IsZero() {
+			t.Errorf("Expected '1' with an expiry, got '%s' expiring %s", first.Value, first.Expires)
+		}
+
+		second := send(t, addr, protocol.IncrBy, "counter", "-5", 60)
+		if string(second.Value) != "-4" || !second.Expires.Equal(first.Expires) {
+			t.Errorf("Expected '-4' expiring %s, got '%s' expiring %s", first.Expires, second.Value, second.Expires)
+		}
+
+		response := send(t, addr, protocol.Decr, "key", "", 60)
+		if response.Code != protocol.NotInteger {
+			t.Errorf("Expected %s, got %s", protocol.NotInteger, response.Code)
+		}
+	})
+
+	t.Run("CAS only stores if unchanged", func(t *testing.T) {
+		send(t, addr, protocol.Set, "cas", "first", 60)
+		get := send(t, addr, protocol.Get, "cas", "", 0)
+		if get.CAS == 0 {
+			t.Fatal("Expected a CAS, got 0.")
+		}
+
+		msg, err := protocol.NewCompareAndSet("cas", []byte("second"), 60, get.CAS, clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		first := sendMessage(t, addr, msg)
+		if first.Status != protocol.OK || first.CAS == get.CAS {
+			t.Errorf("Expected OK with a new CAS, got %s with %d", first.Status, first.CAS)
+		}
+
+		second := sendMessage(t, addr, msg)
+		if second.Code != protocol.Changed || second.CAS != first.CAS {
+			t.Errorf("Expected %s with CAS %d, got %s with %d", protocol.Changed, first.CAS, second.Code, second.CAS)
+		}
+
+		expected := "second"
+		actual := string(send(t, addr, protocol.Get, "cas", "", 0).Value)
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("TTL, EXPIRE and PERSIST", func(t *testing.T) {
+		before := send(t, addr, protocol.TTL, "cas", "", 0)
+		if before.Status != protocol.OK || before.Expires.IsZero() {
+			t.Fatalf("Expected OK with an expiry, got %s expiring %s", before.Status, before.Expires)
+		}
+
+		extended := send(t, addr, protocol.Expire, "cas", "", 3600)
+		if !extended.Expires.After(before.Expires) {
+			t.Errorf("Expected expiry after %s, got %s", before.Expires, extended.Expires)
+		}
+
+		after := send(t, addr, protocol.TTL, "cas", "", 0)
+		if !after.Expires.Equal(extended.Expires) {
+			t.Errorf("Expected expiry %s, got %s", extended.Expires, after.Expires)
+		}
+
+		send(t, addr, protocol.Persist, "cas", "", 0)
+		persisted := send(t, addr, protocol.TTL, "cas", "", 0)
+		if persisted.Status != protocol.OK || !persisted.Expires.IsZero() {
+			t.Errorf("Expected OK with no expiry, got %s expiring %s", persisted.Status, persisted.Expires)
+		}
+
+		missing := send(t, addr, protocol.TTL, "missing", "", 0)
+		if missing.Code != protocol.NotFound {
+			t.Errorf("Expected %s, got %s", protocol.NotFound, missing.Code)
+		}
+	})
+
+	t.Run("TTL under a second", func(t *testing.T) {
+		msg, err := protocol.NewMessageTTL(protocol.Set, "short", []byte("value"), time.Millisecond*200, clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		sendMessage(t, addr, msg)
+
+		response := send(t, addr, protocol.TTL, "short", "", 0)
+		remaining, err := strconv.Atoi(string(response.Value))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if remaining <= 0 || remaining > 200 {
+			t.Errorf("Expected under 200ms left, got %dms", remaining)
+		}
+
+		time.Sleep(time.Millisecond * 250)
+		response = send(t, addr, protocol.Get, "short", "", 0)
+		if response.Status != protocol.Failed {
+			t.Errorf("Expected 'short' to have expired, got %s '%s'", response.Status, response.Value)
+		}
+	})
+
+	t.Run("FLUSH returns the count", func(t *testing.T) {
+		send(t, addr, protocol.Set, "other", "value", 60)
+
+		flushed, err := send(t, addr, protocol.Flush, "", "", 0).Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if flushed != 5 {
+			t.Errorf("Expected 5 flushed, got %d", flushed)
+		}
+	})
+	t.Run("SCAN pages through matching keys", func(t *testing.T) {
+		for _, key := range []string{"scan:a", "scan:b", "scan:c", "other"} {
+			send(t, addr, protocol.Set, key, "value", 60)
+		}
+
+		keys := []string{}
+		cursor := ""
+		for {
+			msg, err := protocol.NewScan(cursor, "scan:*", 2, clock{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			page, next, err := sendMessage(t, addr, msg).Page()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			keys = append(keys, page...)
+			if next == "" {
+				break
+			}
+			cursor = next
+		}
+
+		expected := "scan:a scan:b scan:c"
+		actual := strings.Join(keys, " ")
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("ID is sent back", func(t *testing.T) {
+		msg, err := protocol.NewMessage(protocol.Get, "missing", []byte{}, 0, clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.ID = 1234
+
+		data, err := msg.MarshalBinary(clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, err = conn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := protocol.ReadResponse(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.ID != 1234 {
+			t.Errorf("Expected ID 1234, got %d", response.ID)
+		}
+	})
+
+	t.Run("Version 1 clients get version 1 responses", func(t *testing.T) {
+		send(t, addr, protocol.Set, "v1", "value", 60)
+
+		key := []byte("v1")
+		keyLen := make([]byte, 2)
+		binary.BigEndian.PutUint16(keyLen, uint16(len(key)))
+
+		data := []byte{protocol.VERSION_1, byte(protocol.Get)}
+		data = append(data, make([]byte, 8)...)
+		data = append(data, keyLen...)
+		data = append(data, 0, 0)
+		data = append(data, key...)
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		_, err = conn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		header := make([]byte, protocol.V1_RESPONSE_HEADER_SIZE)
+		_, err = io.ReadFull(conn, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if header[0] != protocol.VERSION_1 {
+			t.Errorf("Expected version %d, got %d", protocol.VERSION_1, header[0])
+		}
+
+		value := make([]byte, 5)
+		_, err = io.ReadFull(conn, value)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if string(value) != "value" {
+			t.Errorf("Expected 'value', got '%s'", value)
+		}
+	})
+}
+
+func TestValueSize(t *testing.T) {
+	addr := serve(t, server.Config{MaxValueSize: 100 * 1024})
+
+	t.Run("Values over 64 KB", func(t *testing.T) {
+		value := strings.Repeat("a", 70*1024)
+		set := send(t, addr, protocol.Set, "big", value, 60)
+		if set.Status != protocol.OK {
+			t.Fatalf("Expected OK, got %s: %s", set.Status, set.Value)
+		}
+
+		get := send(t, addr, protocol.Get, "big", "", 0)
+		if string(get.Value) != value {
+			t.Errorf("Expected %d bytes back, got %d", len(value), len(get.Value))
+		}
+	})
+
+	t.Run("Values over the max", func(t *testing.T) {
+		response := send(t, addr, protocol.Set, "too-big", strings.Repeat("a", 100*1024+1), 60)
+		if response.Code != protocol.TooLarge {
+			t.Errorf("Expected %s, got %s", protocol.TooLarge, response.Code)
+		}
+
+		expected := errors.New("Value of 102401 bytes is over the max of 102400.").Error()
+		actual := string(response.Value)
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Messages too large to read", func(t *testing.T) {
+		msg, err := protocol.NewMessage(protocol.Set, "huge", []byte(strings.Repeat("a", 1<<20)), 60, clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.ID = 42
+
+		data, err := msg.MarshalBinary(clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		go conn.Write(data)
+
+		response, err := protocol.ReadResponse(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if response.Code != protocol.TooLarge || response.ID != 42 {
+			t.Errorf("Expected %s for ID 42, got %s for ID %d", protocol.TooLarge, response.Code, response.ID)
+		}
+	})
+}
+
+func TestStats(t *testing.T) {
+	stats := func(t *testing.T, addr string) map[string]uint64 {
+		t.Helper()
+
+		list, err := send(t, addr, protocol.Stats, "", "", 0).Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		stats := map[string]uint64{}
+		for _, stat := range list {
+			stats[stat.Name] = stat.Value
+		}
+		return stats
+	}
+
+	t.Run("STATS counts reads and commands", func(t *testing.T) {
+		addr := serve(t, server.Config{})
+
+		send(t, addr, protocol.Set, "key", "value", 60)
+		send(t, addr, protocol.Set, "key", "value", 60)
+		send(t, addr, protocol.Get, "key", "", 0)
+		send(t, addr, protocol.Get, "missing", "", 0)
+
+		actual := stats(t, addr)
+		expected := map[string]uint64{
+			"items":       1,
+			"bytes":       8,
+			"hits":        1,
+			"misses":      1,
+			"evictions":   0,
+			"expirations": 0,
+			"set_calls":   2,
+			"set_errors":  0,
+			"get_calls":   2,
+			"get_errors":  1,
+		}
+		for name, value := range expected {
+			if actual[name] != value {
+				t.Errorf("Expected %s to be %d, got %d", name, value, actual[name])
+			}
+		}
+
+		// Earlier connections may not have been seen to close yet.
+		if actual["connections"] < 1 {
+			t.Errorf("Expected at least the connection asking, got %d", actual["connections"])
+		}
+
+		if _, ok := actual["get_usec"]; !ok {
+			t.Errorf("Expected get_usec, got %v", actual)
+		}
+
+		if _, ok := actual["delete_calls"]; ok {
+			t.Errorf("Expected no stats for DELETE, got %v", actual)
+		}
+	})
+
+	t.Run("Metrics in text format", func(t *testing.T) {
+		s, addr, _ := start(t, server.Config{CacheSize: 1})
+		send(t, addr, protocol.Set, "a", "1", 60)
+		send(t, addr, protocol.Set, "b", "2", 60)
+		send(t, addr, protocol.Get, "a", "", 0)
+
+		recorder := httptest.NewRecorder()
+		s.MetricsHandler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+
+		body := recorder.Body.String()
+		for _, expected := range []string{
+			"# TYPE cache_items gauge\ncache_items{namespace=\"default\"} 1\n",
+			"cache_misses_total{namespace=\"default\"} 1\n",
+			"cache_evictions_total{namespace=\"default\"} 1\n",
+			"cache_commands_total{command=\"set\"} 2\n",
+			"cache_command_errors_total{command=\"get\"} 1\n",
+			"# TYPE cache_command_duration_seconds histogram\n",
+			"cache_command_duration_seconds_bucket{command=\"get\",le=\"+Inf\"} 1\n",
+			"cache_command_duration_seconds_count{command=\"set\"} 2\n",
+		} {
+			if !strings.Contains(body, expected) {
+				t.Errorf("Expected '%s' in:\n%s", expected, body)
+			}
+		}
+	})
+}
+
+func TestShutdown(t *testing.T) {
+	shutdown := func(t *testing.T, s *server.Server) {
+		t.Helper()
+
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+
+		err := s.Shutdown(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	t.Run("Serve returns and idle connections are closed", func(t *testing.T) {
+		s, addr, served := start(t, server.Config{})
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// Make sure it's been accepted before shutting down.
+		send(t, addr, protocol.Usage, "", "", 0)
+		shutdown(t, s)
+
+		err = <-served
+		if !errors.Is(err, server.ErrServerClosed) {
+			t.Errorf("Expected '%s', got '%v'", server.ErrServerClosed, err)
+		}
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("Expected EOF, got '%v'", err)
+		}
+
+		_, err = net.Dial("tcp", addr)
+		if err == nil {
+			t.Error("Expected new connections to be refused.")
+		}
+	})
+
+	t.Run("Log and snapshot saved", func(t *testing.T) {
+		for name, cfg := range map[string]server.Config{
+			"Log":      {AOFPath: filepath.Join(t.TempDir(), "cache.aof")},
+			"Snapshot": {SnapshotPath: filepath.Join(t.TempDir(), "cache.snapshot")},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, addr, _ := start(t, cfg)
+				send(t, addr, protocol.Set, "key", "value", 60)
+				shutdown(t, s)
+
+				restarted := serve(t, cfg)
+				eventually(t, restarted, "key", "value")
+			})
+		}
+	})
+
+	t.Run("Snapshot restored when the log is turned on", func(t *testing.T) {
+		dir := t.TempDir()
+		cfg := server.Config{SnapshotPath: filepath.Join(dir, "cache.snapshot")}
+		s, addr, _ := start(t, cfg)
+		send(t, addr, protocol.Set, "key", "value", 60)
+		shutdown(t, s)
+
+		cfg.AOFPath = filepath.Join(dir, "cache.aof")
+		s, addr, _ = start(t, cfg)
+		eventually(t, addr, "key", "value")
+		shutdown(t, s)
+
+		// Not saved over by an empty cache either.
+		cfg.AOFPath = ""
+		restarted := serve(t, cfg)
+		eventually(t, restarted, "key", "value")
+	})
+}
+
+func TestConnections(t *testing.T) {
+	// Sends the message on an open connection.
+	roundTrip := func(t *testing.T, conn net.Conn, cmd protocol.Command) protocol.Response {
+		t.Helper()
+
+		msg, err := protocol.NewMessage(cmd, "", []byte{}, 0, clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data, err := msg.MarshalBinary(clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = conn.Write(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		response, err := protocol.ReadResponse(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	t.Run("Idle connections time out", func(t *testing.T) {
+		addr := serve(t, server.Config{ReadTimeout: 50 * time.Millisecond})
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		roundTrip(t, conn, protocol.Usage)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("Expected EOF, got '%v'", err)
+		}
+	})
+
+	t.Run("Connections over the max are closed", func(t *testing.T) {
+		addr := serve(t, server.Config{MaxConnections: 1})
+
+		first, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer first.Close()
+
+		roundTrip(t, first, protocol.Usage)
+
+		second, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer second.Close()
+
+		second.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = second.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("Expected EOF, got '%v'", err)
+		}
+
+		stats, err := roundTrip(t, first, protocol.Stats).Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, stat := range stats {
+			if stat.Name == "rejected_connections" && stat.Value != 1 {
+				t.Errorf("Expected 1 rejected connection, got %d", stat.Value)
+			}
+		}
+	})
+}
+
+func TestErrors(t *testing.T) {
+	addr := serve(t, server.Config{MaxValueSize: 1024})
+
+	// Sends raw messages on one connection, reading a response to each.
+	exchange := func(t *testing.T, conn net.Conn, data []byte) protocol.Response {
+		t.Helper()
+
+		go conn.Write(data)
+
+		conn.SetReadDeadline(time.Now().Add(time.Second))
+		response, err := protocol.ReadResponse(conn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return response
+	}
+
+	encode := func(t *testing.T, cmd protocol.Command, key string, data string, ttl int, id uint32) []byte {
+		t.Helper()
+
+		msg, err := protocol.NewMessage(cmd, key, []byte(data), ttl, clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		msg.ID = id
+
+		encoded, err := msg.MarshalBinary(clock{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return encoded
+	}
+
+	t.Run("Connection kept open after errors", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		// A TTL of -1s, which no client would send.
+		ttl := int64(-1000)
+		pastExpiry := encode(t, protocol.Set, "key", "value", 60, 2)
+		binary.BigEndian.PutUint64(pastExpiry[6:14], uint64(ttl))
+
+		badCommand := encode(t, protocol.Get, "key", "", 0, 3)
+		badCommand[1] = 99
+
+		tooLong := encode(t, protocol.Set, "key", "value", 60, 7)
+		binary.BigEndian.PutUint64(tooLong[6:14], 1<<53)
+
+		tests := []struct {
+			name     string
+			data     []byte
+			id       uint32
+			expected protocol.ErrorCode
+		}{
+			{"Missing key", encode(t, protocol.Get, "missing", "", 0, 1), 1, protocol.NotFound},
+			{"Expiry in the past", pastExpiry, 2, protocol.BadRequest},
+			{"Unknown command", badCommand, 3, protocol.BadRequest},
+			{"Value over the max", encode(t, protocol.Set, "key", strings.Repeat("a", 2048), 60, 4), 4, protocol.TooLarge},
+			{"Message over the max", encode(t, protocol.Set, "key", strings.Repeat("a", 1<<17), 60, 5), 5, protocol.TooLarge},
+			{"Not a counter", encode(t, protocol.Incr, "text", "", 60, 6), 6, protocol.NotInteger},
+			{"TTL too large", tooLong, 7, protocol.BadRequest},
+		}
+
+		exchange(t, conn, encode(t, protocol.Set, "text", "a", 60, 0))
+
+		for _, tc := range tests {
+			response := exchange(t, conn, tc.data)
+			if response.Code != tc.expected || response.ID != tc.id {
+				t.Errorf("%s: expected %s for ID %d, got %s for ID %d: %s", tc.name, tc.expected, tc.id, response.Code, response.ID, response.Value)
+			}
+		}
+
+		response := exchange(t, conn, encode(t, protocol.Get, "text", "", 0, 8))
+		if response.Status != protocol.OK || string(response.Value) != "a" {
+			t.Errorf("Expected 'a', got %s: %s", response.Status, response.Value)
+		}
+	})
+
+	t.Run("Framing errors close the connection", func(t *testing.T) {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		response := exchange(t, conn, []byte{99, 1, 2, 3})
+		if response.Code != protocol.BadRequest {
+			t.Errorf("Expected %s, got %s", protocol.BadRequest, response.Code)
+		}
+
+		_, err = conn.Read(make([]byte, 1))
+		if err != io.EOF {
+			t.Errorf("Expected EOF, got '%v'", err)
+		}
+	})
+}
+
+func TestNamespaces(t *testing.T) {
+	namespaces := []server.Namespace{{Name: "sessions"}, {Name: "small", CacheSize: 1}}
+
+	// Selects the namespace on a new connection then sends the message,
+	// returning both responses.
+	sendIn := func(t *testing.T, addr string, namespace string, cmd protocol.Command, key string, data string, ttl int) (protocol.Response, protocol.Response) {
+		t.Helper()
+
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+
+		responses := []protocol.Response{}
+		for _, msg := range []struct {
+			cmd  protocol.Command
+			key  string
+			data string
+			ttl  int
+		}{{protocol.Select, namespace, "", 0}, {cmd, key, data, ttl}} {
+			encoded, err := protocol.NewMessage(msg.cmd, msg.key, []byte(msg.data), msg.ttl, clock{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			data, err := encoded.MarshalBinary(clock{})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = conn.Write(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			response, err := protocol.ReadResponse(conn)
+			if err != nil {
+				t.Fatal(err)
+			}
+			responses = append(responses, response)
+		}
+		return responses[0], responses[1]
+	}
+
+	get := func(t *testing.T, addr string, namespace string, key string) string {
+		t.Helper()
+
+		_, response := sendIn(t, addr, namespace, protocol.Get, key, "", 0)
+		return string(response.Value)
+	}
+
+	t.Run("Keys are kept apart", func(t *testing.T) {
+		addr := serve(t, server.Config{Namespaces: namespaces})
+		send(t, addr, protocol.Set, "key", "default", 60)
+		sendIn(t, addr, "sessions", protocol.Set, "key", "sessions", 60)
+
+		for namespace, expected := range map[string]string{
+			server.DEFAULT_NAMESPACE: "default",
+			"sessions":               "sessions",
+			"small":                  "Value doesn't exist.",
+		} {
+			actual := get(t, addr, namespace, "key")
+			if actual != expected {
+				t.Errorf("%s: expected '%s', got '%s'", namespace, expected, actual)
+			}
+		}
+	})
+
+	t.Run("Each has its own limits", func(t *testing.T) {
+		addr := serve(t, server.Config{CacheSize: 10, Namespaces: namespaces})
+		for _, key := range []string{"a", "b", "c"} {
+			send(t, addr, protocol.Set, key, "1", 60)
+			sendIn(t, addr, "small", protocol.Set, key, "1", 60)
+		}
+
+		for namespace, expected := range map[string]uint64{server.DEFAULT_NAMESPACE: 3, "small": 1} {
+			_, response := sendIn(t, addr, namespace, protocol.Usage, "", "", 0)
+			items, _, err := response.Usage()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if items != expected {
+				t.Errorf("%s: expected %d items, got %d", namespace, expected, items)
+			}
+		}
+	})
+
+	t.Run("FLUSH and STATS only cover the selected namespace", func(t *testing.T) {
+		addr := serve(t, server.Config{Namespaces: namespaces})
+		send(t, addr, protocol.Set, "a", "1", 60)
+		sendIn(t, addr, "sessions", protocol.Set, "a", "1", 60)
+		sendIn(t, addr, "sessions", protocol.Set, "b", "1", 60)
+
+		_, response := sendIn(t, addr, "sessions", protocol.Flush, "", "", 0)
+		flushed, err := response.Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if flushed != 2 {
+			t.Errorf("Expected 2 flushed, got %d", flushed)
+		}
+
+		actual := get(t, addr, server.DEFAULT_NAMESPACE, "a")
+		if actual != "1" {
+			t.Errorf("Expected '1', got '%s'", actual)
+		}
+
+		sendIn(t, addr, "sessions", protocol.Get, "a", "", 0)
+		for namespace, expected := range map[string]map[string]uint64{
+			server.DEFAULT_NAMESPACE: {"items": 1, "hits": 1, "misses": 0},
+			"sessions":               {"items": 0, "hits": 0, "misses": 1},
+		} {
+			_, response := sendIn(t, addr, namespace, protocol.Stats, "", "", 0)
+			stats, err := response.Stats()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			for _, stat := range stats {
+				value, ok := expected[stat.Name]
+				if ok && stat.Value != value {
+					t.Errorf("%s: expected %s of %d, got %d", namespace, stat.Name, value, stat.Value)
+				}
+			}
+		}
+	})
+
+	t.Run("Unknown namespaces aren't selected", func(t *testing.T) {
+		addr := serve(t, server.Config{Namespaces: namespaces})
+		send(t, addr, protocol.Set, "key", "value", 60)
+
+		selected, response := sendIn(t, addr, "missing", protocol.Get, "key", "", 0)
+		if selected.Code != protocol.NotFound {
+			t.Errorf("Expected %s, got %s", protocol.NotFound, selected.Code)
+		}
+
+		if string(response.Value) != "value" {
+			t.Errorf("Expected 'value', got '%s'", response.Value)
+		}
+	})
+
+	t.Run("Invalid namespaces", func(t *testing.T) {
+		for name, invalid := range map[string][]server.Namespace{
+			"Default":   {{Name: server.DEFAULT_NAMESPACE}},
+			"Duplicate": {{Name: "a"}, {Name: "a"}},
+			"Empty":     {{Name: ""}},
+			"Path":      {{Name: "../a"}},
+		} {
+			_, err := server.NewServer(server.Config{Namespaces: invalid})
+			if err == nil {
+				t.Errorf("%s: expected an error", name)
+			}
+		}
+	})
+
+	t.Run("Parsed from flags", func(t *testing.T) {
+		parsed, err := server.ParseNamespaces("sessions,small:1,tiny:2:1024")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		expected := []server.Namespace{{"sessions", 0, 0}, {"small", 1, 0}, {"tiny", 2, 1024}}
+		if len(parsed) != len(expected) {
+			t.Fatalf("Expected %v, got %v", expected, parsed)
+		}
+
+		for i := range expected {
+			if parsed[i] != expected[i] {
+				t.Errorf("Expected %v, got %v", expected[i], parsed[i])
+			}
+		}
+
+		for _, invalid := range []string{"a:b", "a:1:2:3", "a:-1"} {
+			_, err := server.ParseNamespaces(invalid)
+			if err == nil {
+				t.Errorf("Expected an error for '%s'", invalid)
+			}
+		}
+	})
+
+	t.Run("Log and snapshot saved for each", func(t *testing.T) {
+		for name, cfg := range map[string]server.Config{
+			"Log":      {AOFPath: filepath.Join(t.TempDir(), "cache.aof"), Namespaces: namespaces},
+			"Snapshot": {SnapshotPath: filepath.Join(t.TempDir(), "cache.snapshot"), Namespaces: namespaces},
+		} {
+			t.Run(name, func(t *testing.T) {
+				s, addr, _ := start(t, cfg)
+				send(t, addr, protocol.Set, "key", "default", 60)
+				sendIn(t, addr, "sessions", protocol.Set, "key", "sessions", 60)
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+
+				err := s.Shutdown(ctx)
+				if err != nil {
+					t.Fatal(err)
+				}
+
+				restarted := serve(t, cfg)
+				for _, namespace := range []string{server.DEFAULT_NAMESPACE, "sessions"} {
+					actual := get(t, restarted, namespace, "key")
+					if actual != namespace {
+						t.Errorf("Expected '%s', got '%s'", namespace, actual)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("Replicated to followers", func(t *testing.T) {
+		leader := serve(t, server.Config{Namespaces: namespaces})
+		sendIn(t, leader, "sessions", protocol.Set, "before", "1", 60)
+
+		follower := serve(t, server.Config{LeaderAddr: leader, Namespaces: namespaces})
+		sendIn(t, leader, "sessions", protocol.Set, "after", "2", 60)
+		send(t, leader, protocol.Set, "after", "default", 60)
+
+		for _, tc := range []struct {
+			namespace string
+			key       string
+			expected  string
+		}{
+			{"sessions", "before", "1"},
+			{"sessions", "after", "2"},
+			{server.DEFAULT_NAMESPACE, "after", "default"},
+			{server.DEFAULT_NAMESPACE, "before", "Value doesn't exist."},
+		} {
+			var actual string
+			for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); {
+				actual = get(t, follower, tc.namespace, tc.key)
+				if actual == tc.expected {
+					break
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			if actual != tc.expected {
+				t.Errorf("%s: expected '%s', got '%s'", tc.namespace, tc.expected, actual)
+			}
+		}
+	})
+}
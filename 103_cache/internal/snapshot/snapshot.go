@@ -0,0 +1,171 @@
+package snapshot
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
+)
+
+// Magic (4B) | Version (1B) | Count (8B) | Entries
+// Entry: Expires (8B, Unix nanoseconds, 0 == never) | KeyLen (4B) | ValueLen (4B) | Key (x) | Value (x)
+const VERSION byte = 1
+const HEADER_SIZE = 13
+const ENTRY_HEADER_SIZE = 16
+
+var magic = []byte("HRCS")
+
+func Write(w io.Writer, items []cache.Node) error {
+	header := make([]byte, 0, HEADER_SIZE)
+	header = append(header, magic...)
+	header = append(header, VERSION)
+	header = binary.BigEndian.AppendUint64(header, uint64(len(items)))
+
+	_, err := w.Write(header)
+	if err != nil {
+		return err
+	}
+
+	for _, item := range items {
+		var expires int64 // 0 == never expires
+		if !item.Expire.IsZero() {
+			expires = item.Expire.UnixNano()
+		}
+
+		entry := make([]byte, 0, ENTRY_HEADER_SIZE+len(item.Key)+len(item.Value))
+		entry = binary.BigEndian.AppendUint64(entry, uint64(expires))
+		entry = binary.BigEndian.AppendUint32(entry, uint32(len(item.Key)))
+		entry = binary.BigEndian.AppendUint32(entry, uint32(len(item.Value)))
+		entry = append(entry, item.Key...)
+		entry = append(entry, item.Value...)
+
+		_, err = w.Write(entry)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func Read(r io.Reader) ([]cache.Node, error) {
+	header := make([]byte, HEADER_SIZE)
+	_, err := io.ReadFull(r, header)
+	if err != nil {
+		return nil, errors.New(fmt.Sprint("Couldn't read snapshot header: ", err))
+	}
+
+	if string(header[:4]) != string(magic) {
+		return nil, errors.New("Not a snapshot.")
+	}
+
+	if header[4] != VERSION {
+		return nil, errors.New("Version mismatch.")
+	}
+
+	count := binary.BigEndian.Uint64(header[5:13])
+
+	items := []cache.Node{}
+	entryHeader := make([]byte, ENTRY_HEADER_SIZE)
+	for range count {
+		_, err = io.ReadFull(r, entryHeader)
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Couldn't read snapshot entry: ", err))
+		}
+
+		expires := int64(binary.BigEndian.Uint64(entryHeader[0:8]))
+		lenKey := binary.BigEndian.Uint32(entryHeader[8:12])
+		lenValue := binary.BigEndian.Uint32(entryHeader[12:16])
+
+		// Added as int64 so they can't wrap, and read as they come rather than
+		// allocated up front, so a corrupt length runs out of file instead of
+		// asking for gigabytes.
+		var buf bytes.Buffer
+		_, err = io.CopyN(&buf, r, int64(lenKey)+int64(lenValue))
+		if err != nil {
+			return nil, errors.New(fmt.Sprint("Couldn't read snapshot entry: ", err))
+		}
+		body := buf.Bytes()
+
+		var expire time.Time
+		if expires != 0 {
+			expire = time.Unix(0, expires).UTC()
+		}
+
+		items = append(items, cache.Node{
+			Key:    string(body[:lenKey]),
+			Value:  body[lenKey:],
+			Expire: expire,
+		})
+	}
+	return items, nil
+}
+
+// Save writes everything in the cache to path. The snapshot is written to a
+// temporary file first so a crash mid-write can't clobber the last good one.
+func Save(path string, c cache.Cache) error {
+	tmp := path + ".tmp"
+
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp)
+	defer f.Close()
+
+	w := bufio.NewWriter(f)
+	err = Write(w, c.Items())
+	if err != nil {
+		return err
+	}
+
+	err = w.Flush()
+	if err != nil {
+		return err
+	}
+
+	err = f.Sync()
+	if err != nil {
+		return err
+	}
+
+	err = f.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// Load restores the snapshot at path into the cache, returning how many items
+// were restored. Items that have expired since the snapshot was taken, or that
+// no longer fit in the cache, are skipped.
+func Load(path string, c cache.Cache, clock cache.Clock) (restored int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	items, err := Read(bufio.NewReader(f))
+	if err != nil {
+		return 0, err
+	}
+
+	for _, item := range items {
+		if !item.Expire.IsZero() && clock.Expired(item.Expire) {
+			continue
+		}
+
+		_, err = c.Set(item.Key, string(item.Value), item.Expire)
+		if err != nil {
+			continue
+		}
+		restored++
+	}
+	return restored, nil
+}
@@ -0,0 +1,282 @@
+package snapshot_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/todaatsushi/handrolled-cache/internal/cache"
+	"github.com/todaatsushi/handrolled-cache/internal/snapshot"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c clock) Now() time.Time {
+	return c.now
+}
+
+func (c clock) Expired(t time.Time) bool {
+	return t.Before(c.now)
+}
+
+func newClock() clock {
+	t, _ := time.Parse(time.RFC3339, "2069-04-20T15:00:00Z")
+	return clock{t}
+}
+
+func TestWriteRead(t *testing.T) {
+	t.Run("Round trip", func(t *testing.T) {
+		now := newClock().Now()
+		expected := []cache.Node{
+			{Key: "key", Value: []byte("420"), Expire: now.Add(time.Minute)},
+			{Key: "other", Value: []byte("line\nbreak"), Expire: now.Add(time.Millisecond * 1500)},
+		}
+
+		var buf bytes.Buffer
+		err := snapshot.Write(&buf, expected)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		actual, err := snapshot.Read(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if len(actual) != len(expected) {
+			t.Fatalf("Expected %d items, got %d", len(expected), len(actual))
+		}
+
+		for i, e := range expected {
+			a := actual[i]
+
+			if a.Key != e.Key {
+				t.Errorf("Expected key '%s', got '%s'", e.Key, a.Key)
+			}
+
+			if string(a.Value) != string(e.Value) {
+				t.Errorf("Expected value '%s', got '%s'", e.Value, a.Value)
+			}
+
+			if !a.Expire.Equal(e.Expire) {
+				t.Errorf("Expected expires '%s', got '%s'", e.Expire, a.Expire)
+			}
+		}
+	})
+
+	t.Run("Not a snapshot", func(t *testing.T) {
+		_, err := snapshot.Read(bytes.NewReader([]byte("not a snapshot at all")))
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Not a snapshot.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Version mismatch", func(t *testing.T) {
+		var buf bytes.Buffer
+		err := snapshot.Write(&buf, []cache.Node{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := buf.Bytes()
+		data[4] = snapshot.VERSION + 1
+
+		_, err = snapshot.Read(bytes.NewReader(data))
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+
+		expected := errors.New("Version mismatch.").Error()
+		actual := err.Error()
+
+		if actual != expected {
+			t.Errorf("Expected '%s', got '%s'", expected, actual)
+		}
+	})
+
+	t.Run("Truncated", func(t *testing.T) {
+		var buf bytes.Buffer
+		items := []cache.Node{
+			{Key: "key", Value: []byte("420"), Expire: newClock().Now()},
+		}
+
+		err := snapshot.Write(&buf, items)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := buf.Bytes()
+		_, err = snapshot.Read(bytes.NewReader(data[:len(data)-1]))
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+	})
+
+	t.Run("Lengths that add up past 32 bits", func(t *testing.T) {
+		var buf bytes.Buffer
+		items := []cache.Node{
+			{Key: "key", Value: []byte("420"), Expire: newClock().Now()},
+		}
+
+		err := snapshot.Write(&buf, items)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		data := buf.Bytes()
+		binary.BigEndian.PutUint32(data[snapshot.HEADER_SIZE+8:], math.MaxUint32)
+		binary.BigEndian.PutUint32(data[snapshot.HEADER_SIZE+12:], 1)
+
+		_, err = snapshot.Read(bytes.NewReader(data))
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+	})
+}
+
+func TestSaveLoad(t *testing.T) {
+	t.Run("Restore into new store", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+		original := cache.NewStore(0, c)
+		for i := range 10 {
+			_, err := original.Set(fmt.Sprint(i), fmt.Sprint(i), c.Now().Add(time.Hour))
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		err := snapshot.Save(path, original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restored := cache.NewStore(0, c)
+		n, err := snapshot.Load(path, restored, c)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 10 {
+			t.Errorf("Expected %d restored, got %d", 10, n)
+		}
+
+		for i := range 10 {
+			value, err := restored.Get(fmt.Sprint(i))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if string(value) != fmt.Sprint(i) {
+				t.Errorf("Expected '%d', got '%s'", i, value)
+			}
+		}
+	})
+
+	t.Run("Skip expired", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+		original := cache.NewShardedStore(4, cache.Options{}, c)
+		_, err := original.Set("short", "1", c.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = original.Set("long", "2", c.Now().Add(time.Hour))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = snapshot.Save(path, original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Restart ten minutes later.
+		later := clock{c.Now().Add(time.Minute * 10)}
+		restored := cache.NewStore(0, later)
+
+		n, err := snapshot.Load(path, restored, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if n != 1 {
+			t.Errorf("Expected %d restored, got %d", 1, n)
+		}
+
+		_, err = restored.Get("short")
+		if err == nil {
+			t.Error("Expected 'short' to have expired")
+		}
+
+		_, err = restored.Get("long")
+		if err != nil {
+			t.Error(err)
+		}
+	})
+
+	t.Run("Keys without an expiry", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "cache.snapshot")
+
+		original := cache.NewStore(0, c)
+		_, err := original.Set("kept", "1", c.Now().Add(time.Minute))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = original.Expire("kept", time.Time{})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = snapshot.Save(path, original)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// Long after it would have expired.
+		later := clock{c.Now().Add(time.Hour * 24)}
+		restored := cache.NewStore(0, later)
+		_, err = snapshot.Load(path, restored, later)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		node, err := restored.Lookup("kept")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !node.Expire.IsZero() {
+			t.Errorf("Expected no expiry, got %s", node.Expire)
+		}
+	})
+
+	t.Run("Missing file", func(t *testing.T) {
+		c := newClock()
+		path := filepath.Join(t.TempDir(), "missing.snapshot")
+
+		_, err := snapshot.Load(path, cache.NewStore(0, c), c)
+		if err == nil {
+			t.Fatal("Expected err, got nil.")
+		}
+	})
+}
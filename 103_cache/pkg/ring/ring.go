@@ -0,0 +1,147 @@
+// Package ring is a consistent hash ring, mapping keys to nodes so adding or
+// removing a node only moves the keys on either side of it.
+package ring
+
+import (
+	"hash/fnv"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// Virtual nodes per node if not given, enough to spread keys within a few
+// percent of even.
+const DEFAULT_REPLICAS = 160
+
+// Ring is safe for concurrent use. The same nodes and replicas always give the
+// same mapping, so separate processes agree on where a key lives.
+type Ring struct {
+	mu       sync.RWMutex
+	replicas int
+	hashes   []uint64 // Sorted points on the ring
+	owners   map[uint64]string
+	nodes    map[string]struct{}
+}
+
+func New(replicas int, nodes ...string) *Ring {
+	if replicas <= 0 {
+		replicas = DEFAULT_REPLICAS
+	}
+
+	r := &Ring{
+		replicas: replicas,
+		owners:   map[uint64]string{},
+		nodes:    map[string]struct{}{},
+	}
+	for _, node := range nodes {
+		r.Add(node)
+	}
+	return r
+}
+
+func hash(s string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(s))
+
+	// FNV alone clusters similar strings like "node#1" and "node#2".
+	x := h.Sum64()
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
+
+func (r *Ring) Add(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.nodes[node]
+	if ok {
+		return
+	}
+	r.nodes[node] = struct{}{}
+
+	for i := 0; i < r.replicas; i++ {
+		h := hash(node + "#" + strconv.Itoa(i))
+
+		// Another node already has the point, only one can own it.
+		_, taken := r.owners[h]
+		if taken {
+			continue
+		}
+
+		r.owners[h] = node
+		r.hashes = append(r.hashes, h)
+	}
+	slices.Sort(r.hashes)
+}
+
+func (r *Ring) Remove(node string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.nodes[node]
+	if !ok {
+		return
+	}
+	delete(r.nodes, node)
+
+	hashes := r.hashes[:0]
+	for _, h := range r.hashes {
+		if r.owners[h] == node {
+			delete(r.owners, h)
+			continue
+		}
+		hashes = append(hashes, h)
+	}
+	r.hashes = hashes
+}
+
+// Get returns the node which owns the key, false if the ring is empty.
+func (r *Ring) Get(key string) (string, bool) {
+	nodes := r.GetN(key, 1)
+	if len(nodes) == 0 {
+		return "", false
+	}
+	return nodes[0], true
+}
+
+// GetN returns up to n distinct nodes for the key in ring order, the owner
+// first followed by the nodes to fall back to if it's unavailable.
+func (r *Ring) GetN(key string, n int) []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	n = min(n, len(r.nodes))
+	if n <= 0 {
+		return []string{}
+	}
+
+	h := hash(key)
+	start := sort.Search(len(r.hashes), func(i int) bool { return r.hashes[i] >= h })
+
+	nodes := make([]string, 0, n)
+	for i := 0; i < len(r.hashes) && len(nodes) < n; i++ {
+		node := r.owners[r.hashes[(start+i)%len(r.hashes)]]
+		if !slices.Contains(nodes, node) {
+			nodes = append(nodes, node)
+		}
+	}
+	return nodes
+}
+
+// Nodes returns every node on the ring, sorted.
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
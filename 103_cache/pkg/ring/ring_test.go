@@ -0,0 +1,143 @@
+package ring_test
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/todaatsushi/handrolled-cache/pkg/ring"
+)
+
+func keys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+	}
+	return keys
+}
+
+func owners(r *ring.Ring, keys []string) map[string]string {
+	owners := map[string]string{}
+	for _, key := range keys {
+		node, ok := r.Get(key)
+		if !ok {
+			panic("Empty ring")
+		}
+		owners[key] = node
+	}
+	return owners
+}
+
+func TestRing(t *testing.T) {
+	t.Run("Empty ring", func(t *testing.T) {
+		r := ring.New(0)
+
+		_, ok := r.Get("key")
+		if ok {
+			t.Error("Expected no node")
+		}
+
+		nodes := r.GetN("key", 3)
+		if len(nodes) != 0 {
+			t.Errorf("Expected no nodes, got %v", nodes)
+		}
+	})
+
+	t.Run("Same nodes give the same mapping", func(t *testing.T) {
+		a := ring.New(0, "a:1", "b:1", "c:1")
+		b := ring.New(0, "c:1", "a:1", "b:1")
+
+		expected := owners(a, keys(1000))
+		actual := owners(b, keys(1000))
+		for key, node := range expected {
+			if actual[key] != node {
+				t.Fatalf("Expected '%s' on '%s', got '%s'", key, node, actual[key])
+			}
+		}
+	})
+
+	t.Run("Keys spread evenly", func(t *testing.T) {
+		nodes := []string{"a:1", "b:1", "c:1", "d:1"}
+		r := ring.New(0, nodes...)
+
+		counts := map[string]int{}
+		for _, node := range owners(r, keys(10000)) {
+			counts[node]++
+		}
+
+		for _, node := range nodes {
+			// Even would be 2500 each
+			if counts[node] < 1800 || counts[node] > 3200 {
+				t.Errorf("Expected roughly 2500 keys on '%s', got %d", node, counts[node])
+			}
+		}
+	})
+
+	t.Run("Adding a node only moves keys to it", func(t *testing.T) {
+		r := ring.New(0, "a:1", "b:1", "c:1", "d:1")
+		before := owners(r, keys(10000))
+
+		r.Add("e:1")
+		after := owners(r, keys(10000))
+
+		moved := 0
+		for key, node := range after {
+			if node == before[key] {
+				continue
+			}
+
+			moved++
+			if node != "e:1" {
+				t.Fatalf("Expected '%s' to stay on '%s' or move to 'e:1', got '%s'", key, before[key], node)
+			}
+		}
+
+		// Even would be 1/5
+		if moved < 1400 || moved > 2600 {
+			t.Errorf("Expected roughly 2000 keys to move, got %d", moved)
+		}
+	})
+
+	t.Run("Removing a node only moves its keys", func(t *testing.T) {
+		r := ring.New(0, "a:1", "b:1", "c:1", "d:1")
+		before := owners(r, keys(10000))
+
+		r.Remove("b:1")
+		after := owners(r, keys(10000))
+
+		for key, node := range after {
+			if before[key] != "b:1" && node != before[key] {
+				t.Fatalf("Expected '%s' to stay on '%s', got '%s'", key, before[key], node)
+			}
+
+			if node == "b:1" {
+				t.Fatalf("Expected '%s' to move off removed node", key)
+			}
+		}
+
+		expected := fmt.Sprint([]string{"a:1", "c:1", "d:1"})
+		actual := fmt.Sprint(r.Nodes())
+		if actual != expected {
+			t.Errorf("Expected %s, got %s", expected, actual)
+		}
+	})
+
+	t.Run("GetN returns distinct fallbacks", func(t *testing.T) {
+		r := ring.New(0, "a:1", "b:1", "c:1")
+
+		for _, key := range keys(100) {
+			nodes := r.GetN(key, 5)
+			if len(nodes) != 3 {
+				t.Fatalf("Expected 3 nodes, got %v", nodes)
+			}
+
+			owner, _ := r.Get(key)
+			if nodes[0] != owner {
+				t.Fatalf("Expected owner '%s' first, got %v", owner, nodes)
+			}
+
+			if nodes[0] == nodes[1] || nodes[1] == nodes[2] || nodes[0] == nodes[2] {
+				t.Fatalf("Expected distinct nodes, got %v", nodes)
+			}
+		}
+	})
+}